@@ -0,0 +1,523 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+)
+
+// byte halves of the registers interrupt services take arguments and return results in
+var (
+	regAL = RegisterAccess{Register_a, 0, 1}
+	regAH = RegisterAccess{Register_a, 1, 1}
+	regBL = RegisterAccess{Register_b, 0, 1}
+	regBH = RegisterAccess{Register_b, 1, 1}
+	regCL = RegisterAccess{Register_c, 0, 1}
+	regCH = RegisterAccess{Register_c, 1, 1}
+	regDL = RegisterAccess{Register_d, 0, 1}
+	regDH = RegisterAccess{Register_d, 1, 1}
+	regAX = RegisterAccess{Register_a, 0, 2}
+	regBX = RegisterAccess{Register_b, 0, 2}
+	regCX = RegisterAccess{Register_c, 0, 2}
+	regDX = RegisterAccess{Register_d, 0, 2}
+)
+
+// cyclesPerTick is how long one 18.2Hz timer tick is on a 4.77MHz pc, the pit divides the cpu clock by 4 then 65536
+const cyclesPerTick = 4 * 65536
+
+// Bios implements enough of the pc bios in go for programs to print, read keys, check the time and read a disk.
+// Scroll, cursor and character writes go to video memory so the screen can be shown, teletype output is also
+// written to Out as plain text
+type Bios struct {
+	Out      io.Writer
+	Log      io.Writer     // calls that aren't implemented or fail are reported here
+	Keys     *bufio.Reader // scripted keyboard input, nil when there's none
+	Keyboard *Keyboard     // the controller -kbd scancodes come through, used ahead of Keys while it has any
+	Disk     []byte        // disk image for int 13h, nil when there's none
+
+	VideoMode    uint8
+	CursorRow    uint8
+	CursorColumn uint8
+	TickBase     int   // ticks are counted from here, int 1ah ah=01 moves it
+	ShiftFlags   uint8 // shift keys held down on the keyboard as int 16h ah=02 reports them
+	VideoReady   bool  // video memory has been cleared for the mode, the first int 10h call does it
+
+	pendingKey int // key int 16h ah=01 looked at but didn't take, -1 when there isn't one
+}
+
+// NewBios makes a bios in 80x25 colour text mode, keys and disk can be nil
+func NewBios(out, log io.Writer, keys io.Reader, disk []byte) *Bios {
+	b := &Bios{Out: out, Log: log, Disk: disk, VideoMode: 3, pendingKey: -1}
+	if keys != nil {
+		b.Keys = bufio.NewReader(keys)
+	}
+	return b
+}
+
+// Install hooks the bios interrupts and saves its state with snapshots
+func (b *Bios) Install() {
+	InterruptHandlers[0x10] = b.video
+	InterruptHandlers[0x13] = b.disk
+	InterruptHandlers[0x16] = b.keyboard
+	InterruptHandlers[0x1a] = b.clock
+	SnapshotDevices = append(SnapshotDevices, b)
+}
+
+// InitVideo clears the screen the way a real bios setting the video mode while booting does, light grey on black
+// spaces. It waits until it's needed so programs that never use the screen keep their memory as they left it
+func (b *Bios) InitVideo() {
+	if b.VideoReady {
+		return
+	}
+	b.VideoReady = true
+	if b.isTextMode() {
+		b.scroll(0, 0x07, 0, 0, 24, b.columns()-1)
+	}
+}
+
+// StartBios sets up the bios for a run from command line options, empty file names mean no keyboard input or disk
+// and "-" reads keys from stdin. Keys typed on keyboard come first
+func StartBios(keysFileName, diskFileName string, keyboard *Keyboard) (*Bios, error) {
+	var keys io.Reader
+	switch keysFileName {
+	case "":
+	case "-":
+		keys = os.Stdin
+	default:
+		file, err := os.Open(keysFileName)
+		if err != nil {
+			return nil, err
+		}
+		keys = file
+	}
+
+	var disk []byte
+	if diskFileName != "" {
+		var err error
+		if disk, err = os.ReadFile(diskFileName); err != nil {
+			return nil, err
+		}
+	}
+	bios := NewBios(os.Stdout, os.Stderr, keys, disk)
+	bios.Keyboard = keyboard
+	bios.Install()
+	return bios, nil
+}
+
+func (b *Bios) unimplemented(vector uint8) {
+	fmt.Fprintf(b.Log, "bios: int %02xh ah=%02xh isn't implemented\n", vector, ReadRegister(regAH))
+	CpuFlagValues[CarryFlag] = true
+}
+
+// isTextMode is true for the modes where video memory holds characters and attributes
+func (b *Bios) isTextMode() bool {
+	return b.VideoMode <= 3 || b.VideoMode == 7
+}
+
+func (b *Bios) columns() uint8 {
+	if b.VideoMode <= 1 {
+		return 40
+	}
+	return 80
+}
+
+// textAddress is where the character at row, column lives in video memory, mode 7 is monochrome at b000
+// hasVideoMemory is false when memory ends before the video buffers, like a pc with no display adapter. The bios
+// leaves the screen alone then instead of tripping over unmapped memory
+func hasVideoMemory() bool {
+	return len(MemoryValues.Bytes) >= 0xc0000
+}
+
+func (b *Bios) textAddress(row, column uint8) uint32 {
+	base := uint32(0xb8000)
+	if b.VideoMode == 7 {
+		base = 0xb0000
+	}
+	return base + (uint32(row)*uint32(b.columns())+uint32(column))*2
+}
+
+// scroll moves the text in a window up by lines (down when negative), 0 lines clears it, new lines get attribute
+func (b *Bios) scroll(lines int, attribute, top, left, bottom, right uint8) {
+	if !hasVideoMemory() {
+		return
+	}
+	bottom, right = min(bottom, 24), min(right, b.columns()-1)
+	height := int(bottom) - int(top) + 1
+	if lines == 0 || lines >= height || -lines >= height {
+		lines = height
+	}
+	for i := 0; i < height; i++ {
+		row := int(top) + i
+		from := row + lines
+		if lines < 0 {
+			row = int(bottom) - i
+			from = row + lines
+		}
+		for column := left; column <= right && column >= left; column++ {
+			value := uint16(attribute)<<8 | ' '
+			if from >= int(top) && from <= int(bottom) {
+				value = MemoryValues.Read(b.textAddress(uint8(from), column), true)
+			}
+			MemoryValues.Write(b.textAddress(uint8(row), column), value, true)
+		}
+	}
+}
+
+// teletype writes a character at the cursor and moves it on like a terminal would
+func (b *Bios) teletype(char uint8) {
+	fmt.Fprintf(b.Out, "%c", char)
+	if !b.isTextMode() || !hasVideoMemory() {
+		return
+	}
+
+	switch char {
+	case '\r':
+		b.CursorColumn = 0
+	case '\n':
+		b.CursorRow++
+	case '\b':
+		if b.CursorColumn > 0 {
+			b.CursorColumn--
+		}
+	case 7: // bell
+	default:
+		MemoryValues.Write(b.textAddress(b.CursorRow, b.CursorColumn), uint16(char), false)
+		b.CursorColumn++
+		if b.CursorColumn >= b.columns() {
+			b.CursorColumn = 0
+			b.CursorRow++
+		}
+	}
+	if b.CursorRow > 24 {
+		b.scroll(1, 0x07, 0, 0, 24, b.columns()-1)
+		b.CursorRow = 24
+	}
+}
+
+// video handles int 10h
+func (b *Bios) video() {
+	b.InitVideo()
+	CpuFlagValues[CarryFlag] = false
+	switch ReadRegister(regAH) {
+	case 0x00: // set video mode
+		b.VideoMode = uint8(ReadRegister(regAL)) & 0x7f
+		b.CursorRow, b.CursorColumn = 0, 0
+		if b.isTextMode() {
+			b.scroll(0, 0x07, 0, 0, 24, b.columns()-1)
+		} else if hasVideoMemory() {
+			// through the bus like the program's writes so watchpoints and reverse execution see them
+			for address := uint32(0xa0000); address < 0xc0000; address += 2 {
+				MemoryValues.Write(address, 0, true)
+			}
+		}
+	case 0x01: // set cursor shape, the cursor isn't drawn
+	case 0x02: // set cursor position, only page 0
+		b.CursorRow, b.CursorColumn = uint8(ReadRegister(regDH)), uint8(ReadRegister(regDL))
+	case 0x03: // get cursor position and shape
+		WriteRegister(regDH, uint16(b.CursorRow))
+		WriteRegister(regDL, uint16(b.CursorColumn))
+		WriteRegister(regCX, 0x0607)
+	case 0x06, 0x07: // scroll window up or down
+		lines := int(ReadRegister(regAL))
+		if ReadRegister(regAH) == 0x07 {
+			lines = -lines
+		}
+		b.scroll(lines, uint8(ReadRegister(regBH)), uint8(ReadRegister(regCH)), uint8(ReadRegister(regCL)),
+			uint8(ReadRegister(regDH)), uint8(ReadRegister(regDL)))
+	case 0x08: // read character and attribute at the cursor
+		if !hasVideoMemory() {
+			WriteRegister(regAX, 0)
+			break
+		}
+		WriteRegister(regAX, MemoryValues.Read(b.textAddress(b.CursorRow, b.CursorColumn), true))
+	case 0x09, 0x0a: // write character (and attribute for 09h) cx times without moving the cursor
+		address := b.textAddress(b.CursorRow, b.CursorColumn)
+		for i := uint32(0); i < uint32(ReadRegister(regCX)) && hasVideoMemory(); i++ {
+			MemoryValues.Write(address+i*2, ReadRegister(regAL), false)
+			if ReadRegister(regAH) == 0x09 {
+				MemoryValues.Write(address+i*2+1, ReadRegister(regBL), false)
+			}
+		}
+	case 0x0e: // teletype output
+		b.teletype(uint8(ReadRegister(regAL)))
+	case 0x0f: // get video mode
+		WriteRegister(regAL, uint16(b.VideoMode))
+		WriteRegister(regAH, uint16(b.columns()))
+		WriteRegister(regBH, 0)
+	default:
+		b.unimplemented(0x10)
+	}
+}
+
+// shift flags, int 16h ah=02 returns them in al
+const (
+	shiftRight    = 1 << 0
+	shiftLeft     = 1 << 1
+	shiftCtrl     = 1 << 2
+	shiftAlt      = 1 << 3
+	shiftCapsLock = 1 << 6
+)
+
+// nextKey takes the next key as scancode<<8 | ascii. Keys come from the keyboard while it has any, then the -keys
+// input where newlines are sent as enter (carriage return). ok is false once input runs out, or when wait is false
+// and there's no key yet
+func (b *Bios) nextKey(wait bool) (uint16, bool) {
+	if b.pendingKey != -1 {
+		key := b.pendingKey
+		b.pendingKey = -1
+		return uint16(key), true
+	}
+	if b.Keyboard != nil && b.Keyboard.HasInput() {
+		return b.keyboardKey(wait)
+	}
+	if b.Keys == nil {
+		return 0, false
+	}
+	char, err := b.Keys.ReadByte()
+	if err != nil {
+		return 0, false
+	}
+	if char == '\n' {
+		char = '\r'
+	}
+	// scan codes aren't known for scripted input so ah is 0
+	return uint16(char), true
+}
+
+// keyboardKey reads scancodes off the keyboard until one is a key press. Waiting skips the clock ahead to the
+// next scancode the script sends, the way hlt skips to the next interrupt
+func (b *Bios) keyboardKey(wait bool) (uint16, bool) {
+	for {
+		// the rest of a line of the script comes in as soon as the last scancode is read
+		TickDevices()
+		code, ok := b.Keyboard.Take()
+		if !ok {
+			next, ok := b.Keyboard.NextEvent(ElapsedCycles)
+			if !wait || !ok {
+				return 0, false
+			}
+			ElapsedCycles = max(next, ElapsedCycles)
+			continue
+		}
+		if key, ok := b.translateScancode(code); ok {
+			return key, true
+		}
+	}
+}
+
+// translateScancode keeps track of the shift keys, any other make code is a key press returned the way int 16h
+// gives it. Break codes, acks and prefixes all have bit 7 set and only matter for the shift keys
+func (b *Bios) translateScancode(code uint8) (uint16, bool) {
+	var flag uint8
+	switch code &^ 0x80 {
+	case scancodes["rshift"]:
+		flag = shiftRight
+	case scancodes["shift"]:
+		flag = shiftLeft
+	case scancodes["ctrl"]:
+		flag = shiftCtrl
+	case scancodes["alt"]:
+		flag = shiftAlt
+	case scancodes["capslock"]:
+		if code&0x80 == 0 {
+			b.ShiftFlags ^= shiftCapsLock
+		}
+		return 0, false
+	}
+	if flag != 0 {
+		if code&0x80 == 0 {
+			b.ShiftFlags |= flag
+		} else {
+			b.ShiftFlags &^= flag
+		}
+		return 0, false
+	}
+	if code&0x80 != 0 {
+		return 0, false
+	}
+
+	chars := keyChars[code]
+	letter := chars[0] >= 'a' && chars[0] <= 'z'
+	shifted := b.ShiftFlags&(shiftLeft|shiftRight) != 0
+	if letter && b.ShiftFlags&shiftCapsLock != 0 {
+		shifted = !shifted
+	}
+	char := chars[0]
+	switch {
+	case b.ShiftFlags&shiftAlt != 0:
+		char = 0
+	case b.ShiftFlags&shiftCtrl != 0 && letter:
+		char = chars[0] - 'a' + 1
+	case shifted:
+		char = chars[1]
+	}
+	return uint16(code)<<8 | uint16(char), true
+}
+
+// keyboard handles int 16h
+func (b *Bios) keyboard() {
+	CpuFlagValues[CarryFlag] = false
+	switch ReadRegister(regAH) {
+	case 0x00, 0x10: // wait for a key
+		key, ok := b.nextKey(true)
+		if !ok {
+			// a real bios waits forever
+			fmt.Fprintln(b.Log, "bios: waiting for a key but keyboard input has run out, halting")
+			Halted = true
+			return
+		}
+		WriteRegister(regAX, key)
+	case 0x01, 0x11: // check for a key, zf is set when there isn't one
+		key, ok := b.nextKey(false)
+		CpuFlagValues[ZeroFlag] = !ok
+		if ok {
+			b.pendingKey = int(key)
+			WriteRegister(regAX, key)
+		}
+	case 0x02: // shift flags
+		WriteRegister(regAL, uint16(b.ShiftFlags))
+	default:
+		b.unimplemented(0x16)
+	}
+}
+
+// Ticks is the bios tick count, 18.2 per second of simulated time
+func (b *Bios) Ticks() int {
+	return b.TickBase + ElapsedCycles/cyclesPerTick
+}
+
+// clock handles int 1ah
+func (b *Bios) clock() {
+	CpuFlagValues[CarryFlag] = false
+	switch ReadRegister(regAH) {
+	case 0x00: // get tick count in cx:dx, al says if midnight passed
+		ticks := b.Ticks()
+		WriteRegister(regCX, uint16(ticks>>16))
+		WriteRegister(regDX, uint16(ticks))
+		WriteRegister(regAL, 0)
+	case 0x01: // set tick count
+		b.TickBase = int(ReadRegister(regCX))<<16 | int(ReadRegister(regDX)) - ElapsedCycles/cyclesPerTick
+	default:
+		b.unimplemented(0x1a)
+	}
+}
+
+// diskGeometry guesses cylinders, heads and sectors per track from the image size, anything that isn't a
+// standard floppy is treated as a hard disk with 16 heads and 63 sectors
+func diskGeometry(size int) (cylinders, heads, sectors int, floppy bool) {
+	switch size {
+	case 160 * 1024:
+		return 40, 1, 8, true
+	case 180 * 1024:
+		return 40, 1, 9, true
+	case 320 * 1024:
+		return 40, 2, 8, true
+	case 360 * 1024:
+		return 40, 2, 9, true
+	case 720 * 1024:
+		return 80, 2, 9, true
+	case 1200 * 1024:
+		return 80, 2, 15, true
+	case 1440 * 1024:
+		return 80, 2, 18, true
+	}
+	heads, sectors = 16, 63
+	return max(1, (size+heads*sectors*512-1)/(heads*sectors*512)), heads, sectors, false
+}
+
+// diskStatus finishes an int 13h call, ah is the status and cf is set if it isn't 0
+func diskStatus(status uint8) {
+	WriteRegister(regAH, uint16(status))
+	CpuFlagValues[CarryFlag] = status != 0
+}
+
+// disk handles int 13h, the image is drive 00h if it's a floppy size and 80h otherwise
+func (b *Bios) disk() {
+	cylinders, heads, sectors, floppy := diskGeometry(len(b.Disk))
+	drive := uint16(0x80)
+	if floppy {
+		drive = 0x00
+	}
+	if b.Disk == nil || ReadRegister(regDL) != drive {
+		diskStatus(0x01) // bad command, there's no such drive
+		return
+	}
+
+	switch ReadRegister(regAH) {
+	case 0x00: // reset
+		diskStatus(0)
+	case 0x02: // read sectors into es:bx
+		count := int(ReadRegister(regAL))
+		cl := int(ReadRegister(regCL))
+		cylinder := int(ReadRegister(regCH)) | (cl&0xc0)<<2
+		sector := cl & 0x3f
+		head := int(ReadRegister(regDH))
+		if sector == 0 || sector > sectors || head >= heads || cylinder >= cylinders {
+			WriteRegister(regAL, 0)
+			diskStatus(0x04) // sector not found
+			return
+		}
+
+		lba := (cylinder*heads+head)*sectors + sector - 1
+		buffer := SegmentBase(Register_es) + uint32(ReadRegister(regBX))
+		read := 0
+		for ; read < count && (lba+read+1)*512 <= len(b.Disk); read++ {
+			for i, value := range b.Disk[(lba+read)*512 : (lba+read+1)*512] {
+				MemoryValues.Write(WrapAddress(buffer+uint32(read*512+i)), uint16(value), false)
+			}
+		}
+		WriteRegister(regAL, uint16(read))
+		if read < count {
+			diskStatus(0x04)
+			return
+		}
+		diskStatus(0)
+	case 0x03: // write sectors, images are read only
+		fmt.Fprintln(b.Log, "bios: int 13h write to a read only disk image")
+		diskStatus(0x03) // write protected
+	case 0x08: // drive parameters
+		maxCylinder := cylinders - 1
+		WriteRegister(regCH, uint16(maxCylinder&0xff))
+		WriteRegister(regCL, uint16(sectors|(maxCylinder>>8)<<6))
+		WriteRegister(regDH, uint16(heads-1))
+		WriteRegister(regDL, 1)
+		if floppy {
+			WriteRegister(regBL, 4) // 1.44M drive
+		}
+		diskStatus(0)
+	default:
+		fmt.Fprintf(b.Log, "bios: int 13h ah=%02xh isn't implemented\n", ReadRegister(regAH))
+		diskStatus(0x01)
+	}
+}
+
+// biosState is what a snapshot keeps of the bios, scripted input and the disk image come from the command line
+type biosState struct {
+	VideoMode    uint8 `json:"video_mode"`
+	CursorRow    uint8 `json:"cursor_row"`
+	CursorColumn uint8 `json:"cursor_column"`
+	TickBase     int   `json:"tick_base"`
+	PendingKey   int   `json:"pending_key"`
+	ShiftFlags   uint8 `json:"shift_flags"`
+	VideoReady   bool  `json:"video_ready"`
+}
+
+func (b *Bios) SnapshotName() string {
+	return "bios"
+}
+
+func (b *Bios) SaveState() (json.RawMessage, error) {
+	return json.Marshal(biosState{b.VideoMode, b.CursorRow, b.CursorColumn, b.TickBase, b.pendingKey, b.ShiftFlags, b.VideoReady})
+}
+
+func (b *Bios) LoadState(state json.RawMessage) error {
+	var s biosState
+	if err := json.Unmarshal(state, &s); err != nil {
+		return err
+	}
+	b.VideoMode, b.CursorRow, b.CursorColumn, b.TickBase, b.pendingKey = s.VideoMode, s.CursorRow, s.CursorColumn, s.TickBase, s.PendingKey
+	b.ShiftFlags, b.VideoReady = s.ShiftFlags, s.VideoReady
+	return nil
+}
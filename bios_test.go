@@ -0,0 +1,208 @@
+package main
+
+import (
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestBiosVideoWritesGoThroughTheBus(t *testing.T) {
+	ResetMachine()
+	bios := NewBios(io.Discard, io.Discard, nil, nil)
+	bios.Install()
+	bios.InitVideo()
+	watchpoints := NewWatchpoints(&MemoryValues)
+	watchpoints.AddRange(WatchWrite, 0xb8000, 4)
+
+	tests := []struct {
+		name   string
+		ax, bx uint16
+		cx     uint16
+		writes int
+	}{
+		{"teletype", 0x0e41, 0, 0, 1},
+		{"write character and attribute", 0x0942, 0x1f, 2, 4},
+		{"write character", 0x0a43, 0, 2, 2},
+		{"scroll", 0x0600, 0x07, 0, 2},
+	}
+	for _, test := range tests {
+		bios.CursorRow, bios.CursorColumn = 0, 0
+		WriteRegister(regAX, test.ax)
+		WriteRegister(regBX, test.bx)
+		WriteRegister(regCX, test.cx)
+		WriteRegister(regDX, 0x184f)
+		bios.video()
+		if hits := watchpoints.TakeHits(); len(hits) != test.writes {
+			t.Errorf("%s: the watchpoint saw %d writes, want %d", test.name, len(hits), test.writes)
+		}
+	}
+
+	// rom over the text buffer keeps its contents like it does against the program's writes
+	MemoryValues.Map(Region{Name: "rom", Start: 0xb8000, End: 0xb8010, Kind: RegionRom})
+	MemoryValues.Poke(0xb8000, 0x5a, false)
+	bios.CursorRow, bios.CursorColumn = 0, 0
+	WriteRegister(regAX, 0x0e41)
+	bios.video()
+	if value := MemoryValues.Peek(0xb8000, false); value != 0x5a {
+		t.Errorf("teletype wrote %02x over rom", value)
+	}
+}
+
+func TestBiosClearsVideoOnFirstCall(t *testing.T) {
+	ResetMachine()
+	bios := NewBios(io.Discard, io.Discard, nil, nil)
+	bios.Install()
+	MemoryValues.Poke(0xb8002, 0x1234, true)
+	if value := MemoryValues.Peek(0xb8000, true); value != 0 || bios.VideoReady {
+		t.Errorf("installing the bios left %04x at b800:0000, want video memory untouched", value)
+	}
+
+	// get cursor position doesn't draw anything but it's the first int 10h call
+	WriteRegister(regAX, 0x0300)
+	bios.video()
+	if first, second := MemoryValues.Peek(0xb8000, true), MemoryValues.Peek(0xb8002, true); first != 0x0720 || second != 0x0720 {
+		t.Errorf("the first int 10h call left %04x %04x, want the screen cleared to 0720", first, second)
+	}
+
+	// once cleared the screen is the program's
+	MemoryValues.Poke(0xb8000, 0x1f41, true)
+	bios.video()
+	if value := MemoryValues.Peek(0xb8000, true); value != 0x1f41 {
+		t.Errorf("a later int 10h call cleared the screen again, b800:0000 is %04x", value)
+	}
+}
+
+func TestBiosCarryFlag(t *testing.T) {
+	ResetMachine()
+	bios := NewBios(io.Discard, io.Discard, nil, nil)
+	bios.Install()
+	tests := []struct {
+		name    string
+		service func()
+		ax      uint16
+		carry   bool
+	}{
+		{"get cursor position", bios.video, 0x0300, false},
+		{"unimplemented video call", bios.video, 0x4f00, true},
+		{"shift flags", bios.keyboard, 0x0200, false},
+		{"unimplemented keyboard call", bios.keyboard, 0x0500, true},
+		{"tick count", bios.clock, 0x0000, false},
+		{"unimplemented clock call", bios.clock, 0x0700, true},
+		{"read from a missing disk", bios.disk, 0x0201, true},
+	}
+	for _, test := range tests {
+		// the opposite of what the call should leave
+		CpuFlagValues[CarryFlag] = !test.carry
+		WriteRegister(regAX, test.ax)
+		test.service()
+		if CpuFlagValues[CarryFlag] != test.carry {
+			t.Errorf("%s left cf %v, want %v", test.name, CpuFlagValues[CarryFlag], test.carry)
+		}
+	}
+}
+
+func TestBiosWithoutVideoMemory(t *testing.T) {
+	ResetMachine()
+	defer SetMemorySize(0x100000)
+	SetMemorySize(0xa0000)
+	MemoryValues.Unmapped = UnmappedFault
+	bios := NewBios(io.Discard, io.Discard, nil, nil)
+	bios.Install()
+	for _, ax := range []uint16{0x0e41, 0x0600, 0x0013, 0x0800, 0x0941} {
+		WriteRegister(regAX, ax)
+		WriteRegister(regCX, 1)
+		bios.video()
+	}
+	if CpuFault != nil {
+		t.Errorf("the bios touched video memory that isn't there: %v", CpuFault)
+	}
+}
+
+func TestBiosReadsScriptedKeys(t *testing.T) {
+	ResetMachine()
+	InstallTimer()
+	script, err := ParseKeyScript(strings.NewReader("1000 a\n5000 b\n9000 +shift c\n12000 -shift f1\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyboard := NewKeyboard(InterruptController, script)
+	keyboard.Install()
+	bios := NewBios(io.Discard, io.Discard, nil, nil)
+	bios.Keyboard = keyboard
+	bios.Install()
+
+	// each call is made at cycle (or where the last one left the clock when it's 0), waiting calls skip to the
+	// cycle the script sends the key at
+	tests := []struct {
+		name    string
+		cycle   int
+		ah      uint8
+		ax      uint16
+		noKey   bool
+		arrives int
+	}{
+		{"nothing yet", 500, 0x01, 0x0100, true, 500},
+		{"waits for a", 0, 0x00, 0x1e61, false, 1000},
+		{"b is there", 6000, 0x01, 0x3062, false, 6000},
+		{"b was only looked at", 0, 0x00, 0x3062, false, 6000},
+		{"shift capitalises c", 0, 0x00, 0x2e43, false, 9000},
+		{"shift is still held", 0, 0x02, 0x0202, false, 9000},
+		{"f1 has no ascii", 0, 0x10, 0x3b00, false, 12000},
+		{"shift was let go", 0, 0x02, 0x0200, false, 12000},
+	}
+	for _, test := range tests {
+		if test.cycle != 0 {
+			ElapsedCycles = test.cycle
+			TickDevices()
+		}
+		WriteRegister(regAH, uint16(test.ah))
+		bios.keyboard()
+		if ax := ReadRegister(regAX); ax != test.ax || ElapsedCycles != test.arrives {
+			t.Errorf("%s: ax %04x at cycle %d, want %04x at %d", test.name, ax, ElapsedCycles, test.ax, test.arrives)
+		}
+		if test.ah == 0x01 && CpuFlagValues[ZeroFlag] != test.noKey {
+			t.Errorf("%s: zf is %v, want %v", test.name, CpuFlagValues[ZeroFlag], test.noKey)
+		}
+	}
+	if InterruptController.Requests != 0 {
+		t.Errorf("irq 1 is still requested after the bios read the scancodes itself")
+	}
+
+	// the script has run out and there's no -keys input to fall back on
+	WriteRegister(regAH, 0x00)
+	bios.keyboard()
+	if !Halted {
+		t.Errorf("waiting for a key once the script ran out didn't halt")
+	}
+}
+
+func TestBiosTranslateScancode(t *testing.T) {
+	tests := []struct {
+		name  string
+		codes []uint8
+		key   uint16
+		flags uint8
+	}{
+		{"letter", []uint8{0x1e}, 0x1e61, 0},
+		{"shifted symbol", []uint8{0x36, 0x02}, 0x0221, shiftRight},
+		{"enter", []uint8{0x1c}, 0x1c0d, 0},
+		{"ctrl c", []uint8{0x1d, 0x2e}, 0x2e03, shiftCtrl},
+		{"alt x", []uint8{0x38, 0x2d}, 0x2d00, shiftAlt},
+		{"caps lock", []uint8{0x3a, 0xba, 0x1e}, 0x1e41, shiftCapsLock},
+		{"caps lock and shift", []uint8{0x3a, 0xba, 0x2a, 0x1e}, 0x1e61, shiftCapsLock | shiftLeft},
+		{"caps lock leaves digits", []uint8{0x3a, 0xba, 0x02}, 0x0231, shiftCapsLock},
+		{"released shift", []uint8{0x2a, 0xaa, 0x1e}, 0x1e61, 0},
+		{"ack and prefix are skipped", []uint8{0xfa, 0xe0, 0x48}, 0x4800, 0},
+	}
+	for _, test := range tests {
+		bios := NewBios(io.Discard, io.Discard, nil, nil)
+		var key uint16
+		var ok bool
+		for _, code := range test.codes {
+			key, ok = bios.translateScancode(code)
+		}
+		if !ok || key != test.key || bios.ShiftFlags != test.flags {
+			t.Errorf("%s: %04x %v with flags %02x, want %04x with %02x", test.name, key, ok, bios.ShiftFlags, test.key, test.flags)
+		}
+	}
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Breakpoint stops execution before an instruction runs, it can match on address, opcode and/or a condition.
+// A breakpoint with only a condition is checked before every instruction
+type Breakpoint struct {
+	ID int
+
+	HasAddress bool
+	Address    uint32
+
+	HasOp bool
+	Op    OperationType
+
+	Condition *Expression
+
+	Hits int
+}
+
+// Matches reports whether the breakpoint fires for inst, which is about to be executed
+func (b *Breakpoint) Matches(inst Instruction) bool {
+	if b.HasAddress && inst.Address != b.Address {
+		return false
+	}
+	if b.HasOp && inst.Op != b.Op {
+		return false
+	}
+	if b.Condition != nil && !b.Condition.True() {
+		return false
+	}
+	return true
+}
+
+func (b *Breakpoint) String() string {
+	var parts []string
+	if b.HasAddress {
+		parts = append(parts, fmt.Sprintf("%04x", b.Address))
+	}
+	if b.HasOp {
+		parts = append(parts, opTypeToString[b.Op])
+	}
+	if b.Condition != nil {
+		parts = append(parts, "if "+b.Condition.String())
+	}
+	return fmt.Sprintf("%d: %s (hit %d times)", b.ID, strings.Join(parts, " "), b.Hits)
+}
+
+// Breakpoints is a set of breakpoints checked by the run loop
+type Breakpoints struct {
+	List   []*Breakpoint
+	nextID int
+}
+
+func (bs *Breakpoints) add(b *Breakpoint) *Breakpoint {
+	bs.nextID++
+	b.ID = bs.nextID
+	bs.List = append(bs.List, b)
+	return b
+}
+
+// AddAddress breaks when execution reaches address
+func (bs *Breakpoints) AddAddress(address uint32) *Breakpoint {
+	return bs.add(&Breakpoint{HasAddress: true, Address: address})
+}
+
+// AddOp breaks before every instruction with the given operation e.g. Op_call
+func (bs *Breakpoints) AddOp(op OperationType) *Breakpoint {
+	return bs.add(&Breakpoint{HasOp: true, Op: op})
+}
+
+// AddCondition breaks before any instruction when condition is true
+func (bs *Breakpoints) AddCondition(condition Expression) *Breakpoint {
+	return bs.add(&Breakpoint{Condition: &condition})
+}
+
+func opByName(name string) (OperationType, bool) {
+	for op, opName := range opTypeToString {
+		if opName == name {
+			return op, true
+		}
+	}
+	return 0, false
+}
+
+// Add parses a breakpoint spec, `<address|opcode> [if <condition>]` or `if <condition>`
+// e.g. `0x1b`, `call`, `0x1b if ax == 0 && [bx+2] > 5`. The spec is split at the first if, nothing in a
+// location or condition is called if
+func (bs *Breakpoints) Add(spec string) (*Breakpoint, error) {
+	b := &Breakpoint{}
+	location, condition, hasCondition := strings.Cut(" "+strings.TrimSpace(spec)+" ", " if ")
+	location = strings.TrimSpace(location)
+
+	if location != "" {
+		if op, ok := opByName(strings.ToLower(location)); ok {
+			b.HasOp, b.Op = true, op
+		} else {
+			// segment:offset is resolved now, a breakpoint is on a physical address
+			address, err := ParseAddress(location)
+			if err != nil {
+				return nil, fmt.Errorf("%q is not an address or opcode", location)
+			}
+			b.HasAddress, b.Address = true, address
+		}
+	}
+
+	if hasCondition {
+		expression, err := ParseExpression(strings.TrimSpace(condition))
+		if err != nil {
+			return nil, err
+		}
+		b.Condition = &expression
+	}
+
+	if !b.HasAddress && !b.HasOp && b.Condition == nil {
+		return nil, fmt.Errorf("empty breakpoint")
+	}
+	return bs.add(b), nil
+}
+
+// Delete removes the breakpoint with the given id
+func (bs *Breakpoints) Delete(id int) error {
+	for i, b := range bs.List {
+		if b.ID == id {
+			bs.List = append(bs.List[:i], bs.List[i+1:]...)
+			return nil
+		}
+	}
+	return fmt.Errorf("no breakpoint %d", id)
+}
+
+// Check returns the first breakpoint that fires for inst and counts the hit, nil if none do
+func (bs *Breakpoints) Check(inst Instruction) *Breakpoint {
+	if bs == nil {
+		return nil
+	}
+	for _, b := range bs.List {
+		if b.Matches(inst) {
+			b.Hits++
+			return b
+		}
+	}
+	return nil
+}
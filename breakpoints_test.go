@@ -0,0 +1,51 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestBreakpointsAdd(t *testing.T) {
+	ResetMachine()
+	WriteU16(RegisterValues[Register_a], 0, 1)
+	CpuFlagValues[InterruptFlag] = true
+
+	tests := []struct {
+		spec       string
+		hasAddress bool
+		address    uint32
+		hasOp      bool
+		op         OperationType
+		condition  string
+	}{
+		{spec: "0x1b", hasAddress: true, address: 0x1b},
+		{spec: "0x100:0x10", hasAddress: true, address: 0x1010},
+		{spec: "call", hasOp: true, op: Op_call},
+		{spec: "0x1b if ax == 1", hasAddress: true, address: 0x1b, condition: "ax == 1"},
+		{spec: "if sp < 39990", condition: "sp < 39990"},
+		{spec: "  if iflag  ", condition: "iflag"},
+		{spec: "ret if iflag && ax", hasOp: true, op: Op_ret, condition: "iflag && ax"},
+	}
+	for _, test := range tests {
+		b, err := (&Breakpoints{}).Add(test.spec)
+		if err != nil {
+			t.Errorf("Add(%q) failed: %v", test.spec, err)
+			continue
+		}
+		if b.HasAddress != test.hasAddress || b.Address != test.address || b.HasOp != test.hasOp || b.Op != test.op {
+			t.Errorf("Add(%q) = %s", test.spec, b)
+		}
+		condition := ""
+		if b.Condition != nil {
+			condition = b.Condition.String()
+		}
+		if condition != test.condition {
+			t.Errorf("Add(%q) has condition %q, want %q", test.spec, condition, test.condition)
+		}
+	}
+
+	for _, spec := range []string{"", "if", "0x1b if", "nosuchop", "0x1b if ax ==", "if if"} {
+		if _, err := (&Breakpoints{}).Add(spec); err == nil {
+			t.Errorf("Add(%q) should have failed", spec)
+		}
+	}
+}
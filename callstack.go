@@ -0,0 +1,108 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// Frame is a call or interrupt the program hasn't returned from yet, addresses are physical
+type Frame struct {
+	Call      uint32 `json:"call"`   // the call instruction, or the instruction an interrupt came in before
+	Target    uint32 `json:"target"` // where it went
+	Return    uint32 `json:"return"` // where the ret or iret should come back to
+	SS        uint16 `json:"ss"`     // ss:sp of the pushed return address
+	SP        uint16 `json:"sp"`
+	Interrupt int    `json:"interrupt"` // the vector, -1 for a call
+}
+
+// maxFrames stops a program that calls without ever returning (using call as a jump) growing the shadow stack forever
+const maxFrames = 1 << 16
+
+// CallStack is a shadow of the program's stack with only the calls on it, built from call/ret and interrupts/iret.
+// It doesn't depend on what's in stack memory so it still has the call chain when the program has scribbled on that
+type CallStack struct {
+	Frames []Frame
+	Log    io.Writer // returns that don't go back to where the matching call came from are reported here
+}
+
+// Calls tracks the calls made by the program being simulated
+var Calls = CallStack{Log: os.Stderr}
+
+// Enter records a call or interrupt that has just pushed its return address and jumped to cs:ip
+func (c *CallStack) Enter(call, returnAddress uint32, vector int) {
+	c.unwind()
+	frame := Frame{
+		Call:      call,
+		Target:    InstructionAddress(),
+		Return:    returnAddress,
+		SS:        ReadU16(RegisterValues[Register_ss], 0),
+		SP:        ReadU16(RegisterValues[Register_sp], 0),
+		Interrupt: vector,
+	}
+	c.Frames = append(c.Frames, frame)
+	if len(c.Frames) > maxFrames {
+		c.Frames = c.Frames[1:]
+	}
+}
+
+// Return matches a ret or iret that has just gone back to cs:ip with the call it returns from. Returning somewhere
+// other than where the innermost call expects is reported, a return with no calls made is the program going back
+// to whatever started it (a .com program's ret to the psp) so that's fine
+func (c *CallStack) Return() {
+	if len(c.Frames) == 0 {
+		return
+	}
+	target := InstructionAddress()
+	top := len(c.Frames) - 1
+	for i := top; i >= 0; i-- {
+		if c.Frames[i].Return != target {
+			continue
+		}
+		if i != top {
+			c.report("%s returned to %s skipping %d calls, the innermost from %s", CurrentInstruction,
+				AddressString(target), top-i, AddressString(c.Frames[top].Call))
+		}
+		c.Frames = c.Frames[:i]
+		return
+	}
+	c.report("%s returned to %s but the call from %s returns to %s", CurrentInstruction,
+		AddressString(target), AddressString(c.Frames[top].Call), AddressString(c.Frames[top].Return))
+	// whatever it was, its return address has been popped
+	c.Frames = c.Frames[:top]
+}
+
+func (c *CallStack) report(format string, args ...any) {
+	if c.Log != nil {
+		fmt.Fprintf(c.Log, "calls: at %s %s\n", AddressString(CurrentInstruction.Address), fmt.Sprintf(format, args...))
+	}
+}
+
+// unwind drops calls whose return address has been popped without a ret e.g. `add sp, 2` or stepping backwards
+func (c *CallStack) unwind() {
+	ss, sp := ReadU16(RegisterValues[Register_ss], 0), ReadU16(RegisterValues[Register_sp], 0)
+	for len(c.Frames) > 0 {
+		frame := c.Frames[len(c.Frames)-1]
+		if frame.SS != ss || Stack.Depth(sp) >= Stack.Depth(frame.SP) {
+			return
+		}
+		c.Frames = c.Frames[:len(c.Frames)-1]
+	}
+}
+
+// Backtrace is cs:ip followed by where each call it's inside was made from, innermost first
+func (c *CallStack) Backtrace() string {
+	c.unwind()
+	var trace strings.Builder
+	fmt.Fprintf(&trace, "#0  %s\n", AddressString(InstructionAddress()))
+	for i := len(c.Frames) - 1; i >= 0; i-- {
+		frame := c.Frames[i]
+		fmt.Fprintf(&trace, "#%-2d %s", len(c.Frames)-i, AddressString(frame.Call))
+		if frame.Interrupt >= 0 {
+			fmt.Fprintf(&trace, " interrupt %02xh", frame.Interrupt)
+		}
+		fmt.Fprintln(&trace)
+	}
+	return trace.String()
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+// jumpTo puts cs:ip and sp where a call or return has just left them
+func jumpTo(cs, ip, sp uint16) {
+	WriteU16(RegisterValues[Register_cs], 0, cs)
+	WriteU16(RegisterValues[Register_ip], 0, ip)
+	WriteU16(RegisterValues[Register_sp], 0, sp)
+}
+
+func TestCallStack(t *testing.T) {
+	ResetMachine()
+	var log bytes.Buffer
+	calls := CallStack{Log: &log}
+	WriteU16(RegisterValues[Register_ss], 0, 0x100)
+	Stack = StackBounds{Base: 0x1000}
+
+	// near call from 0000:0105 to 0000:0200, then a far one from 0000:0205 to 2000:0010 pushing cs and ip
+	jumpTo(0, 0x200, 0xffe)
+	calls.Enter(0x105, 0x108, -1)
+	jumpTo(0x2000, 0x10, 0xffa)
+	calls.Enter(0x205, 0x20a, -1)
+	if len(calls.Frames) != 2 || calls.Frames[1].Target != 0x20010 || calls.Frames[1].SP != 0xffa {
+		t.Fatalf("after two calls the frames are %+v", calls.Frames)
+	}
+	if trace := calls.Backtrace(); trace != "#0  20010\n#1  0205\n#2  0105\n" {
+		t.Errorf("backtrace is %q", trace)
+	}
+
+	// the far ret comes back to the other segment
+	jumpTo(0, 0x20a, 0xffe)
+	calls.Return()
+	if len(calls.Frames) != 1 || log.Len() != 0 {
+		t.Errorf("the far ret left %+v and logged %q", calls.Frames, log.String())
+	}
+
+	// a ret somewhere else still pops the frame but says so
+	jumpTo(0, 0x300, 0x1000)
+	calls.Return()
+	if len(calls.Frames) != 0 || !strings.Contains(log.String(), "returned to 0300 but the call from 0105 returns to 0108") {
+		t.Errorf("the mismatched ret left %+v and logged %q", calls.Frames, log.String())
+	}
+
+	// returning with no calls made is the program going back to whatever ran it
+	log.Reset()
+	calls.Return()
+	if log.Len() != 0 {
+		t.Errorf("a ret with no calls logged %q", log.String())
+	}
+}
+
+func TestCallStackSkippedReturn(t *testing.T) {
+	ResetMachine()
+	var log bytes.Buffer
+	calls := CallStack{Log: &log}
+	Stack = StackBounds{Base: 0x1000}
+
+	// a longjmp style return to the outer call skips the inner one
+	jumpTo(0, 0x200, 0xffe)
+	calls.Enter(0x105, 0x108, -1)
+	jumpTo(0, 0x300, 0xffc)
+	calls.Enter(0x205, 0x208, -1)
+	jumpTo(0, 0x108, 0x1000)
+	calls.Return()
+	if len(calls.Frames) != 0 || !strings.Contains(log.String(), "returned to 0108 skipping 1 calls, the innermost from 0205") {
+		t.Errorf("the skipping ret left %+v and logged %q", calls.Frames, log.String())
+	}
+}
+
+func TestCallStackUnwind(t *testing.T) {
+	ResetMachine()
+	calls := CallStack{}
+	WriteU16(RegisterValues[Register_ss], 0, 0x100)
+	Stack = StackBounds{Base: 0x1000}
+	jumpTo(0, 0x200, 0xffe)
+	calls.Enter(0x105, 0x108, -1)
+	jumpTo(0, 0x300, 0xffc)
+	calls.Enter(0x205, 0x208, -1)
+
+	// pushing more keeps both calls
+	WriteU16(RegisterValues[Register_sp], 0, 0xff0)
+	if trace := calls.Backtrace(); trace != "#0  0300\n#1  0205\n#2  0105\n" {
+		t.Errorf("with more pushed the backtrace is %q", trace)
+	}
+	// `add sp, 2` drops the inner call's return address without a ret
+	WriteU16(RegisterValues[Register_sp], 0, 0xffe)
+	if trace := calls.Backtrace(); trace != "#0  0300\n#1  0105\n" {
+		t.Errorf("after popping one return address the backtrace is %q", trace)
+	}
+	// a program resetting sp to the base of its stack has left every call
+	WriteU16(RegisterValues[Register_sp], 0, 0x1000)
+	calls.Enter(0x305, 0x308, -1)
+	if len(calls.Frames) != 1 || calls.Frames[0].Call != 0x305 {
+		t.Errorf("after resetting sp the frames are %+v, want only the new call", calls.Frames)
+	}
+
+	// a different stack segment isn't compared against, the calls stay until the program switches back
+	WriteU16(RegisterValues[Register_ss], 0, 0x200)
+	WriteU16(RegisterValues[Register_sp], 0, 0x1000)
+	calls.Backtrace()
+	if len(calls.Frames) != 1 {
+		t.Errorf("switching stacks unwound to %+v", calls.Frames)
+	}
+}
+
+func TestCallStackInterrupts(t *testing.T) {
+	defer ResetMachine()
+	ResetMachine()
+	WriteU16(RegisterValues[Register_ss], 0, 0x100)
+	WriteU16(RegisterValues[Register_sp], 0, 0x1000)
+	StartStack()
+	// int 21h at 0000:0100 into a handler at 2000:0000 that returns straight away with iret
+	MemoryValues.Poke(0x100, 0x21cd, true)
+	MemoryValues.Poke(0x102, 0xf4, false)
+	MemoryValues.Poke(0x20000, 0xcf, false)
+	MemoryValues.Poke(0x21*4+2, 0x2000, true)
+	WriteU16(RegisterValues[Register_ip], 0, 0x100)
+	instructions := DecodeFlow(MemoryValues.Bytes, 0, len(MemoryValues.Bytes), 0x100, 0x20000).Instructions
+
+	Step(instructions, []bool{false, false, false})
+	if len(Calls.Frames) != 1 {
+		t.Fatalf("int left frames %+v", Calls.Frames)
+	}
+	if frame := Calls.Frames[0]; frame.Call != 0x100 || frame.Target != 0x20000 || frame.Return != 0x102 || frame.Interrupt != 0x21 || frame.SP != 0xffa {
+		t.Errorf("int made frame %+v", frame)
+	}
+	if trace := Calls.Backtrace(); trace != "#0  20000\n#1  0100 interrupt 21h\n" {
+		t.Errorf("inside the handler the backtrace is %q", trace)
+	}
+	Step(instructions, []bool{false, false, false})
+	if len(Calls.Frames) != 0 || InstructionAddress() != 0x102 {
+		t.Errorf("iret to %05x left frames %+v", InstructionAddress(), Calls.Frames)
+	}
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// BlockProfile is what a simulation run recorded about a basic block
+type BlockProfile struct {
+	Executions int
+	Cycles     int
+}
+
+// ProfileBlocks simulates the program and totals how often each block ran and the cycles spent in it
+func ProfileBlocks(disassembly Disassembly, end int) map[uint32]*BlockProfile {
+	profile := map[uint32]*BlockProfile{}
+	for _, block := range disassembly.Blocks {
+		profile[block.Start] = &BlockProfile{}
+	}
+
+	for !Halted && InstructionAddress() < uint32(end) {
+		instruction, ok := Step(disassembly.Instructions, []bool{false, false, false})
+		if !ok {
+			break
+		}
+
+		block := disassembly.BlockAt(instruction.Address)
+		if block == nil {
+			continue
+		}
+		if block.Start == instruction.Address {
+			profile[block.Start].Executions++
+		}
+		profile[block.Start].Cycles += CalculateInstructionCycles(instruction, tookJump)
+	}
+	return profile
+}
+
+func dotEscape(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(s)
+}
+
+// WriteDot renders the blocks as a graphviz digraph, profile can be nil if the program wasn't run
+func WriteDot(disassembly Disassembly, profile map[uint32]*BlockProfile) string {
+	var res strings.Builder
+	res.WriteString("digraph cfg {\n")
+	res.WriteString("\tnode [shape=box fontname=\"monospace\"];\n")
+
+	for _, block := range disassembly.Blocks {
+		label := fmt.Sprintf("block %s\\l", AddressString(block.Start))
+		for _, inst := range block.Instructions {
+			label += dotEscape(fmt.Sprintf("%04x  %s", inst.Address, inst)) + "\\l"
+		}
+		if stats, ok := profile[block.Start]; ok {
+			label += fmt.Sprintf("executions: %d  cycles: %d\\l", stats.Executions, stats.Cycles)
+		}
+		fmt.Fprintf(&res, "\tb%04x [label=\"%s\"];\n", block.Start, label)
+	}
+
+	for _, block := range disassembly.Blocks {
+		last := block.Instructions[len(block.Instructions)-1]
+		for _, successor := range block.Successors {
+			var attributes string
+			switch {
+			case last.IsCall() && successor == last.Target():
+				attributes = " [style=dashed label=\"call\"]"
+			case last.IsCall():
+				attributes = " [label=\"return\"]"
+			case last.IsConditional() && successor == last.Target():
+				attributes = " [color=darkgreen label=\"taken\"]"
+			case last.IsConditional():
+				attributes = " [color=red label=\"not taken\"]"
+			}
+			fmt.Fprintf(&res, "\tb%04x -> b%04x%s;\n", block.Start, successor, attributes)
+		}
+	}
+
+	res.WriteString("}\n")
+	return res.String()
+}
+
+// executions is how many times the instruction at address ran, ok is false if it isn't a decoded instruction
+func executions(disassembly Disassembly, profile map[uint32]*BlockProfile, address uint32) (int, bool) {
+	if _, ok := disassembly.Instructions[int(address)]; !ok {
+		return 0, false
+	}
+	// every instruction in a block runs as many times as the block is entered
+	block := disassembly.BlockAt(address)
+	if block == nil {
+		return 0, false
+	}
+	return profile[block.Start].Executions, true
+}
+
+// WriteCoverage lists how many times each source line ran when a listing is loaded, otherwise each instruction.
+// Code that never ran is marked ##### and lines that aren't code with - like gcov does
+func WriteCoverage(disassembly Disassembly, profile map[uint32]*BlockProfile) string {
+	count := func(address uint32, isCode bool) string {
+		executed, ok := executions(disassembly, profile, address)
+		switch {
+		case !isCode || !ok:
+			return "-"
+		case executed == 0:
+			return "#####"
+		}
+		return strconv.Itoa(executed)
+	}
+
+	var res strings.Builder
+	if len(Sources.Lines) > 0 {
+		for _, line := range Sources.Lines {
+			fmt.Fprintf(&res, "%9s: %5d: %s\n", count(line.Address, line.HasAddress), line.Line, line.Text)
+		}
+		return res.String()
+	}
+
+	addresses := make([]int, 0, len(disassembly.Instructions))
+	for address := range disassembly.Instructions {
+		addresses = append(addresses, address)
+	}
+	slices.Sort(addresses)
+	for _, address := range addresses {
+		fmt.Fprintf(&res, "%9s: %s: %s\n", count(uint32(address), true), AddressString(uint32(address)), disassembly.Instructions[address])
+	}
+	return res.String()
+}
+
+// RunCfgCommand handles `sim_8086 cfg [-o out.dot] [-profile] [-coverage out.txt] <file>`
+func RunCfgCommand(args []string) {
+	flags := flag.NewFlagSet("cfg", flag.ExitOnError)
+	output := flags.String("o", "", "file to write the DOT graph to, defaults to <file>.dot")
+	withProfile := flags.Bool("profile", false, "simulate the program and annotate blocks with execution counts and cycles")
+	coverageFileName := flags.String("coverage", "", "also write how many times each source line or instruction ran to this file, implies -profile")
+	var options MachineOptions
+	options.AddFlags(flags)
+	flags.Parse(args)
+
+	if flags.NArg() == 0 {
+		fmt.Println("Error: no file provided")
+		flags.PrintDefaults()
+		return
+	}
+	programFileName := flags.Arg(0)
+
+	// the profile runs the program so it needs the same machine as any other run
+	program, _, err := setupMachine(programFileName, options)
+	if err != nil {
+		fmt.Println("Error:", err)
+		return
+	}
+
+	disassembly := DecodeFlow(MemoryValues.Bytes, program.Start, program.End, program.Entries...)
+
+	var profile map[uint32]*BlockProfile
+	if *withProfile || *coverageFileName != "" {
+		profile = ProfileBlocks(disassembly, program.End)
+	}
+	if *coverageFileName != "" {
+		if err := os.WriteFile(*coverageFileName, []byte(WriteCoverage(disassembly, profile)), 0644); err != nil {
+			fmt.Println("Error: failed to write coverage", err)
+			return
+		}
+		fmt.Println("wrote coverage to", *coverageFileName)
+	}
+
+	fileName := *output
+	if fileName == "" {
+		fileName = programFileName + ".dot"
+	}
+	err = os.WriteFile(fileName, []byte(WriteDot(disassembly, profile)), 0644)
+	if err != nil {
+		fmt.Println("Error: failed to write control flow graph", err)
+		return
+	}
+	fmt.Println("wrote control flow graph to", fileName)
+}
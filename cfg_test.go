@@ -0,0 +1,39 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestWriteDotBranchEdges(t *testing.T) {
+	ResetMachine()
+	copy(MemoryValues.Bytes, flowProgram)
+	disassembly := DecodeFlow(MemoryValues.Bytes, 0, len(flowProgram), 0)
+	// zf is clear so the je falls through to the jmp
+	profile := ProfileBlocks(disassembly, len(flowProgram))
+	dot := WriteDot(disassembly, profile)
+
+	for _, want := range []string{
+		"\tb0000 -> b0009 [color=darkgreen label=\"taken\"];\n",
+		"\tb0000 -> b0005 [color=red label=\"not taken\"];\n",
+		"\tb0005 -> b000c;\n",
+		"\tb0009 -> b000c;\n",
+	} {
+		if !strings.Contains(dot, want) {
+			t.Errorf("the graph is missing the edge %q:\n%s", want, dot)
+		}
+	}
+	if strings.Contains(dot, "b000c ->") {
+		t.Errorf("hlt shouldn't have any edges:\n%s", dot)
+	}
+
+	runs := map[uint32]int{0: 1, 5: 1, 9: 0, 0xc: 1}
+	for start, executions := range runs {
+		if profile[start].Executions != executions {
+			t.Errorf("block %04x ran %d times, want %d", start, profile[start].Executions, executions)
+		}
+	}
+	if !strings.Contains(dot, "0009  mov bx, 2\\lexecutions: 0  cycles: 0\\l") {
+		t.Errorf("the block that never ran isn't labelled with its profile:\n%s", dot)
+	}
+}
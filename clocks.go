@@ -171,6 +171,20 @@ func CalculateInstructionCycles(instruction Instruction, tookJump bool) int {
 	case Op_ret:
 		// intra no pop
 		cycleTotal = 8
+	case Op_int:
+		cycleTotal = 51
+	case Op_iret:
+		cycleTotal = 24
+	case Op_hlt:
+		cycleTotal = 2
+	case Op_in, Op_out:
+		if op2IsImmediate {
+			cycleTotal = 10
+		} else {
+			cycleTotal = 8
+		}
+	case Op_cli, Op_sti:
+		cycleTotal = 2
 	}
 	return cycleTotal
 }
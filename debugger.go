@@ -0,0 +1,594 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// Debugger is an interactive front end to the simulation loop, it reads commands from In and writes to Out
+type Debugger struct {
+	In  io.Reader
+	Out io.Writer
+
+	Disassembly Disassembly
+	Program     Program // the program ends once cs:ip reaches its End
+	Breakpoints *Breakpoints
+	Watchpoints *Watchpoints
+	History     *History // nil when reverse execution is turned off
+
+	lastCommand string
+}
+
+const debuggerHelp = `commands:
+  s, step [n]           execute n instructions (default 1)
+  n, next               step over calls
+  c, continue           run until a breakpoint or the program ends
+  b, break <spec>       break on an address, opcode or condition e.g. b 0x1b, b call, b 0x1b if ax == 0 && [bx+2] > 5
+  delete <id>           remove a breakpoint
+  w, watch <kind> <addr>[,<len>]   stop on memory access, kind is r, w, rw or change e.g. w change ss:sp,2
+  unwatch <id>          remove a watchpoint
+  i, info               list breakpoints and watchpoints
+  u, until <addr>       run until cs:ip reaches addr
+  rs, reverse-step [n]  undo n instructions (default 1)
+  rc, reverse-continue  undo instructions until a breakpoint or the start of the history
+  lastwrite <addr>      show which instruction last wrote to addr
+  r, regs               print registers and flags
+  stack [n]             show n words from the top of the stack (default 8)
+  bt, backtrace         show the calls cs:ip is inside, innermost first
+  x/<n><fmt><size> <addr>   examine memory, fmt is x or d, size is b or w e.g. x/16xb ds:si
+  set <reg> <value>     set a register e.g. set ax 0x10
+  save <file>           save a snapshot of the machine
+  load <file>           restore a snapshot, the reverse history is cleared
+  d, disas [n]          disassemble n instructions around ip (default 5)
+  h, help               show this message
+  q, quit               exit the debugger
+an empty line repeats the last command`
+
+// Finished is true once the program halted, cs:ip has left the program or landed somewhere that wasn't decoded
+func (d *Debugger) Finished() bool {
+	address := InstructionAddress()
+	_, decoded := FetchInstruction(d.Disassembly.Instructions, address)
+	return Halted || int(address) >= d.Program.End || !decoded
+}
+
+// printFinished says the program is done, and why if it was stopped by a fault
+func (d *Debugger) printFinished() {
+	if CpuFault != nil {
+		fmt.Fprintln(d.Out, CpuFault)
+		fmt.Fprint(d.Out, Calls.Backtrace())
+	}
+	fmt.Fprintln(d.Out, "program has finished")
+}
+
+// StepOne executes the instruction at ip and prints its effect
+func (d *Debugger) StepOne() bool {
+	if d.Finished() {
+		d.printFinished()
+		return false
+	}
+	Step(d.Disassembly.Instructions, []bool{true, false, false})
+	d.reportWatches()
+	return true
+}
+
+// reportWatches prints any watchpoints the last instruction triggered, false if there weren't any
+func (d *Debugger) reportWatches() bool {
+	hits := d.Watchpoints.TakeHits()
+	for _, hit := range hits {
+		fmt.Fprintln(d.Out, hit)
+	}
+	return len(hits) > 0
+}
+
+// RunUntil steps until stop returns true, a breakpoint fires or the program ends, instructions aren't printed.
+// The instruction at ip always runs so continuing from a breakpoint doesn't immediately stop again
+func (d *Debugger) RunUntil(stop func() bool) {
+	for !d.Finished() {
+		Step(d.Disassembly.Instructions, []bool{false, false, false})
+		if d.reportWatches() {
+			d.printLocation()
+			return
+		}
+		if stop() {
+			d.printLocation()
+			return
+		}
+		if d.Finished() {
+			break
+		}
+		inst, ok := FetchInstruction(d.Disassembly.Instructions, InstructionAddress())
+		if !ok {
+			continue
+		}
+		if hit := d.Breakpoints.Check(inst); hit != nil {
+			fmt.Fprintf(d.Out, "breakpoint %s\n", hit)
+			d.printLocation()
+			return
+		}
+	}
+	d.printFinished()
+}
+
+// ReverseStep undoes the last instruction, false once there's no history left
+func (d *Debugger) ReverseStep() bool {
+	if d.History == nil {
+		fmt.Fprintln(d.Out, "reverse execution is off, start the debugger with -history")
+		return false
+	}
+	record, ok := d.History.Undo()
+	if !ok {
+		fmt.Fprintln(d.Out, "reached the start of the recorded history")
+		return false
+	}
+	fmt.Fprintf(d.Out, "undid %s\n", record)
+	return true
+}
+
+// ReverseContinue undoes instructions until the one at ip has a breakpoint on it
+func (d *Debugger) ReverseContinue() {
+	if d.History == nil {
+		fmt.Fprintln(d.Out, "reverse execution is off, start the debugger with -history")
+		return
+	}
+	for {
+		if _, ok := d.History.Undo(); !ok {
+			fmt.Fprintln(d.Out, "reached the start of the recorded history")
+			d.printLocation()
+			return
+		}
+		// an address that hasn't been decoded would check a zero instruction, that can't be where a breakpoint is
+		inst, ok := FetchInstruction(d.Disassembly.Instructions, InstructionAddress())
+		if !ok {
+			continue
+		}
+		if hit := d.Breakpoints.Check(inst); hit != nil {
+			fmt.Fprintf(d.Out, "breakpoint %s\n", hit)
+			d.printLocation()
+			return
+		}
+	}
+}
+
+// LastWrite reports the most recent recorded instruction that wrote to address
+func (d *Debugger) LastWrite(address uint32) {
+	if d.History == nil {
+		fmt.Fprintln(d.Out, "reverse execution is off, start the debugger with -history")
+		return
+	}
+	record, write, ok := d.History.LastWrite(address)
+	if !ok {
+		fmt.Fprintf(d.Out, "nothing in the recorded history wrote to %05x\n", address)
+		return
+	}
+	fmt.Fprintf(d.Out, "%s wrote %x -> %x to [%05x]\n", record, write.Old, write.New, write.Address)
+}
+
+// Next steps over the instruction at ip, calls are run until they return to the following instruction
+func (d *Debugger) Next() {
+	ip := ReadU16(RegisterValues[Register_ip], 0)
+	inst, ok := d.Disassembly.Instructions[int(InstructionAddress())]
+	if !ok || !inst.IsCall() {
+		d.StepOne()
+		return
+	}
+
+	returnAddress := ip + uint16(inst.Size)
+	sp := ReadU16(RegisterValues[Register_sp], 0)
+	// sp check stops a recursive call returning to the same address from ending the step early
+	d.RunUntil(func() bool {
+		return ReadU16(RegisterValues[Register_ip], 0) == returnAddress && ReadU16(RegisterValues[Register_sp], 0) >= sp
+	})
+}
+
+func (d *Debugger) printLocation() {
+	address := InstructionAddress()
+	if inst, ok := d.Disassembly.Instructions[int(address)]; ok {
+		fmt.Fprintf(d.Out, "=> %s  %s\n", AddressString(address), inst)
+		if line, ok := Sources.Lookup(address); ok {
+			fmt.Fprintf(d.Out, "   %s\n", line)
+		}
+	} else {
+		fmt.Fprintf(d.Out, "=> %s\n", AddressString(address))
+	}
+}
+
+// Disassemble prints count instructions either side of cs:ip
+func (d *Debugger) Disassemble(count int) {
+	addresses := make([]int, 0, len(d.Disassembly.Instructions))
+	for address := range d.Disassembly.Instructions {
+		addresses = append(addresses, address)
+	}
+	slices.Sort(addresses)
+
+	ip := int(InstructionAddress())
+	at, _ := slices.BinarySearch(addresses, ip)
+	for _, address := range addresses[max(0, at-count):min(len(addresses), at+count+1)] {
+		marker := "  "
+		if address == ip {
+			marker = "=>"
+		}
+		text := d.Disassembly.Instructions[address].String()
+		if line, ok := Sources.Lookup(uint32(address)); ok {
+			text = fmt.Sprintf("%-30s ; %s", text, line)
+		}
+		fmt.Fprintf(d.Out, "%s %s  %s\n", marker, AddressString(uint32(address)), text)
+	}
+}
+
+// ParseValue reads a number in decimal or 0x hex, or the current value of a register
+func ParseValue(s string) (uint16, error) {
+	if register, ok := RegisterByName(s); ok {
+		return ReadRegister(register), nil
+	}
+	value, err := strconv.ParseInt(s, 0, 32)
+	if err != nil {
+		return 0, fmt.Errorf("%q is not a number or register", s)
+	}
+	if value < -0x8000 || value > 0xffff {
+		return 0, fmt.Errorf("%q doesn't fit in 16 bits", s)
+	}
+	return uint16(value), nil
+}
+
+// ParseSegmentValue is ParseValue for the parts of segment:offset, numbers are hex with or without 0x the way
+// debug.com and nasm map files write them
+func ParseSegmentValue(s string) (uint16, error) {
+	if _, ok := RegisterByName(s); ok || strings.HasPrefix(strings.ToLower(s), "0x") {
+		return ParseValue(s)
+	}
+	value, err := strconv.ParseUint(s, 16, 16)
+	if err != nil {
+		return 0, fmt.Errorf("%q is not a hex number or register", s)
+	}
+	return uint16(value), nil
+}
+
+// segmentBase is the physical address a segment starts at
+func segmentBase(segment string) (uint32, error) {
+	value, err := ParseSegmentValue(segment)
+	if err != nil {
+		return 0, err
+	}
+	return uint32(value) << 4, nil
+}
+
+// ParseAddress parses [segment:]offset where the offset can be a sum like bx+2 or a symbol like factorial+3.
+// A symbol after a segment is taken as its offset in that segment, and numbers after a segment are hex
+func ParseAddress(s string) (uint32, error) {
+	var base uint32
+	hasSegment := false
+	if segment, offset, found := strings.Cut(s, ":"); found {
+		var err error
+		if base, err = segmentBase(segment); err != nil {
+			return 0, err
+		}
+		s = offset
+		hasSegment = true
+	}
+
+	var offset uint16
+	for _, term := range strings.Split(s, "+") {
+		term = strings.TrimSpace(term)
+		// symbols are already physical addresses
+		if symbol, ok := Symbols.Find(term); ok {
+			if !hasSegment {
+				base += symbol.Address
+				continue
+			}
+			if symbol.Address < base || symbol.Address-base > 0xffff {
+				return 0, fmt.Errorf("%s at %05x isn't in segment %04x", term, symbol.Address, base>>4)
+			}
+			offset += uint16(symbol.Address - base)
+			continue
+		}
+		parse := ParseValue
+		if hasSegment {
+			parse = ParseSegmentValue
+		}
+		value, err := parse(term)
+		if err != nil {
+			return 0, err
+		}
+		offset += value
+	}
+	return base + uint32(offset), nil
+}
+
+// Examine implements x/<count><format><size> <address>
+func (d *Debugger) Examine(spec, address string) error {
+	count, format, size := 1, byte('x'), byte('b')
+	spec = strings.TrimPrefix(spec, "x")
+	spec = strings.TrimPrefix(spec, "/")
+	digits := strings.IndexFunc(spec, func(r rune) bool { return r < '0' || r > '9' })
+	if digits == -1 {
+		digits = len(spec)
+	}
+	if digits > 0 {
+		count, _ = strconv.Atoi(spec[:digits])
+	}
+	for _, c := range []byte(spec[digits:]) {
+		switch c {
+		case 'x', 'd':
+			format = c
+		case 'b', 'w':
+			size = c
+		default:
+			return fmt.Errorf("unknown examine format %q", c)
+		}
+	}
+
+	location, err := ParseAddress(address)
+	if err != nil {
+		return err
+	}
+
+	width := 1
+	if size == 'w' {
+		width = 2
+	}
+	perLine := 16 / width
+	for i := 0; i < count; i++ {
+		if i%perLine == 0 {
+			if i != 0 {
+				fmt.Fprintln(d.Out)
+			}
+			fmt.Fprintf(d.Out, "%05x:", location)
+		}
+
+		value := MemoryValues.Peek(location, width == 2)
+
+		switch {
+		case format == 'd':
+			fmt.Fprintf(d.Out, " %d", value)
+		case width == 2:
+			fmt.Fprintf(d.Out, " %04x", value)
+		default:
+			fmt.Fprintf(d.Out, " %02x", value)
+		}
+		location += uint32(width)
+	}
+	fmt.Fprintln(d.Out)
+	return nil
+}
+
+// Execute runs a single debugger command, it returns false when the debugger should exit
+func (d *Debugger) Execute(line string) bool {
+	line = strings.TrimSpace(line)
+	if line == "" {
+		line = d.lastCommand
+	}
+	d.lastCommand = line
+
+	fields := strings.Fields(line)
+	if len(fields) == 0 {
+		return true
+	}
+
+	var err error
+	switch command := fields[0]; {
+	case command == "s" || command == "step":
+		count := 1
+		if len(fields) > 1 {
+			count, err = strconv.Atoi(fields[1])
+		}
+		for i := 0; i < count && err == nil; i++ {
+			if !d.StepOne() {
+				break
+			}
+		}
+	case command == "n" || command == "next":
+		d.Next()
+	case command == "c" || command == "continue":
+		d.RunUntil(func() bool { return false })
+	case command == "u" || command == "until":
+		if len(fields) < 2 {
+			err = fmt.Errorf("until needs an address")
+			break
+		}
+		var target uint32
+		if target, err = ParseAddress(fields[1]); err == nil {
+			d.RunUntil(func() bool { return InstructionAddress() == target })
+		}
+	case command == "b" || command == "break":
+		var b *Breakpoint
+		if b, err = d.Breakpoints.Add(strings.Join(fields[1:], " ")); err == nil {
+			fmt.Fprintf(d.Out, "breakpoint %s\n", b)
+		}
+	case command == "delete":
+		if len(fields) < 2 {
+			err = fmt.Errorf("delete needs a breakpoint id")
+			break
+		}
+		var id int
+		if id, err = strconv.Atoi(fields[1]); err == nil {
+			err = d.Breakpoints.Delete(id)
+		}
+	case command == "w" || command == "watch":
+		var w *Watchpoint
+		if w, err = d.Watchpoints.Add(strings.Join(fields[1:], " ")); err == nil {
+			fmt.Fprintf(d.Out, "watchpoint %s\n", w)
+		}
+	case command == "unwatch":
+		if len(fields) < 2 {
+			err = fmt.Errorf("unwatch needs a watchpoint id")
+			break
+		}
+		var id int
+		if id, err = strconv.Atoi(fields[1]); err == nil {
+			err = d.Watchpoints.Delete(id)
+		}
+	case command == "i" || command == "info":
+		for _, b := range d.Breakpoints.List {
+			fmt.Fprintln(d.Out, "breakpoint", b)
+		}
+		for _, w := range d.Watchpoints.List {
+			fmt.Fprintln(d.Out, "watchpoint", w)
+		}
+	case command == "rs" || command == "reverse-step":
+		count := 1
+		if len(fields) > 1 {
+			count, err = strconv.Atoi(fields[1])
+		}
+		for i := 0; i < count && err == nil; i++ {
+			if !d.ReverseStep() {
+				break
+			}
+		}
+		if err == nil {
+			d.printLocation()
+		}
+	case command == "rc" || command == "reverse-continue":
+		d.ReverseContinue()
+	case command == "lastwrite":
+		var address uint32
+		if address, err = ParseAddress(strings.Join(fields[1:], "")); err == nil {
+			d.LastWrite(address)
+		}
+	case command == "r" || command == "regs":
+		fmt.Fprint(d.Out, RegisterValues)
+		fmt.Fprintln(d.Out, CpuFlagValues)
+	case command == "bt" || command == "backtrace":
+		fmt.Fprint(d.Out, Calls.Backtrace())
+	case command == "stack":
+		words := 8
+		if len(fields) > 1 {
+			words, err = strconv.Atoi(fields[1])
+		}
+		if err == nil {
+			fmt.Fprint(d.Out, StackView(words))
+		}
+	case strings.HasPrefix(command, "x"):
+		if len(fields) < 2 {
+			err = fmt.Errorf("x needs an address")
+			break
+		}
+		err = d.Examine(command, strings.Join(fields[1:], ""))
+	case command == "set":
+		// accept both `set ax 5` and `set ax=5`
+		args := strings.FieldsFunc(strings.Join(fields[1:], " "), func(r rune) bool { return r == ' ' || r == '=' })
+		if len(args) != 2 {
+			err = fmt.Errorf("usage: set <reg> <value>")
+			break
+		}
+		register, ok := RegisterByName(args[0])
+		if !ok {
+			err = fmt.Errorf("unknown register %q", args[0])
+			break
+		}
+		var value uint16
+		if value, err = ParseValue(args[1]); err == nil {
+			WriteRegister(register, value)
+		}
+	case command == "save":
+		if len(fields) < 2 {
+			err = fmt.Errorf("save needs a file name")
+			break
+		}
+		if err = SaveSnapshot(fields[1], d.Program); err == nil {
+			fmt.Fprintln(d.Out, "saved snapshot to", fields[1])
+		}
+	case command == "load":
+		if len(fields) < 2 {
+			err = fmt.Errorf("load needs a file name")
+			break
+		}
+		var snapshot Snapshot
+		if snapshot, err = LoadSnapshot(fields[1]); err == nil {
+			d.Program = snapshot.Program
+			d.Disassembly = DecodeFlow(MemoryValues.Bytes, d.Program.Start, d.Program.End, append(d.Program.Entries, int(InstructionAddress()))...)
+			if d.History != nil {
+				d.History.Records = nil
+			}
+			d.printLocation()
+		}
+	case command == "d" || command == "disas":
+		count := 5
+		if len(fields) > 1 {
+			count, err = strconv.Atoi(fields[1])
+		}
+		if err == nil {
+			d.Disassemble(count)
+		}
+	case command == "h" || command == "help":
+		fmt.Fprintln(d.Out, debuggerHelp)
+	case command == "q" || command == "quit":
+		return false
+	default:
+		err = fmt.Errorf("unknown command %q, try help", command)
+	}
+
+	if err != nil {
+		fmt.Fprintln(d.Out, "error:", err)
+	}
+	return true
+}
+
+// Repl reads commands until quit or the input runs out
+func (d *Debugger) Repl() {
+	scanner := bufio.NewScanner(d.In)
+	d.printLocation()
+	for {
+		fmt.Fprint(d.Out, "(8086) ")
+		if !scanner.Scan() || !d.Execute(scanner.Text()) {
+			return
+		}
+	}
+}
+
+// RunDebugCommand handles `sim_8086 debug <file>`
+func RunDebugCommand(args []string) {
+	flags := flag.NewFlagSet("debug", flag.ExitOnError)
+	var breakpointSpecs, watchpointSpecs RepeatedFlag
+	flags.Var(&breakpointSpecs, "break", "breakpoint to start with, same syntax as the break command (repeatable)")
+	flags.Var(&watchpointSpecs, "watch", "watchpoint to start with, same syntax as the watch command (repeatable)")
+	historyLimit := flags.Int("history", 100_000, "instructions to remember for reverse execution, 0 turns it off")
+	var options MachineOptions
+	options.AddFlags(flags)
+	flags.Parse(args)
+
+	if flags.NArg() == 0 && len(options.Loads) == 0 && len(options.Roms) == 0 {
+		fmt.Println("Error: no file provided")
+		flags.PrintDefaults()
+		return
+	}
+	program, dos, err := setupMachine(flags.Arg(0), options)
+	if err != nil {
+		fmt.Println("Error:", err)
+		return
+	}
+
+	debugger := Debugger{
+		In:          os.Stdin,
+		Out:         os.Stdout,
+		Disassembly: DecodeFlow(MemoryValues.Bytes, program.Start, program.End, program.Entries...),
+		Program:     program,
+		Breakpoints: &Breakpoints{},
+		Watchpoints: NewWatchpoints(&MemoryValues),
+	}
+	if *historyLimit > 0 {
+		debugger.History = NewHistory(&MemoryValues, *historyLimit)
+	}
+	for _, spec := range breakpointSpecs {
+		if _, err := debugger.Breakpoints.Add(spec); err != nil {
+			fmt.Printf("Error: invalid breakpoint %q: %v\n", spec, err)
+			return
+		}
+	}
+	for _, spec := range watchpointSpecs {
+		if _, err := debugger.Watchpoints.Add(spec); err != nil {
+			fmt.Printf("Error: invalid watchpoint %q: %v\n", spec, err)
+			return
+		}
+	}
+	debugger.Repl()
+	if dos != nil {
+		// the exit status is the program's like it is without the debugger
+		os.Exit(int(dos.ExitCode))
+	}
+}
@@ -5,37 +5,93 @@ import (
 )
 
 func Decode(memory []byte, at *int) map[int]Instruction {
-	memVal := Memory{Bytes: memory}
+	memVal := &Memory{Bytes: memory}
 	var allInstructions = map[int]Instruction{}
 
 	for *at < len(memory) {
-		atBeforeTryingInstructions := *at
-		for _, instruction := range instTable {
-			instVal, err := TryDecode(memVal, *at, instruction)
-			if err != nil {
-				continue
-			}
-
-			// instruction was valid no need to test more
-			allInstructions[*at] = instVal
-			*at += int(instVal.Size) // confirm the read, move the address the length of the instruction to the next instruction
-			break                    // found a match, we can exit the inner loop and try decoding from the next readable byte
-		}
-
-		// we failed to decode
-		if *at == atBeforeTryingInstructions {
+		instVal, err := DecodeAt(memVal, *at)
+		if err != nil {
+			// we failed to decode
 			fmt.Println(allInstructions)
 			panic(fmt.Sprintf("[ERROR]: failed to decode: %08b\n", memory[*at:]))
-
 		}
 
+		allInstructions[*at] = instVal
+		*at += int(instVal.Size) // confirm the read, move the address the length of the instruction to the next instruction
 	}
 
 	return allInstructions
 }
 
+// maxInstructionSize is a segment prefix and the longest instruction, opcode, modrm, a displacement and data word
+const maxInstructionSize = 7
+
+// instructionQueue holds the bytes of one instruction fetched from the bus, every encoding is tried against them so
+// each byte is only fetched once. Reading past what was fetched panics like reading past the end of memory
+type instructionQueue struct {
+	at    int
+	bytes []byte
+	size  int // of the memory they came from
+}
+
+func (q *instructionQueue) Fetch(address uint32) uint8 {
+	return q.bytes[int(address)-q.at]
+}
+
+func (q *instructionQueue) Size() int {
+	return q.size
+}
+
+// DecodeAt decodes the single instruction starting at address at, trying each encoding in the instruction table.
+// The bytes are fetched through the bus so code in a mapped region reads what the region gives
+func DecodeAt(memory Bus, at int) (Instruction, error) {
+	if at < 0 || at >= memory.Size() {
+		return Instruction{}, fmt.Errorf("address %d is outside of memory", at)
+	}
+	queue := &instructionQueue{at: at, size: memory.Size()}
+	for address := at; address < at+maxInstructionSize && address < memory.Size(); address++ {
+		queue.bytes = append(queue.bytes, memory.Fetch(uint32(address)))
+	}
+	return decodeQueue(queue, at)
+}
+
+func decodeQueue(queue *instructionQueue, at int) (inst Instruction, err error) {
+	// an instruction hanging off the end of memory reads out of bounds, treat that as undecodable
+	defer func() {
+		if r := recover(); r != nil {
+			inst, err = Instruction{}, fmt.Errorf("instruction at %d runs past end of memory", at)
+		}
+	}()
+
+	// segment override prefix 001 sr 110, it applies to the memory operand of the instruction after it
+	if prefix := queue.Fetch(uint32(at)); prefix&0b11100111 == 0b00100110 {
+		inst, err := decodeQueue(queue, at+1)
+		if err != nil {
+			return Instruction{}, err
+		}
+		for i := range inst.InstructionOperands {
+			inst.InstructionOperands[i].EffectiveAddress.Segment = Register_es + Register((prefix>>3)&0b11)
+		}
+		inst.Address = uint32(at)
+		inst.Size++
+		inst.Bytes = append([]byte{prefix}, inst.Bytes...)
+		return inst, nil
+	}
+
+	for _, instruction := range instTable {
+		instVal, err := TryDecode(queue, at, instruction)
+		if err != nil {
+			continue
+		}
+		// instruction was valid no need to test more
+		return instVal, nil
+	}
+
+	return Instruction{}, fmt.Errorf("no instruction matches %08b at %d", queue.Fetch(uint32(at)), at)
+}
+
 // TryDecode attempts to decode one(1) instruction, and moves the at position forwards
-func TryDecode(memory Memory, at int, possibleInstruction InstructionEncoding) (Instruction, error) {
+func TryDecode(memory *instructionQueue, at int, possibleInstruction InstructionEncoding) (Instruction, error) {
 	isValidInst := true
 	decodedInst := Instruction{
 		Address:             uint32(at),
@@ -51,15 +107,15 @@ func TryDecode(memory Memory, at int, possibleInstruction InstructionEncoding) (
 
 	testBits := InstructionBits{
 		BitCount: 8,
-		Value:    memory.ReadMemory(&at),
+		Value:    memory.Fetch(uint32(at)),
 	}
-	decodedInst.Bytes = append(decodedInst.Bytes, memory.ReadMemory(&at))
+	decodedInst.Bytes = append(decodedInst.Bytes, memory.Fetch(uint32(at)))
 	at += 1 // don't move at until we actually read
 
 	for _, pisBits := range possibleInstruction.Bits {
-		if testBits.BitCount == 0 && at < len(memory.Bytes) && pisBits.BitCount != 0 {
-			testBits.Value = memory.ReadMemory(&at)
-			decodedInst.Bytes = append(decodedInst.Bytes, memory.ReadMemory(&at))
+		if testBits.BitCount == 0 && at < memory.Size() && pisBits.BitCount != 0 {
+			testBits.Value = memory.Fetch(uint32(at))
+			decodedInst.Bytes = append(decodedInst.Bytes, memory.Fetch(uint32(at)))
 			at += 1 // don't move at until we actually read
 			decodedInst.Size++
 		}
@@ -102,8 +158,8 @@ func TryDecode(memory Memory, at int, possibleInstruction InstructionEncoding) (
 		displacementIsW := (mod == 0b10) || hasDirectAddress
 		dataisW := bits[Bits_S] != 1 && (w == 0b1)
 
-		DispVal := ParseDataValue(&memory, &at, &decodedInst, hasDisplacement, displacementIsW)
-		DataVal := ParseDataValue(&memory, &at, &decodedInst, has[Bits_Data], dataisW)
+		DispVal := ParseDataValue(memory, &at, &decodedInst, hasDisplacement, displacementIsW)
+		DataVal := ParseDataValue(memory, &at, &decodedInst, has[Bits_Data], dataisW)
 
 		source := &decodedInst.InstructionOperands[1]
 		dest := &decodedInst.InstructionOperands[0]
@@ -126,6 +182,12 @@ func TryDecode(memory Memory, at int, possibleInstruction InstructionEncoding) (
 		if has[Bits_REG] {
 			*source = GetRegisterOperand(reg, w)
 		}
+		if has[Bits_SR] {
+			*source = InstructionOperand{
+				Type:     Operand_Register,
+				Register: RegisterAccess{Register_es + Register(bits[Bits_SR]), 0, 2},
+			}
+		}
 
 		if has[Bits_MOD] {
 			if mod == 0b11 {
@@ -154,6 +216,13 @@ func TryDecode(memory Memory, at int, possibleInstruction InstructionEncoding) (
 			decodedInst.InstructionOperands[1].Immediate.Value = int(DataVal)
 
 		}
+		if has[Bits_PortDX] {
+			// dx is a full word even when the accumulator is al
+			decodedInst.InstructionOperands[1] = InstructionOperand{
+				Type:     Operand_Register,
+				Register: RegisterAccess{Register_d, 0, 2},
+			}
+		}
 		return decodedInst, nil
 	}
 
@@ -183,23 +252,23 @@ func GetRegisterOperand(registerIndex uint8, w uint8) InstructionOperand {
 	return operand
 }
 
-func ParseDataValue(memory *Memory, at *int, decodedInst *Instruction, exists, wide bool) uint16 {
+func ParseDataValue(memory *instructionQueue, at *int, decodedInst *Instruction, exists, wide bool) uint16 {
 	var res uint16
 	if exists {
 		if wide {
 			// read 2 bytes
-			b1 := memory.ReadMemory(at)
+			b1 := memory.Fetch(uint32(*at))
 			decodedInst.Bytes = append(decodedInst.Bytes, b1)
 			*at += 1
 			decodedInst.Size++
-			b2 := memory.ReadMemory(at)
+			b2 := memory.Fetch(uint32(*at))
 			decodedInst.Bytes = append(decodedInst.Bytes, b2)
 			decodedInst.Size++
 			*at += 1
 			res = uint16(b1) | uint16(b2)<<8
 		} else {
 			// read
-			b1 := memory.ReadMemory(at)
+			b1 := memory.Fetch(uint32(*at))
 			decodedInst.Bytes = append(decodedInst.Bytes, b1)
 			*at += 1
 			decodedInst.Size++
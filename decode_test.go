@@ -0,0 +1,36 @@
+package main
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestDecodeSegmentPrefix(t *testing.T) {
+	// es: mov [bx+2], ax
+	memory := []byte{0x26, 0x89, 0x47, 0x02}
+	instruction, err := DecodeAt(&Memory{Bytes: memory}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if instruction.Op != Op_mov || instruction.Size != 4 || !slices.Equal(instruction.Bytes, memory) {
+		t.Errorf("decoded %s, %d bytes %x", instruction, instruction.Size, instruction.Bytes)
+	}
+	if text := instruction.String(); text != "mov [es:bx + 2], ax" {
+		t.Errorf("decoded %q", text)
+	}
+	destination := instruction.InstructionOperands[0].EffectiveAddress
+	if destination.Segment != Register_es || destination.SegmentRegister() != Register_es {
+		t.Errorf("the memory operand is in %s, want es", RegisterName(destination.SegmentRegister()))
+	}
+
+	// the write goes to es rather than ds
+	ResetMachine()
+	copy(MemoryValues.Bytes, memory)
+	WriteU16(RegisterValues[Register_a], 0, 0xbeef)
+	WriteU16(RegisterValues[Register_es], 0, 0x2000)
+	WriteU16(RegisterValues[Register_b], 0, 0x10)
+	Simulate(instruction, []bool{false, false, false})
+	if value := MemoryValues.Peek(0x20012, true); value != 0xbeef {
+		t.Errorf("es:[bx+2] holds %04x after the mov, want beef", value)
+	}
+}
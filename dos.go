@@ -0,0 +1,384 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// dos error codes returned in ax with cf set
+const (
+	dosInvalidFunction = 0x01
+	dosFileNotFound    = 0x02
+	dosPathNotFound    = 0x03
+	dosTooManyFiles    = 0x04
+	dosAccessDenied    = 0x05
+	dosInvalidHandle   = 0x06
+)
+
+// Dos implements the int 21h console and file calls simple dos programs use, console io goes through the bios.
+// Files are opened inside Root on the host so programs can't reach anything outside it. Open host files can't go
+// in a snapshot so saving one fails while the program has any open
+type Dos struct {
+	Bios     *Bios
+	Log      io.Writer
+	Root     string
+	ExitCode uint8
+
+	files      map[uint16]*os.File
+	nextHandle uint16
+}
+
+// NewDos makes a dos that keeps files inside root
+func NewDos(bios *Bios, log io.Writer, root string) *Dos {
+	// 0-4 are the standard handles, stdin stdout stderr aux and prn
+	return &Dos{Bios: bios, Log: log, Root: root, files: map[uint16]*os.File{}, nextHandle: 5}
+}
+
+// Install hooks int 21h and saves its state with snapshots
+func (d *Dos) Install() {
+	InterruptHandlers[0x21] = d.call
+	SnapshotDevices = append(SnapshotDevices, d)
+}
+
+// dosState is what a snapshot keeps of dos
+type dosState struct {
+	ExitCode   uint8  `json:"exit_code"`
+	NextHandle uint16 `json:"next_handle"`
+}
+
+func (d *Dos) SnapshotName() string {
+	return "dos"
+}
+
+func (d *Dos) SaveState() (json.RawMessage, error) {
+	if len(d.files) > 0 {
+		return nil, fmt.Errorf("the program has %d files open", len(d.files))
+	}
+	return json.Marshal(dosState{d.ExitCode, d.nextHandle})
+}
+
+func (d *Dos) LoadState(state json.RawMessage) error {
+	var s dosState
+	if err := json.Unmarshal(state, &s); err != nil {
+		return err
+	}
+	d.ExitCode, d.nextHandle = s.ExitCode, s.NextHandle
+	return nil
+}
+
+// dosResult finishes a call, cf is set and ax holds the error code when it failed
+func dosResult(err uint16) {
+	CpuFlagValues[CarryFlag] = err != 0
+	if err != 0 {
+		WriteRegister(regAX, err)
+	}
+}
+
+// readString reads bytes from memory starting at address until terminator, it gives up after 64k
+func readString(address uint32, terminator byte) []byte {
+	var res []byte
+	for i := uint32(0); i < 0x10000; i++ {
+		b := byte(MemoryValues.Read(WrapAddress(address+i), false))
+		if b == terminator {
+			break
+		}
+		res = append(res, b)
+	}
+	return res
+}
+
+// dataAddress is ds:dx, where most calls take their buffer or file name
+func dataAddress() uint32 {
+	return Physical(SegmentBase(Register_ds), ReadRegister(regDX))
+}
+
+// readKey waits for a key like a real dos would, running out of scripted input halts the program
+func (d *Dos) readKey() (uint8, bool) {
+	key, ok := d.Bios.nextKey(true)
+	if !ok {
+		fmt.Fprintln(d.Log, "dos: waiting for a key but keyboard input has run out, halting")
+		Halted = true
+	}
+	return uint8(key), ok
+}
+
+// hostPath maps a dos file name onto a path inside Root, drive letters are dropped and neither .. nor symlinks can leave Root
+func (d *Dos) hostPath(name string) (string, bool) {
+	name = strings.ReplaceAll(name, `\`, "/")
+	if len(name) >= 2 && name[1] == ':' {
+		name = name[2:]
+	}
+	name = strings.TrimPrefix(filepath.Clean("/"+name), "/")
+	if !filepath.IsLocal(name) {
+		return "", false
+	}
+
+	path := filepath.Join(d.Root, name)
+	if _, err := os.Stat(path); err != nil {
+		// dos names are case insensitive, most host files are lower case
+		if lower := filepath.Join(d.Root, strings.ToLower(name)); lower != path {
+			if _, err := os.Stat(lower); err == nil {
+				path = lower
+			}
+		}
+	}
+	// .. is gone from name but a symlink inside Root can still point out of it
+	if !d.insideRoot(path) {
+		return "", false
+	}
+	return path, true
+}
+
+// insideRoot resolves the symlinks in path and checks it still ends up under Root, a file that doesn't exist yet
+// (being created) is checked by the directory it would go in
+func (d *Dos) insideRoot(path string) bool {
+	root, err := filepath.EvalSymlinks(d.Root)
+	if err != nil {
+		return false
+	}
+	resolved, err := filepath.EvalSymlinks(path)
+	if err != nil {
+		if _, err := os.Lstat(path); err == nil {
+			// a dangling symlink, creating the file would follow it to wherever it points
+			return false
+		}
+		directory, err := filepath.EvalSymlinks(filepath.Dir(path))
+		if err != nil {
+			return false
+		}
+		resolved = filepath.Join(directory, filepath.Base(path))
+	}
+	relative, err := filepath.Rel(root, resolved)
+	return err == nil && (relative == "." || filepath.IsLocal(relative))
+}
+
+// fileError turns a host error into a dos error code
+func fileError(err error) uint16 {
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+		return dosFileNotFound
+	case errors.Is(err, fs.ErrInvalid):
+		return dosInvalidFunction
+	}
+	// anything else is most likely permissions
+	return dosAccessDenied
+}
+
+func (d *Dos) open(flags int) {
+	path, ok := d.hostPath(string(readString(dataAddress(), 0)))
+	if !ok {
+		dosResult(dosPathNotFound)
+		return
+	}
+	if len(d.files) >= 255 {
+		dosResult(dosTooManyFiles)
+		return
+	}
+	file, err := os.OpenFile(path, flags, 0644)
+	if err != nil {
+		dosResult(fileError(err))
+		return
+	}
+	handle := d.nextHandle
+	d.nextHandle++
+	d.files[handle] = file
+	WriteRegister(regAX, handle)
+	dosResult(0)
+}
+
+// read handles 3fh, handle 0 reads keys
+func (d *Dos) read() {
+	handle, count, buffer := ReadRegister(regBX), int(ReadRegister(regCX)), dataAddress()
+	var data []byte
+	if handle == 0 {
+		for len(data) < count {
+			key, ok := d.readKey()
+			if !ok {
+				return
+			}
+			d.Bios.teletype(key)
+			data = append(data, key)
+			if key == '\r' {
+				// dos hands back the line with cr lf on the end
+				d.Bios.teletype('\n')
+				if len(data) < count {
+					data = append(data, '\n')
+				}
+				break
+			}
+		}
+	} else {
+		file, ok := d.files[handle]
+		if !ok {
+			dosResult(dosInvalidHandle)
+			return
+		}
+		data = make([]byte, count)
+		n, err := file.Read(data)
+		if err != nil && err != io.EOF {
+			dosResult(fileError(err))
+			return
+		}
+		data = data[:n]
+	}
+
+	for i, b := range data {
+		MemoryValues.Write(WrapAddress(buffer+uint32(i)), uint16(b), false)
+	}
+	WriteRegister(regAX, uint16(len(data)))
+	dosResult(0)
+}
+
+// write handles 40h, handles 1 and 2 go to the screen
+func (d *Dos) write() {
+	handle, count, buffer := ReadRegister(regBX), int(ReadRegister(regCX)), dataAddress()
+	data := make([]byte, count)
+	for i := range data {
+		data[i] = byte(MemoryValues.Read(WrapAddress(buffer+uint32(i)), false))
+	}
+
+	if handle == 1 || handle == 2 {
+		for _, b := range data {
+			d.Bios.teletype(b)
+		}
+	} else {
+		file, ok := d.files[handle]
+		if !ok {
+			dosResult(dosInvalidHandle)
+			return
+		}
+		if _, err := file.Write(data); err != nil {
+			dosResult(fileError(err))
+			return
+		}
+	}
+	WriteRegister(regAX, uint16(count))
+	dosResult(0)
+}
+
+// call handles int 21h, ah picks the function
+func (d *Dos) call() {
+	switch ah := ReadRegister(regAH); ah {
+	case 0x00: // terminate
+		Halted = true
+	case 0x01: // read a character and echo it
+		if key, ok := d.readKey(); ok {
+			d.Bios.teletype(key)
+			WriteRegister(regAL, uint16(key))
+		}
+	case 0x02: // write the character in dl
+		d.Bios.teletype(uint8(ReadRegister(regDL)))
+		WriteRegister(regAL, ReadRegister(regDL))
+	case 0x06: // direct console io, dl ffh reads without waiting
+		if ReadRegister(regDL) != 0xff {
+			d.Bios.teletype(uint8(ReadRegister(regDL)))
+			break
+		}
+		key, ok := d.Bios.nextKey(false)
+		CpuFlagValues[ZeroFlag] = !ok
+		WriteRegister(regAL, key&0xff)
+	case 0x07, 0x08: // read a character without echo
+		if key, ok := d.readKey(); ok {
+			WriteRegister(regAL, uint16(key))
+		}
+	case 0x09: // write a $ terminated string at ds:dx
+		for _, b := range readString(dataAddress(), '$') {
+			d.Bios.teletype(b)
+		}
+		WriteRegister(regAL, '$')
+	case 0x0a: // buffered line input into ds:dx, the first byte is the buffer size
+		buffer := dataAddress()
+		size := MemoryValues.Read(buffer, false)
+		var line []byte
+		for {
+			key, ok := d.readKey()
+			if !ok {
+				return
+			}
+			if key == '\r' {
+				break
+			}
+			if key == '\b' {
+				if len(line) > 0 {
+					line = line[:len(line)-1]
+					d.Bios.teletype('\b')
+				}
+				continue
+			}
+			// the cr needs a byte too
+			if len(line)+1 < int(size) {
+				line = append(line, key)
+				d.Bios.teletype(key)
+			}
+		}
+		d.Bios.teletype('\r')
+		MemoryValues.Write(buffer+1, uint16(len(line)), false)
+		for i, b := range append(line, '\r') {
+			MemoryValues.Write(buffer+2+uint32(i), uint16(b), false)
+		}
+	case 0x0b: // is a key waiting
+		WriteRegister(regAL, 0)
+		if key, ok := d.Bios.nextKey(false); ok {
+			d.Bios.pendingKey = int(key)
+			WriteRegister(regAL, 0xff)
+		}
+	case 0x30: // dos version, pretend to be 5.0
+		WriteRegister(regAX, 0x0005)
+		WriteRegister(regBX, 0)
+		WriteRegister(regCX, 0)
+	case 0x3c: // create or truncate a file
+		d.open(os.O_RDWR | os.O_CREATE | os.O_TRUNC)
+	case 0x3d: // open an existing file, al is the access mode
+		d.open([]int{os.O_RDONLY, os.O_WRONLY, os.O_RDWR, os.O_RDONLY}[ReadRegister(regAL)&3])
+	case 0x3e: // close
+		file, ok := d.files[ReadRegister(regBX)]
+		if !ok {
+			dosResult(dosInvalidHandle)
+			break
+		}
+		delete(d.files, ReadRegister(regBX))
+		if err := file.Close(); err != nil {
+			dosResult(fileError(err))
+			break
+		}
+		dosResult(0)
+	case 0x3f:
+		d.read()
+	case 0x40:
+		d.write()
+	case 0x42: // seek to cx:dx from the start, current position or end depending on al
+		file, ok := d.files[ReadRegister(regBX)]
+		if !ok {
+			dosResult(dosInvalidHandle)
+			break
+		}
+		if ReadRegister(regAL) > 2 {
+			dosResult(dosInvalidFunction)
+			break
+		}
+		offset := int64(int32(uint32(ReadRegister(regCX))<<16 | uint32(ReadRegister(regDX))))
+		position, err := file.Seek(offset, int(ReadRegister(regAL)))
+		if err != nil {
+			dosResult(fileError(err))
+			break
+		}
+		WriteRegister(regDX, uint16(position>>16))
+		WriteRegister(regAX, uint16(position))
+		dosResult(0)
+	case 0x4c: // terminate with the exit code in al
+		d.ExitCode = uint8(ReadRegister(regAL))
+		if d.ExitCode != 0 {
+			fmt.Fprintf(d.Log, "dos: program exited with code %d\n", d.ExitCode)
+		}
+		Halted = true
+	default:
+		fmt.Fprintf(d.Log, "dos: int 21h ah=%02xh isn't implemented\n", ah)
+		dosResult(dosInvalidFunction)
+	}
+}
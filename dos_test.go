@@ -0,0 +1,46 @@
+package main
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestDosHostPath(t *testing.T) {
+	root := t.TempDir()
+	outside := t.TempDir()
+	os.WriteFile(filepath.Join(root, "data.txt"), nil, 0644)
+	os.WriteFile(filepath.Join(outside, "secret.txt"), nil, 0644)
+	os.Mkdir(filepath.Join(root, "sub"), 0755)
+	if err := os.Symlink(outside, filepath.Join(root, "out")); err != nil {
+		t.Skip("can't make symlinks here:", err)
+	}
+	os.Symlink(filepath.Join(outside, "secret.txt"), filepath.Join(root, "secret.txt"))
+	os.Symlink(filepath.Join(outside, "new.txt"), filepath.Join(root, "dangling.txt"))
+	os.Symlink("sub", filepath.Join(root, "inside"))
+	dos := NewDos(NewBios(io.Discard, io.Discard, nil, nil), io.Discard, root)
+
+	tests := []struct {
+		name string
+		path string
+		ok   bool
+	}{
+		{`DATA.TXT`, filepath.Join(root, "data.txt"), true},
+		{`c:\sub\new.txt`, filepath.Join(root, "sub", "new.txt"), true},
+		{`..\..\data.txt`, filepath.Join(root, "data.txt"), true},
+		// the directory has to be there to know where the file would end up
+		{`nodir\new.txt`, "", false},
+		{`inside\new.txt`, filepath.Join(root, "inside", "new.txt"), true},
+		{`out\secret.txt`, "", false},
+		{`out\new.txt`, "", false},
+		{`secret.txt`, "", false},
+		{`dangling.txt`, "", false},
+	}
+	for _, test := range tests {
+		path, ok := dos.hostPath(test.name)
+		if ok != test.ok || path != test.path {
+			t.Errorf("hostPath(%q) = %q, %v want %q, %v", test.name, path, ok, test.path, test.ok)
+		}
+	}
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"os"
+)
+
+// ExeHeader is the fixed part of an MZ executable's header, sizes are in 512 byte pages or 16 byte paragraphs
+type ExeHeader struct {
+	Signature        uint16
+	LastPageBytes    uint16 // bytes used in the last page, 0 means all 512
+	Pages            uint16
+	Relocations      uint16
+	HeaderParagraphs uint16
+	MinAlloc         uint16 // extra paragraphs the program needs after its image
+	MaxAlloc         uint16 // extra paragraphs it would like
+	SS               uint16 // relative to the load segment
+	SP               uint16
+	Checksum         uint16
+	IP               uint16
+	CS               uint16 // relative to the load segment
+	RelocationTable  uint16 // file offset of the relocation table
+	Overlay          uint16
+}
+
+const exeHeaderSize = 0x1c
+
+// ExeRelocation is a segment:offset in the image of a word that needs the load segment added to it
+type ExeRelocation struct {
+	Offset  uint16
+	Segment uint16
+}
+
+// Exe is a parsed MZ executable
+type Exe struct {
+	Header      ExeHeader
+	Relocations []ExeRelocation
+	Image       []byte // the load module, everything after the header
+}
+
+// ParseExe checks an MZ executable's header is sane and splits it into the header, relocations and load module
+func ParseExe(file []byte) (Exe, error) {
+	if len(file) < exeHeaderSize {
+		return Exe{}, fmt.Errorf("%d bytes is too short for an MZ header", len(file))
+	}
+	var header ExeHeader
+	for i, field := range []*uint16{
+		&header.Signature, &header.LastPageBytes, &header.Pages, &header.Relocations, &header.HeaderParagraphs,
+		&header.MinAlloc, &header.MaxAlloc, &header.SS, &header.SP, &header.Checksum, &header.IP, &header.CS,
+		&header.RelocationTable, &header.Overlay,
+	} {
+		*field = binary.LittleEndian.Uint16(file[i*2:])
+	}
+
+	// ZM is accepted by dos too
+	if header.Signature != 0x5a4d && header.Signature != 0x4d5a {
+		return Exe{}, fmt.Errorf("missing MZ signature, got %04x", header.Signature)
+	}
+	if header.LastPageBytes > 512 {
+		return Exe{}, fmt.Errorf("last page has %d bytes, a page is only 512", header.LastPageBytes)
+	}
+	if header.Pages == 0 {
+		return Exe{}, fmt.Errorf("header says the file has no pages")
+	}
+
+	fileSize := int(header.Pages) * 512
+	if header.LastPageBytes != 0 {
+		fileSize -= 512 - int(header.LastPageBytes)
+	}
+	headerSize := int(header.HeaderParagraphs) * 16
+	if headerSize < exeHeaderSize {
+		return Exe{}, fmt.Errorf("header is %d bytes, smaller than the %d byte MZ header", headerSize, exeHeaderSize)
+	}
+	if headerSize > fileSize {
+		return Exe{}, fmt.Errorf("header is %d bytes but the file is only %d", headerSize, fileSize)
+	}
+	if fileSize > len(file) {
+		return Exe{}, fmt.Errorf("header says the file is %d bytes but it's %d", fileSize, len(file))
+	}
+
+	relocationEnd := int(header.RelocationTable) + int(header.Relocations)*4
+	if header.Relocations > 0 && (int(header.RelocationTable) < exeHeaderSize || relocationEnd > headerSize) {
+		return Exe{}, fmt.Errorf("relocation table %04x-%04x isn't inside the %d byte header", header.RelocationTable, relocationEnd, headerSize)
+	}
+
+	exe := Exe{Header: header, Image: file[headerSize:fileSize]}
+	for i := 0; i < int(header.Relocations); i++ {
+		at := int(header.RelocationTable) + i*4
+		relocation := ExeRelocation{
+			Offset:  binary.LittleEndian.Uint16(file[at:]),
+			Segment: binary.LittleEndian.Uint16(file[at+2:]),
+		}
+		if address := int(relocation.Segment)*16 + int(relocation.Offset); address+2 > len(exe.Image) {
+			return Exe{}, fmt.Errorf("relocation %d at %04x:%04x is outside the %d byte image", i, relocation.Segment, relocation.Offset, len(exe.Image))
+		}
+		exe.Relocations = append(exe.Relocations, relocation)
+	}
+	return exe, nil
+}
+
+// LoadExe loads an MZ executable with its psp at segment:0000 and the load module right after it at segment+10h,
+// relocations are fixed up for that address. ds and es point at the psp, cs:ip and ss:sp come from the header
+func LoadExe(fileName string, segment uint16) (Program, error) {
+	file, err := os.ReadFile(fileName)
+	if err != nil {
+		return Program{}, err
+	}
+	exe, err := ParseExe(file)
+	if err != nil {
+		return Program{}, fmt.Errorf("%s: %v", fileName, err)
+	}
+
+	loadSegment := segment + 0x10
+	imageParagraphs := (len(exe.Image) + 15) / 16
+	available := int(dosMemoryEnd()) - int(loadSegment)
+	if imageParagraphs+int(exe.Header.MinAlloc) > available {
+		return Program{}, fmt.Errorf("%s: needs %d paragraphs, only %d are free", fileName, imageParagraphs+int(exe.Header.MinAlloc), available)
+	}
+	// dos gives the program as much of what it asked for in max alloc as it can
+	allocated := min(available, imageParagraphs+int(exe.Header.MaxAlloc))
+
+	psp := writePsp(segment, loadSegment+uint16(allocated))
+	image := uint32(loadSegment) << 4
+	copy(MemoryValues.Bytes[image:], exe.Image)
+	for _, relocation := range exe.Relocations {
+		address := image + uint32(relocation.Segment)<<4 + uint32(relocation.Offset)
+		MemoryValues.Poke(address, MemoryValues.Peek(address, true)+loadSegment, true)
+	}
+
+	WriteU16(RegisterValues[Register_ds], 0, segment)
+	WriteU16(RegisterValues[Register_es], 0, segment)
+	WriteU16(RegisterValues[Register_cs], 0, loadSegment+exe.Header.CS)
+	WriteU16(RegisterValues[Register_ip], 0, exe.Header.IP)
+	WriteU16(RegisterValues[Register_ss], 0, loadSegment+exe.Header.SS)
+	WriteU16(RegisterValues[Register_sp], 0, exe.Header.SP)
+	StartStack()
+
+	program := Program{
+		Format:  "exe",
+		Start:   int(psp),
+		End:     int(image) + len(exe.Image),
+		Entries: []int{int(psp), int(InstructionAddress())},
+	}
+	program.InstallHandlers()
+	return program, nil
+}
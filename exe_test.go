@@ -0,0 +1,86 @@
+package main
+
+import (
+	"encoding/binary"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// makeExe builds an MZ file with a 2 paragraph header, a relocation at 0000:0001 and a 6 byte image
+func makeExe(change func(header []uint16)) []byte {
+	header := []uint16{0x5a4d, 0x26, 1, 1, 2, 0x10, 0xffff, 0x20, 0x100, 0, 3, 0, 0x1c, 0}
+	if change != nil {
+		change(header)
+	}
+	file := make([]byte, 0x26)
+	for i, value := range header {
+		binary.LittleEndian.PutUint16(file[i*2:], value)
+	}
+	binary.LittleEndian.PutUint16(file[0x1c:], 1) // relocation offset
+	binary.LittleEndian.PutUint16(file[0x1e:], 0) // relocation segment
+	copy(file[0x20:], []byte{0xb8, 0x00, 0x00, 0xf4, 0x90, 0x90})
+	return file
+}
+
+func TestParseExe(t *testing.T) {
+	exe, err := ParseExe(makeExe(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := ExeHeader{
+		Signature: 0x5a4d, LastPageBytes: 0x26, Pages: 1, Relocations: 1, HeaderParagraphs: 2, MinAlloc: 0x10,
+		MaxAlloc: 0xffff, SS: 0x20, SP: 0x100, IP: 3, RelocationTable: 0x1c,
+	}
+	if exe.Header != want {
+		t.Errorf("header is %+v, want %+v", exe.Header, want)
+	}
+	if !slices.Equal(exe.Relocations, []ExeRelocation{{Offset: 1}}) {
+		t.Errorf("relocations are %v", exe.Relocations)
+	}
+	if !slices.Equal(exe.Image, []byte{0xb8, 0x00, 0x00, 0xf4, 0x90, 0x90}) {
+		t.Errorf("image is % x", exe.Image)
+	}
+
+	// bytes after the size in the header are an overlay or debug info, not part of the image
+	exe, err = ParseExe(append(makeExe(nil), 0xcc, 0xcc))
+	if err != nil || len(exe.Image) != 6 {
+		t.Errorf("trailing bytes gave a %d byte image, %v", len(exe.Image), err)
+	}
+	// ZM works too and a last page of 0 means the whole page is used
+	if _, err := ParseExe(makeExe(func(h []uint16) { h[0] = 0x4d5a })); err != nil {
+		t.Errorf("ZM signature failed: %v", err)
+	}
+	if _, err := ParseExe(append(makeExe(func(h []uint16) { h[1] = 0 }), make([]byte, 512-0x26)...)); err != nil {
+		t.Errorf("full last page failed: %v", err)
+	}
+}
+
+func TestParseExeErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		file   []byte
+		reason string
+	}{
+		{"short", make([]byte, 0x1b), "too short"},
+		{"signature", makeExe(func(h []uint16) { h[0] = 0x1234 }), "signature"},
+		{"last page", makeExe(func(h []uint16) { h[1] = 513 }), "only 512"},
+		{"no pages", makeExe(func(h []uint16) { h[2] = 0 }), "no pages"},
+		{"small header", makeExe(func(h []uint16) { h[4] = 1 }), "smaller than"},
+		{"big header", makeExe(func(h []uint16) { h[4] = 3 }), "the file is only"},
+		{"truncated", makeExe(func(h []uint16) { h[1] = 0x30 }), "but it's"},
+		{"relocation table", makeExe(func(h []uint16) { h[12] = 0x1e }), "isn't inside"},
+	}
+	for _, test := range tests {
+		if _, err := ParseExe(test.file); err == nil || !strings.Contains(err.Error(), test.reason) {
+			t.Errorf("%s: got %v, want an error about %q", test.name, err, test.reason)
+		}
+	}
+
+	// a relocation pointing past the end of the image
+	file := makeExe(nil)
+	binary.LittleEndian.PutUint16(file[0x1c:], 5)
+	if _, err := ParseExe(file); err == nil || !strings.Contains(err.Error(), "outside") {
+		t.Errorf("relocation outside the image gave %v", err)
+	}
+}
@@ -0,0 +1,281 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// Expression is a compiled condition over registers, flags and memory, it's evaluated against the current machine state
+type Expression struct {
+	Source string
+	eval   func() int
+}
+
+// Evaluate returns the value of the expression, conditions are true when non zero
+func (e Expression) Evaluate() int {
+	return e.eval()
+}
+
+// True reports whether the expression holds right now
+func (e Expression) True() bool {
+	return e.eval() != 0
+}
+
+func (e Expression) String() string {
+	return e.Source
+}
+
+// flagNames are the names conditions can use to read cpu flags, the interrupt flag isn't "if" so it can't be
+// mistaken for the if that starts a breakpoint's condition
+var flagNames = map[string]CpuFlag{
+	"zf":    ZeroFlag,
+	"sf":    SignFlag,
+	"cf":    CarryFlag,
+	"iflag": InterruptFlag,
+}
+
+// binary operators from loosest to tightest binding, the same levels as C
+var precedence = [][]string{
+	{"||"},
+	{"&&"},
+	{"|"},
+	{"&"},
+	{"==", "!="},
+	{"<=", ">=", "<", ">"},
+	{"+", "-"},
+	{"*"},
+}
+
+type expressionParser struct {
+	tokens []string
+	at     int
+	usesBp bool // bp was read since the last [, addresses based on it are in the stack segment
+}
+
+func tokenize(s string) ([]string, error) {
+	var tokens []string
+	for i := 0; i < len(s); {
+		c := rune(s[i])
+		switch {
+		case unicode.IsSpace(c):
+			i++
+		case unicode.IsLetter(c) || unicode.IsDigit(c):
+			start := i
+			for i < len(s) && (unicode.IsLetter(rune(s[i])) || unicode.IsDigit(rune(s[i]))) {
+				i++
+			}
+			tokens = append(tokens, s[start:i])
+		case i+1 < len(s) && slices.Contains([]string{"==", "!=", "<=", ">=", "&&", "||"}, s[i:i+2]):
+			tokens = append(tokens, s[i:i+2])
+			i += 2
+		case strings.ContainsRune("+-*&|<>![]():", c):
+			tokens = append(tokens, string(c))
+			i++
+		default:
+			return nil, fmt.Errorf("unexpected character %q in %q", c, s)
+		}
+	}
+	return tokens, nil
+}
+
+// ParseExpression compiles something like `ax == 0 && [bx+2] > 5`, memory reads are words unless prefixed with byte.
+// Addresses are in the segment the cpu would use, ss for ones based on bp and ds otherwise, or an override like es:[di]
+func ParseExpression(s string) (Expression, error) {
+	tokens, err := tokenize(s)
+	if err != nil {
+		return Expression{}, err
+	}
+	p := &expressionParser{tokens: tokens}
+	eval, err := p.parseBinary(0)
+	if err != nil {
+		return Expression{}, err
+	}
+	if p.at != len(p.tokens) {
+		return Expression{}, fmt.Errorf("unexpected %q in %q", p.tokens[p.at], s)
+	}
+	return Expression{Source: s, eval: eval}, nil
+}
+
+func (p *expressionParser) peek() string {
+	if p.at < len(p.tokens) {
+		return p.tokens[p.at]
+	}
+	return ""
+}
+
+func (p *expressionParser) next() string {
+	token := p.peek()
+	p.at++
+	return token
+}
+
+func (p *expressionParser) expect(token string) error {
+	if got := p.next(); got != token {
+		return fmt.Errorf("expected %q got %q", token, got)
+	}
+	return nil
+}
+
+func (p *expressionParser) parseBinary(level int) (func() int, error) {
+	if level == len(precedence) {
+		return p.parseUnary()
+	}
+
+	left, err := p.parseBinary(level + 1)
+	if err != nil {
+		return nil, err
+	}
+	for {
+		op := p.peek()
+		matched := false
+		for _, candidate := range precedence[level] {
+			if op == candidate {
+				matched = true
+			}
+		}
+		if !matched {
+			return left, nil
+		}
+		p.next()
+
+		right, err := p.parseBinary(level + 1)
+		if err != nil {
+			return nil, err
+		}
+		left = binaryOperation(op, left, right)
+	}
+}
+
+func boolToInt(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+func binaryOperation(op string, left, right func() int) func() int {
+	switch op {
+	case "||":
+		return func() int { return boolToInt(left() != 0 || right() != 0) }
+	case "&&":
+		return func() int { return boolToInt(left() != 0 && right() != 0) }
+	case "==":
+		return func() int { return boolToInt(left() == right()) }
+	case "!=":
+		return func() int { return boolToInt(left() != right()) }
+	case "<":
+		return func() int { return boolToInt(left() < right()) }
+	case "<=":
+		return func() int { return boolToInt(left() <= right()) }
+	case ">":
+		return func() int { return boolToInt(left() > right()) }
+	case ">=":
+		return func() int { return boolToInt(left() >= right()) }
+	case "+":
+		return func() int { return left() + right() }
+	case "-":
+		return func() int { return left() - right() }
+	case "*":
+		return func() int { return left() * right() }
+	case "&":
+		return func() int { return left() & right() }
+	default: // "|"
+		return func() int { return left() | right() }
+	}
+}
+
+func (p *expressionParser) parseUnary() (func() int, error) {
+	switch p.peek() {
+	case "!":
+		p.next()
+		operand, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return func() int { return boolToInt(operand() == 0) }, nil
+	case "-":
+		p.next()
+		operand, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return func() int { return -operand() }, nil
+	}
+	return p.parsePrimary()
+}
+
+func (p *expressionParser) parseMemory(wide bool) (func() int, error) {
+	var address EffectiveAddress
+	if p.isSegmentOverride() {
+		register, _ := RegisterByName(p.next())
+		p.next()
+		address.Segment = register.RegisterIndex
+	}
+	if err := p.expect("["); err != nil {
+		return nil, err
+	}
+	outerUsesBp := p.usesBp
+	p.usesBp = false
+	offset, err := p.parseBinary(0)
+	if err != nil {
+		return nil, err
+	}
+	if err := p.expect("]"); err != nil {
+		return nil, err
+	}
+	if p.usesBp {
+		address.EffectiveAddressExpression = EffectiveAddress_bp
+	}
+	p.usesBp = outerUsesBp
+
+	segment := address.SegmentRegister()
+	return func() int {
+		return int(MemoryValues.PeekOffset(SegmentBase(segment), uint16(offset()), wide))
+	}, nil
+}
+
+// isSegmentOverride is true when the next tokens are a segment register and a colon, like the es: in es:[di]
+func (p *expressionParser) isSegmentOverride() bool {
+	if p.at+1 >= len(p.tokens) || p.tokens[p.at+1] != ":" {
+		return false
+	}
+	register, ok := RegisterByName(p.peek())
+	return ok && register.RegisterIndex >= Register_es && register.RegisterIndex <= Register_ds
+}
+
+func (p *expressionParser) parsePrimary() (func() int, error) {
+	token := p.peek()
+	switch {
+	case token == "":
+		return nil, fmt.Errorf("unexpected end of expression")
+	case token == "(":
+		p.next()
+		inner, err := p.parseBinary(0)
+		if err != nil {
+			return nil, err
+		}
+		return inner, p.expect(")")
+	case token == "[" || p.isSegmentOverride():
+		return p.parseMemory(true)
+	case token == "byte" || token == "word":
+		p.next()
+		return p.parseMemory(token == "word")
+	}
+
+	p.next()
+	if register, ok := RegisterByName(token); ok {
+		p.usesBp = p.usesBp || register.RegisterIndex == Register_bp
+		return func() int { return int(ReadRegister(register)) }, nil
+	}
+	if flag, ok := flagNames[strings.ToLower(token)]; ok {
+		return func() int { return boolToInt(CpuFlagValues[flag]) }, nil
+	}
+	value, err := strconv.ParseInt(token, 0, 32)
+	if err != nil {
+		return nil, fmt.Errorf("%q is not a number, register or flag", token)
+	}
+	return func() int { return int(value) }, nil
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestParseExpression(t *testing.T) {
+	ResetMachine()
+	WriteU16(RegisterValues[Register_a], 0, 5)
+	WriteU16(RegisterValues[Register_b], 0, 0x10)
+	WriteU16(RegisterValues[Register_ds], 0, 0x100)
+	MemoryValues.Poke(0x1000+0x10, 0x34, false)
+	MemoryValues.Poke(0x1000+0x12, 0xbeef, true)
+	WriteU16(RegisterValues[Register_bp], 0, 0x10)
+	WriteU16(RegisterValues[Register_ss], 0, 0x200)
+	MemoryValues.Poke(0x2000+0x10, 0x5555, true)
+	WriteU16(RegisterValues[Register_es], 0, 0x300)
+	MemoryValues.Poke(0x3000+0x10, 0x1234, true)
+	CpuFlagValues[ZeroFlag] = true
+	CpuFlagValues[InterruptFlag] = true
+
+	tests := []struct {
+		source string
+		want   int
+	}{
+		{"ax == 5", 1},
+		{"ax != 5", 0},
+		{"1 + 2 * 3", 7},
+		{"(1 + 2) * 3", 9},
+		{"10 - 2 - 3", 5},
+		{"-ax + 6", 1},
+		{"!ax", 0},
+		// | and & bind looser than comparisons like they do in C
+		{"1 | 2 == 2", 1},
+		{"6 & 3 == 3", 0},
+		{"1 | 2 & 0", 1},
+		{"ax > 3 && bx < 2 || ax", 1},
+		{"ax >= 5 && ax <= 5", 1},
+		{"al", 5},
+		{"ah", 0},
+		{"0x1f", 0x1f},
+		{"[bx+2]", 0xbeef},
+		{"word [bx+2] == 0xbeef", 1},
+		{"byte [bx]", 0x34},
+		{"byte [bx+2]", 0xef},
+		// bp based addresses are in the stack segment like they are for instructions
+		{"[bp]", 0x5555},
+		{"[bp+si]", 0x5555},
+		{"[bx] + [bp]", 0x34 + 0x5555},
+		{"es:[bx]", 0x1234},
+		{"byte es:[bx]", 0x34},
+		{"word es : [bx] == 0x1234", 1},
+		{"ds:[bp]", 0x34},
+		{"ss:[bx]", 0x5555},
+		{"es", 0x300},
+		{"zf", 1},
+		{"sf", 0},
+		{"iflag && !cf", 1},
+	}
+	for _, test := range tests {
+		expression, err := ParseExpression(test.source)
+		if err != nil {
+			t.Errorf("ParseExpression(%q) failed: %v", test.source, err)
+			continue
+		}
+		if got := expression.Evaluate(); got != test.want {
+			t.Errorf("%q = %d, want %d", test.source, got, test.want)
+		}
+	}
+}
+
+func TestParseExpressionErrors(t *testing.T) {
+	for _, source := range []string{
+		"",
+		"ax ==",
+		"[bx",
+		"es:",
+		"es:bx",
+		"ax:[bx]",
+		"(1 + 2",
+		"1 2",
+		"1 $ 2",
+		"nosuchthing",
+		// the interrupt flag is iflag, if only separates a breakpoint's location from its condition
+		"if",
+	} {
+		if _, err := ParseExpression(source); err == nil {
+			t.Errorf("ParseExpression(%q) should have failed", source)
+		}
+	}
+}
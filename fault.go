@@ -0,0 +1,52 @@
+package main
+
+import (
+	"fmt"
+)
+
+type FaultKind int
+
+const (
+	FaultUnmapped FaultKind = iota
+	FaultStackOverflow
+	FaultStackUnderflow
+)
+
+func (k FaultKind) String() string {
+	return []string{"unmapped memory", "stack overflow", "stack underflow"}[k]
+}
+
+// Fault is something the program did that the machine can't carry on from, like touching memory that isn't there.
+// It stops the run with cs:ip still on the instruction that caused it
+type Fault struct {
+	Kind        FaultKind
+	Instruction Instruction
+	Address     uint32 // memory the fault is about, if there is any
+	Reason      string
+}
+
+func (f *Fault) Error() string {
+	return fmt.Sprintf("fault at %s %s: %s", AddressString(f.Instruction.Address), f.Instruction, f.Reason)
+}
+
+// CpuFault is the fault that stopped the run, nil if nothing has gone wrong
+var CpuFault *Fault
+
+// RaiseFault stops the instruction being simulated, Simulate catches it and halts the machine
+func RaiseFault(kind FaultKind, address uint32, format string, args ...any) {
+	panic(&Fault{Kind: kind, Instruction: CurrentInstruction, Address: address, Reason: fmt.Sprintf(format, args...)})
+}
+
+// catchFault turns a fault raised while simulating into CpuFault and a halted machine, anything else is a real panic
+func catchFault() {
+	r := recover()
+	if r == nil {
+		return
+	}
+	fault, ok := r.(*Fault)
+	if !ok {
+		panic(r)
+	}
+	CpuFault = fault
+	Halted = true
+}
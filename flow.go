@@ -0,0 +1,203 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// BasicBlock is a straight run of instructions, control only enters at Start and only leaves from the last instruction
+type BasicBlock struct {
+	Start        uint32
+	End          uint32 // address after the last instruction
+	Instructions []Instruction
+	Successors   []uint32 // addresses of the blocks control can move to next
+}
+
+// Disassembly is the result of following control flow through a region of memory,
+// any byte in [Start, End) not covered by an instruction is treated as data
+type Disassembly struct {
+	Start, End   int
+	Memory       []byte
+	Instructions map[int]Instruction
+	Blocks       []BasicBlock // ordered by start address
+}
+
+// Successors returns the addresses execution can continue at after inst
+func Successors(inst Instruction) []uint32 {
+	next := inst.Address + inst.Size
+	switch {
+	case inst.IsReturn(), inst.IsTerminate():
+		return nil
+	case inst.IsCall(), inst.IsConditional():
+		// calls come back to the next instruction once the callee returns
+		return []uint32{inst.Target(), next}
+	case inst.Flags[IsJump]:
+		return []uint32{inst.Target()}
+	default:
+		return []uint32{next}
+	}
+}
+
+// DecodeFlow disassembles memory[start:end] by following jumps and calls from the entry points instead of
+// sweeping every byte, so data mixed in with the code doesn't get decoded as instructions
+func DecodeFlow(memory []byte, start, end int, entries ...int) Disassembly {
+	memVal := &Memory{Bytes: memory}
+	result := Disassembly{
+		Start:        start,
+		End:          end,
+		Memory:       memory,
+		Instructions: map[int]Instruction{},
+	}
+
+	leaders := map[uint32]bool{}
+	toVisit := slices.Clone(entries)
+	for _, entry := range entries {
+		leaders[uint32(entry)] = true
+	}
+
+	for len(toVisit) > 0 {
+		at := toVisit[len(toVisit)-1]
+		toVisit = toVisit[:len(toVisit)-1]
+
+		// walk forward until we hit something already decoded or control can't fall through
+		for at >= start && at < end {
+			if _, seen := result.Instructions[at]; seen {
+				break
+			}
+
+			inst, err := DecodeAt(memVal, at)
+			if err != nil || int(inst.Address+inst.Size) > end {
+				break
+			}
+			result.Instructions[at] = inst
+
+			successors := Successors(inst)
+			if inst.Flags[IsJump] || inst.IsCall() || inst.IsReturn() {
+				// anything after a control transfer starts a new block
+				for _, successor := range successors {
+					leaders[successor] = true
+				}
+				leaders[inst.Address+inst.Size] = true
+			}
+
+			fallsThrough := false
+			for _, successor := range successors {
+				if successor == inst.Address+inst.Size {
+					fallsThrough = true
+					continue
+				}
+				toVisit = append(toVisit, int(successor))
+			}
+			if !fallsThrough {
+				break
+			}
+			at += int(inst.Size)
+		}
+	}
+
+	result.Blocks = buildBlocks(result.Instructions, leaders)
+	return result
+}
+
+func buildBlocks(instructions map[int]Instruction, leaders map[uint32]bool) []BasicBlock {
+	addresses := make([]int, 0, len(instructions))
+	for address := range instructions {
+		addresses = append(addresses, address)
+	}
+	slices.Sort(addresses)
+
+	var blocks []BasicBlock
+	var current *BasicBlock
+	for _, address := range addresses {
+		inst := instructions[address]
+
+		// a block also ends where the previous instruction doesn't run straight into this one (data gap)
+		if current == nil || leaders[inst.Address] || current.End != inst.Address {
+			if current != nil {
+				blocks = append(blocks, *current)
+			}
+			current = &BasicBlock{Start: inst.Address, End: inst.Address}
+		}
+		current.Instructions = append(current.Instructions, inst)
+		current.End = inst.Address + inst.Size
+	}
+	if current != nil {
+		blocks = append(blocks, *current)
+	}
+
+	for i := range blocks {
+		last := blocks[i].Instructions[len(blocks[i].Instructions)-1]
+		for _, successor := range Successors(last) {
+			if _, ok := instructions[int(successor)]; ok {
+				blocks[i].Successors = append(blocks[i].Successors, successor)
+			}
+		}
+	}
+	return blocks
+}
+
+// IsCode reports whether address is the start of or inside a decoded instruction
+func (d Disassembly) IsCode(address int) bool {
+	return d.BlockAt(uint32(address)) != nil
+}
+
+// BlockAt returns the block holding address, or nil if it's data
+func (d Disassembly) BlockAt(address uint32) *BasicBlock {
+	i, found := slices.BinarySearchFunc(d.Blocks, address, func(b BasicBlock, a uint32) int {
+		if b.Start > a {
+			return 1
+		}
+		if b.End <= a {
+			return -1
+		}
+		return 0
+	})
+	if !found {
+		return nil
+	}
+	return &d.Blocks[i]
+}
+
+// String renders a listing with block headers, the bytes that weren't reached are emitted as db
+func (d Disassembly) String() string {
+	var res strings.Builder
+	at := d.Start
+	for _, block := range d.Blocks {
+		if int(block.Start) > at {
+			res.WriteString(d.dataListing(at, int(block.Start)))
+		}
+
+		successors := make([]string, 0, len(block.Successors))
+		for _, successor := range block.Successors {
+			successors = append(successors, fmt.Sprintf("%04x", successor))
+		}
+		fmt.Fprintf(&res, "\n; block %04x-%04x -> [%s]\n", block.Start, block.End, strings.Join(successors, " "))
+		for _, inst := range block.Instructions {
+			if symbol, ok := Symbols.Lookup(inst.Address); ok && symbol.Address == inst.Address {
+				fmt.Fprintf(&res, "%s:\n", symbol.Name)
+			}
+			fmt.Fprintf(&res, "%04x  %s\n", inst.Address, inst)
+		}
+		at = int(block.End)
+	}
+	if at < d.End {
+		res.WriteString(d.dataListing(at, d.End))
+	}
+	return res.String()
+}
+
+func (d Disassembly) dataListing(from, to int) string {
+	var res strings.Builder
+	res.WriteString("\n; data\n")
+	for from < to {
+		lineEnd := min(from+8, to)
+		values := make([]string, 0, 8)
+		for _, b := range d.Memory[from:lineEnd] {
+			values = append(values, fmt.Sprintf("0x%02x", b))
+		}
+		fmt.Fprintf(&res, "%04x  db %s\n", from, strings.Join(values, ", "))
+		from = lineEnd
+	}
+	return res.String()
+}
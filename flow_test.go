@@ -0,0 +1,58 @@
+package main
+
+import (
+	"slices"
+	"strings"
+	"testing"
+)
+
+// flowProgram has data after an unconditional jmp that decodes as an instruction if it's swept
+var flowProgram = []byte{
+	0xb8, 0x01, 0x00, // 0000 mov ax, 1
+	0x74, 0x04, //       0003 je 0009
+	0xeb, 0x05, //       0005 jmp 000c
+	0xb0, 0x55, //       0007 data, mov al, 55h if it were code
+	0xbb, 0x02, 0x00, // 0009 mov bx, 2
+	0xf4, //             000c hlt
+}
+
+func TestDecodeFlowSkipsData(t *testing.T) {
+	disassembly := DecodeFlow(flowProgram, 0, len(flowProgram), 0)
+
+	var addresses []int
+	for address := range disassembly.Instructions {
+		addresses = append(addresses, address)
+	}
+	slices.Sort(addresses)
+	if !slices.Equal(addresses, []int{0, 3, 5, 9, 0xc}) {
+		t.Errorf("decoded instructions at %x, want 0 3 5 9 c", addresses)
+	}
+	for _, address := range []int{7, 8} {
+		if disassembly.IsCode(address) {
+			t.Errorf("the data at %x after the jmp was treated as code", address)
+		}
+	}
+	if listing := disassembly.String(); !strings.Contains(listing, "0007  db 0xb0, 0x55\n") {
+		t.Errorf("the listing doesn't show the data as db:\n%s", listing)
+	}
+
+	tests := []struct {
+		start, end uint32
+		successors []uint32
+	}{
+		{0, 5, []uint32{9, 5}},
+		{5, 7, []uint32{0xc}},
+		{9, 0xc, []uint32{0xc}},
+		{0xc, 0xd, nil},
+	}
+	if len(disassembly.Blocks) != len(tests) {
+		t.Fatalf("got %d blocks, want %d", len(disassembly.Blocks), len(tests))
+	}
+	for i, test := range tests {
+		block := disassembly.Blocks[i]
+		if block.Start != test.start || block.End != test.end || !slices.Equal(block.Successors, test.successors) {
+			t.Errorf("block %d is %x-%x -> %x, want %x-%x -> %x", i, block.Start, block.End, block.Successors,
+				test.start, test.end, test.successors)
+		}
+	}
+}
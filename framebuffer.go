@@ -0,0 +1,236 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Framebuffer describes a region of memory to turn into an image
+type Framebuffer struct {
+	Offset uint32
+	Width  int
+	Height int
+	Format string // rgba, rgb, gray, cga (320x200 4 colour) or mode13h (320x200 256 colour)
+}
+
+// framebufferDefaults are where the pc video modes keep their pixels
+var framebufferDefaults = map[string]Framebuffer{
+	"rgba":    {Width: 64, Height: 64},
+	"rgb":     {Width: 64, Height: 64},
+	"gray":    {Width: 64, Height: 64},
+	"cga":     {Offset: 0xb8000, Width: 320, Height: 200},
+	"mode13h": {Offset: 0xa0000, Width: 320, Height: 200},
+}
+
+// ParseFramebuffer reads `offset=256,width=64,height=64,format=rgba`, anything left out comes from the format's
+// defaults. The offset can be a physical address or segment:offset
+func ParseFramebuffer(spec string) (Framebuffer, error) {
+	fields := map[string]string{}
+	for _, field := range strings.Split(spec, ",") {
+		key, value, found := strings.Cut(strings.TrimSpace(field), "=")
+		if !found {
+			return Framebuffer{}, fmt.Errorf("%q should be key=value", field)
+		}
+		fields[key] = value
+	}
+
+	format := fields["format"]
+	if format == "" {
+		format = "rgba"
+	}
+	fb, ok := framebufferDefaults[format]
+	if !ok {
+		return Framebuffer{}, fmt.Errorf("unknown format %q, expected rgba, rgb, gray, cga or mode13h", format)
+	}
+	fb.Format = format
+
+	for key, value := range fields {
+		var err error
+		switch key {
+		case "format":
+		case "offset":
+			if strings.Contains(value, ":") {
+				fb.Offset, err = ParseAddress(value)
+			} else {
+				var offset uint64
+				offset, err = strconv.ParseUint(value, 0, 32)
+				fb.Offset = uint32(offset)
+			}
+		case "width":
+			fb.Width, err = strconv.Atoi(value)
+		case "height":
+			fb.Height, err = strconv.Atoi(value)
+		default:
+			err = fmt.Errorf("unknown field")
+		}
+		if err != nil {
+			return Framebuffer{}, fmt.Errorf("%s=%s: %v", key, value, err)
+		}
+	}
+	if fb.Width <= 0 || fb.Height <= 0 {
+		return Framebuffer{}, fmt.Errorf("%dx%d isn't a usable image size", fb.Width, fb.Height)
+	}
+	return fb, nil
+}
+
+// cgaPalette is palette 1 at high intensity, the one mode 4 starts with
+var cgaPalette = color.Palette{
+	color.RGBA{0x00, 0x00, 0x00, 0xff},
+	color.RGBA{0x55, 0xff, 0xff, 0xff},
+	color.RGBA{0xff, 0x55, 0xff, 0xff},
+	color.RGBA{0xff, 0xff, 0xff, 0xff},
+}
+
+// vgaPalette is the default 256 colour palette mode 13h starts with
+var vgaPalette = func() color.Palette {
+	vga6 := func(r, g, b int) color.Color {
+		return color.RGBA{uint8(r * 255 / 63), uint8(g * 255 / 63), uint8(b * 255 / 63), 0xff}
+	}
+
+	var palette color.Palette
+	// the 16 cga colours
+	for i := 0; i < 16; i++ {
+		intensity := (i >> 3) * 21
+		r, g, b := (i>>2&1)*42+intensity, (i>>1&1)*42+intensity, (i&1)*42+intensity
+		if i == 6 {
+			g = 21 // brown not dark yellow
+		}
+		palette = append(palette, vga6(r, g, b))
+	}
+	for _, gray := range []int{0, 5, 8, 11, 14, 17, 20, 24, 28, 32, 36, 40, 45, 50, 56, 63} {
+		palette = append(palette, vga6(gray, gray, gray))
+	}
+	// 9 runs of 24 hues, high/medium/low brightness each at high/medium/low saturation
+	for _, v := range [][5]int{
+		{0, 16, 31, 47, 63}, {31, 39, 47, 55, 63}, {45, 49, 54, 58, 63},
+		{0, 7, 14, 21, 28}, {14, 17, 21, 24, 28}, {20, 22, 24, 26, 28},
+		{0, 4, 8, 12, 16}, {8, 10, 12, 14, 16}, {11, 12, 13, 15, 16},
+	} {
+		for i := 0; i < 4; i++ {
+			palette = append(palette, vga6(v[i], v[0], v[4])) // blue to magenta
+		}
+		for i := 0; i < 4; i++ {
+			palette = append(palette, vga6(v[4], v[0], v[4-i])) // to red
+		}
+		for i := 0; i < 4; i++ {
+			palette = append(palette, vga6(v[4], v[i], v[0])) // to yellow
+		}
+		for i := 0; i < 4; i++ {
+			palette = append(palette, vga6(v[4-i], v[4], v[0])) // to green
+		}
+		for i := 0; i < 4; i++ {
+			palette = append(palette, vga6(v[0], v[4], v[i])) // to cyan
+		}
+		for i := 0; i < 4; i++ {
+			palette = append(palette, vga6(v[0], v[4-i], v[4])) // back to blue
+		}
+	}
+	for len(palette) < 256 {
+		palette = append(palette, vga6(0, 0, 0))
+	}
+	return palette
+}()
+
+// Image reads the framebuffer out of memory, anything past the end of memory is black
+func (f Framebuffer) Image(memory []byte) image.Image {
+	at := func(i int) uint8 {
+		if address := int(f.Offset) + i; address < len(memory) {
+			return memory[address]
+		}
+		return 0
+	}
+	bounds := image.Rect(0, 0, f.Width, f.Height)
+
+	switch f.Format {
+	case "cga":
+		// 2 bits a pixel, even lines in the first 8k and odd lines in the second
+		img := image.NewPaletted(bounds, cgaPalette)
+		bytesPerLine := (f.Width + 3) / 4
+		for y := 0; y < f.Height; y++ {
+			line := (y&1)*0x2000 + (y>>1)*bytesPerLine
+			for x := 0; x < f.Width; x++ {
+				img.SetColorIndex(x, y, at(line+x/4)>>(6-2*(x%4))&3)
+			}
+		}
+		return img
+	case "mode13h":
+		img := image.NewPaletted(bounds, vgaPalette)
+		for i := range img.Pix {
+			img.Pix[i] = at(i)
+		}
+		return img
+	case "gray":
+		img := image.NewGray(bounds)
+		for i := range img.Pix {
+			img.Pix[i] = at(i)
+		}
+		return img
+	case "rgb":
+		img := image.NewRGBA(bounds)
+		for i := 0; i < f.Width*f.Height; i++ {
+			copy(img.Pix[i*4:], []uint8{at(i * 3), at(i*3 + 1), at(i*3 + 2), 0xff})
+		}
+		return img
+	default:
+		img := image.NewNRGBA(bounds)
+		for i := range img.Pix {
+			img.Pix[i] = at(i)
+		}
+		return img
+	}
+}
+
+// WritePng saves the framebuffer as it is in memory now
+func (f Framebuffer) WritePng(fileName string, memory []byte) error {
+	file, err := os.Create(fileName)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	if err := png.Encode(file, f.Image(memory)); err != nil {
+		return err
+	}
+	return file.Close()
+}
+
+// PngCapture saves the framebuffer every time an instruction matching one of its breakpoints is about to run,
+// each capture gets a number e.g. out-1.png, out-2.png
+type PngCapture struct {
+	Framebuffer Framebuffer
+	FileName    string
+	At          *Breakpoints
+	Captures    int
+	Err         error // first error writing a capture
+}
+
+// NewPngCapture starts capturing before instructions matching the breakpoint specs
+func NewPngCapture(framebuffer Framebuffer, fileName string, specs []string) (*PngCapture, error) {
+	c := &PngCapture{Framebuffer: framebuffer, FileName: fileName, At: &Breakpoints{}}
+	for _, spec := range specs {
+		if _, err := c.At.Add(spec); err != nil {
+			return nil, fmt.Errorf("invalid capture point %q: %v", spec, err)
+		}
+	}
+	ExecutionObservers = append(ExecutionObservers, c)
+	return c, nil
+}
+
+func (c *PngCapture) Before(instruction Instruction) {
+	if c.At.Check(instruction) == nil {
+		return
+	}
+	c.Captures++
+	extension := filepath.Ext(c.FileName)
+	fileName := fmt.Sprintf("%s-%d%s", strings.TrimSuffix(c.FileName, extension), c.Captures, extension)
+	if err := c.Framebuffer.WritePng(fileName, MemoryValues.Bytes); err != nil && c.Err == nil {
+		c.Err = err
+	}
+}
+
+func (c *PngCapture) After(instruction Instruction) {}
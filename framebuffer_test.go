@@ -0,0 +1,50 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseFramebuffer(t *testing.T) {
+	ResetMachine()
+	tests := []struct {
+		spec string
+		want Framebuffer
+	}{
+		{"format=rgba", Framebuffer{Width: 64, Height: 64, Format: "rgba"}},
+		{"offset=256,width=64,height=64,format=rgba", Framebuffer{Offset: 256, Width: 64, Height: 64, Format: "rgba"}},
+		{"offset=0x100, width=32", Framebuffer{Offset: 0x100, Width: 32, Height: 64, Format: "rgba"}},
+		{"format=gray,height=8", Framebuffer{Width: 64, Height: 8, Format: "gray"}},
+		{"format=cga", Framebuffer{Offset: 0xb8000, Width: 320, Height: 200, Format: "cga"}},
+		{"format=mode13h", Framebuffer{Offset: 0xa0000, Width: 320, Height: 200, Format: "mode13h"}},
+		{"format=mode13h,offset=0x9000:0", Framebuffer{Offset: 0x90000, Width: 320, Height: 200, Format: "mode13h"}},
+	}
+	for _, test := range tests {
+		fb, err := ParseFramebuffer(test.spec)
+		if err != nil {
+			t.Errorf("ParseFramebuffer(%q) failed: %v", test.spec, err)
+			continue
+		}
+		if fb != test.want {
+			t.Errorf("ParseFramebuffer(%q) = %+v, want %+v", test.spec, fb, test.want)
+		}
+	}
+
+	errors := []struct {
+		spec   string
+		reason string
+	}{
+		{"format=ega", "unknown format"},
+		{"offset", "key=value"},
+		{"depth=8", "unknown field"},
+		{"width=wide", "width=wide"},
+		{"offset=zz:0", "offset=zz:0"},
+		{"width=0", "usable image size"},
+		{"height=-1", "usable image size"},
+	}
+	for _, test := range errors {
+		if _, err := ParseFramebuffer(test.spec); err == nil || !strings.Contains(err.Error(), test.reason) {
+			t.Errorf("ParseFramebuffer(%q) = %v, want an error about %q", test.spec, err, test.reason)
+		}
+	}
+}
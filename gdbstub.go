@@ -0,0 +1,489 @@
+package main
+
+import (
+	"bufio"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// gdbRegisters is the order gdb's i386 target (which i8086 mode uses) expects registers in g/G packets,
+// everything is sent as 32 bits. Register_none entries are ones we don't simulate and always read as 0
+var gdbRegisters = []Register{
+	Register_a, Register_c, Register_d, Register_b,
+	Register_sp, Register_bp, Register_si, Register_di,
+	Register_ip,
+	// eflags, handled separately
+	Register_none,
+	Register_cs, Register_ss, Register_ds, Register_es,
+	// fs gs
+	Register_none, Register_none,
+}
+
+const gdbFlagsRegister = 9
+
+const (
+	gdbSigTrap = 5
+	gdbSigInt  = 2
+	gdbSigSegv = 11
+)
+
+// GdbServer speaks the gdb remote serial protocol to one client over a tcp connection
+type GdbServer struct {
+	Disassembly Disassembly
+	Program     Program
+
+	conn        net.Conn
+	packets     chan string // complete packets from the client, a ctrl-c interrupt arrives as "\x03"
+	deferred    []string    // packets that arrived while the program was running, handled once it stops
+	breakpoints *Breakpoints
+	watchpoints *Watchpoints
+	history     *History
+}
+
+// ServeGdb waits for gdb to connect on address (":1234" listens on localhost only) and runs the program under its control
+func ServeGdb(address string, disassembly Disassembly, program Program) error {
+	if strings.HasPrefix(address, ":") {
+		address = "localhost" + address
+	}
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return err
+	}
+	defer listener.Close()
+
+	fmt.Printf("waiting for gdb on %s (target remote %s, set architecture i8086)\n", listener.Addr(), listener.Addr())
+	conn, err := listener.Accept()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	server := &GdbServer{
+		Disassembly: disassembly,
+		Program:     program,
+		conn:        conn,
+		packets:     make(chan string),
+		breakpoints: &Breakpoints{},
+		watchpoints: NewWatchpoints(&MemoryValues),
+		history:     NewHistory(&MemoryValues, 100_000),
+	}
+	go server.readPackets()
+	server.serve()
+	return nil
+}
+
+// readPackets splits the incoming stream into packets, acknowledging each one
+func (g *GdbServer) readPackets() {
+	defer close(g.packets)
+	reader := bufio.NewReader(g.conn)
+	for {
+		c, err := reader.ReadByte()
+		if err != nil {
+			return
+		}
+		switch c {
+		case 0x03:
+			g.packets <- "\x03"
+		case '$':
+			data, err := reader.ReadString('#')
+			if err != nil {
+				return
+			}
+			checksum := make([]byte, 2)
+			if _, err := io.ReadFull(reader, checksum); err != nil {
+				return
+			}
+			data = strings.TrimSuffix(data, "#")
+			if expected, _ := strconv.ParseUint(string(checksum), 16, 8); uint8(expected) != gdbChecksum(data) {
+				g.conn.Write([]byte("-"))
+				continue
+			}
+			g.conn.Write([]byte("+"))
+			g.packets <- data
+		}
+		// '+' and '-' acks from gdb are ignored, we never resend
+	}
+}
+
+func gdbChecksum(data string) uint8 {
+	var sum uint8
+	for i := 0; i < len(data); i++ {
+		sum += data[i]
+	}
+	return sum
+}
+
+func (g *GdbServer) send(data string) {
+	fmt.Fprintf(g.conn, "$%s#%02x", data, gdbChecksum(data))
+}
+
+// nextPacket is the next packet to handle, ones put off while running come first. ok is false once gdb has gone
+func (g *GdbServer) nextPacket() (string, bool) {
+	if len(g.deferred) > 0 {
+		packet := g.deferred[0]
+		g.deferred = g.deferred[1:]
+		return packet, true
+	}
+	packet, ok := <-g.packets
+	return packet, ok
+}
+
+func (g *GdbServer) serve() {
+	for {
+		packet, ok := g.nextPacket()
+		if !ok {
+			return
+		}
+		if packet == "\x03" {
+			g.send(fmt.Sprintf("S%02x", gdbSigInt))
+			continue
+		}
+
+		reply, keepGoing := g.handle(packet)
+		if reply != nil {
+			g.send(*reply)
+		}
+		if !keepGoing {
+			return
+		}
+	}
+}
+
+func reply(s string) *string {
+	return &s
+}
+
+// handle returns the reply to a packet, nil to not reply, and false once the session is over
+func (g *GdbServer) handle(packet string) (*string, bool) {
+	if packet == "" {
+		return reply(""), true
+	}
+
+	args := packet[1:]
+	switch packet[0] {
+	case '?':
+		return reply(fmt.Sprintf("S%02x", gdbSigTrap)), true
+	case 'g':
+		return reply(g.readRegisters()), true
+	case 'G':
+		return reply(g.writeRegisters(args)), true
+	case 'p':
+		n, err := strconv.ParseUint(args, 16, 8)
+		if err != nil {
+			return reply("E01"), true
+		}
+		return reply(g.readRegister(int(n))), true
+	case 'P':
+		n, value, found := strings.Cut(args, "=")
+		index, err := strconv.ParseUint(n, 16, 8)
+		if !found || err != nil {
+			return reply("E01"), true
+		}
+		return reply(g.writeRegister(int(index), value)), true
+	case 'm':
+		return reply(g.readMemory(args)), true
+	case 'M':
+		return reply(g.writeMemory(args)), true
+	case 's':
+		return reply(g.step()), true
+	case 'c':
+		return reply(g.cont()), true
+	case 'b':
+		switch args {
+		case "s":
+			return reply(g.reverseStep()), true
+		case "c":
+			return reply(g.reverseContinue()), true
+		}
+	case 'Z', 'z':
+		return reply(g.breakpoint(packet[0] == 'Z', args)), true
+	case 'H', 'T':
+		return reply("OK"), true
+	case 'k':
+		return nil, false
+	case 'D':
+		return reply("OK"), false
+	case 'q':
+		switch {
+		case strings.HasPrefix(args, "Supported"):
+			return reply("PacketSize=4000;ReverseStep+;ReverseContinue+"), true
+		case args == "Attached":
+			return reply("1"), true
+		case args == "C":
+			return reply("QC1"), true
+		}
+	}
+	// an empty reply tells gdb we don't support the packet
+	return reply(""), true
+}
+
+func gdbHex32(value uint32) string {
+	return fmt.Sprintf("%02x%02x%02x%02x", uint8(value), uint8(value>>8), uint8(value>>16), uint8(value>>24))
+}
+
+func parseGdbHex32(s string) (uint32, error) {
+	raw, err := hex.DecodeString(s)
+	if err != nil || len(raw) > 4 {
+		return 0, fmt.Errorf("bad register value %q", s)
+	}
+	var value uint32
+	for i, b := range raw {
+		value |= uint32(b) << (8 * i)
+	}
+	return value, nil
+}
+
+func (g *GdbServer) readRegister(n int) string {
+	if n >= len(gdbRegisters) {
+		return "E01"
+	}
+	if n == gdbFlagsRegister {
+		return gdbHex32(uint32(FlagsWord()))
+	}
+	if gdbRegisters[n] == Register_none {
+		return gdbHex32(0)
+	}
+	return gdbHex32(uint32(ReadU16(RegisterValues[gdbRegisters[n]], 0)))
+}
+
+func (g *GdbServer) writeRegister(n int, value string) string {
+	v, err := parseGdbHex32(value)
+	if err != nil || n >= len(gdbRegisters) {
+		return "E01"
+	}
+	switch {
+	case n == gdbFlagsRegister:
+		SetFlagsWord(uint16(v))
+	case gdbRegisters[n] != Register_none:
+		WriteU16(RegisterValues[gdbRegisters[n]], 0, uint16(v))
+	}
+	return "OK"
+}
+
+func (g *GdbServer) readRegisters() string {
+	var res strings.Builder
+	for n := range gdbRegisters {
+		res.WriteString(g.readRegister(n))
+	}
+	return res.String()
+}
+
+func (g *GdbServer) writeRegisters(values string) string {
+	for n := range gdbRegisters {
+		if len(values) < (n+1)*8 {
+			break
+		}
+		if result := g.writeRegister(n, values[n*8:(n+1)*8]); result != "OK" {
+			return result
+		}
+	}
+	return "OK"
+}
+
+// parseAddressLength reads the "addr,length" part of m, M and Z packets
+func parseAddressLength(s string) (uint32, uint32, error) {
+	address, length, found := strings.Cut(s, ",")
+	a, err := strconv.ParseUint(address, 16, 32)
+	if !found || err != nil {
+		return 0, 0, fmt.Errorf("bad address %q", s)
+	}
+	l, err := strconv.ParseUint(length, 16, 32)
+	if err != nil {
+		return 0, 0, fmt.Errorf("bad length %q", s)
+	}
+	return uint32(a), uint32(l), nil
+}
+
+// inMemory is true if the length bytes at address are all in memory, without address+length wrapping round
+func inMemory(address, length uint32) bool {
+	return uint64(address)+uint64(length) <= uint64(len(MemoryValues.Bytes))
+}
+
+func (g *GdbServer) readMemory(args string) string {
+	address, length, err := parseAddressLength(args)
+	address = gdbAddress(address)
+	if err != nil || !inMemory(address, length) {
+		return "E01"
+	}
+	data := make([]byte, length)
+	for i := range data {
+		data[i] = uint8(MemoryValues.Peek(address+uint32(i), false))
+	}
+	return hex.EncodeToString(data)
+}
+
+func (g *GdbServer) writeMemory(args string) string {
+	location, data, _ := strings.Cut(args, ":")
+	address, length, err := parseAddressLength(location)
+	address = gdbAddress(address)
+	if err != nil || !inMemory(address, length) {
+		return "E01"
+	}
+	raw, err := hex.DecodeString(data)
+	if err != nil || uint32(len(raw)) != length {
+		return "E01"
+	}
+	// written like the program would so rom stays read only and the undo history and traces see it
+	for i, b := range raw {
+		MemoryValues.Write(address+uint32(i), uint16(b), false)
+	}
+	// gdb changing memory isn't something its own watchpoints should stop for
+	g.watchpoints.TakeHits()
+	return "OK"
+}
+
+// exited is true once the program has halted or cs:ip has left it, the process is over as far as gdb is concerned
+func (g *GdbServer) exited() bool {
+	return Halted || int(InstructionAddress()) >= g.Program.End
+}
+
+// finished is true when nothing more can run, the program exited or cs:ip landed somewhere that wasn't decoded
+func (g *GdbServer) finished() bool {
+	_, decoded := FetchInstruction(g.Disassembly.Instructions, InstructionAddress())
+	return g.exited() || !decoded
+}
+
+// breakpointHit checks the breakpoints against the instruction at cs:ip, an address that hasn't been decoded
+// can't have one
+func (g *GdbServer) breakpointHit() bool {
+	instruction, ok := FetchInstruction(g.Disassembly.Instructions, InstructionAddress())
+	return ok && g.breakpoints.Check(instruction) != nil
+}
+
+// stopReply is sent after the program stops, watchpoint hits tell gdb which address triggered
+func (g *GdbServer) stopReply(hits []WatchHit) string {
+	if CpuFault != nil {
+		// tell gdb it was a segfault so the state at the faulting instruction can be looked at
+		return fmt.Sprintf("S%02x", gdbSigSegv)
+	}
+	if g.exited() {
+		return "W00"
+	}
+	if g.finished() {
+		// still stopped in the program, just somewhere that can't be run, so gdb can look at how it got there
+		return fmt.Sprintf("S%02x", gdbSigSegv)
+	}
+	if len(hits) > 0 {
+		kind := "watch"
+		switch hits[0].Watchpoint.Kind {
+		case WatchRead:
+			kind = "rwatch"
+		case WatchRead | WatchWrite:
+			kind = "awatch"
+		}
+		return fmt.Sprintf("T%02x%s:%x;", gdbSigTrap, kind, hits[0].Access.Address)
+	}
+	return fmt.Sprintf("S%02x", gdbSigTrap)
+}
+
+func (g *GdbServer) step() string {
+	if !g.finished() {
+		Step(g.Disassembly.Instructions, []bool{false, false, false})
+	}
+	return g.stopReply(g.watchpoints.TakeHits())
+}
+
+// cont runs until a breakpoint, watchpoint, the end of the program or gdb sends an interrupt
+func (g *GdbServer) cont() string {
+	// step off the current instruction first so a breakpoint at ip doesn't stop us straight away
+	for steps := 0; !g.finished(); steps++ {
+		Step(g.Disassembly.Instructions, []bool{false, false, false})
+		if hits := g.watchpoints.TakeHits(); len(hits) > 0 {
+			return g.stopReply(hits)
+		}
+		if g.finished() {
+			break
+		}
+		if g.breakpointHit() {
+			return g.stopReply(nil)
+		}
+
+		// don't check for ctrl-c on every instruction, it's a channel operation
+		if steps%1024 == 0 {
+			select {
+			case packet, ok := <-g.packets:
+				if !ok || packet == "\x03" {
+					return fmt.Sprintf("S%02x", gdbSigInt)
+				}
+				g.deferred = append(g.deferred, packet)
+			default:
+			}
+		}
+	}
+	return g.stopReply(nil)
+}
+
+// reverseStep handles bs, undoing the last instruction
+func (g *GdbServer) reverseStep() string {
+	if _, ok := g.history.Undo(); !ok {
+		// the replaylog stop reason tells gdb it hit the start of the recording
+		return fmt.Sprintf("T%02xreplaylog:begin;", gdbSigTrap)
+	}
+	return fmt.Sprintf("S%02x", gdbSigTrap)
+}
+
+// reverseContinue handles bc, undoing instructions until one with a breakpoint is at ip
+func (g *GdbServer) reverseContinue() string {
+	for {
+		if _, ok := g.history.Undo(); !ok {
+			return fmt.Sprintf("T%02xreplaylog:begin;", gdbSigTrap)
+		}
+		if g.breakpointHit() {
+			return fmt.Sprintf("S%02x", gdbSigTrap)
+		}
+	}
+}
+
+// gdbAddress turns an address from gdb into a physical one. gdb's pc is ip, so anything that fits in 16 bits is
+// an offset in cs and anything bigger is already physical. Memory, breakpoints and watchpoints all use it so
+// x/i $pc shows the code a breakpoint at $pc stops on
+func gdbAddress(address uint32) uint32 {
+	if address > 0xffff {
+		return address
+	}
+	return Physical(SegmentBase(Register_cs), uint16(address))
+}
+
+// breakpoint handles Z (insert) and z (remove) packets, type 0/1 are breakpoints and 2/3/4 write/read/access watchpoints
+func (g *GdbServer) breakpoint(insert bool, args string) string {
+	kind, location, _ := strings.Cut(args, ",")
+	address, length, err := parseAddressLength(location)
+	if err != nil {
+		return "E01"
+	}
+
+	watchKinds := map[string]WatchKind{"2": WatchWrite, "3": WatchRead, "4": WatchRead | WatchWrite}
+	switch {
+	case kind == "0" || kind == "1":
+		address = gdbAddress(address)
+		if insert {
+			g.breakpoints.AddAddress(address)
+			return "OK"
+		}
+		for _, b := range g.breakpoints.List {
+			if b.HasAddress && b.Address == address {
+				g.breakpoints.Delete(b.ID)
+				return "OK"
+			}
+		}
+		return "E01"
+	case watchKinds[kind] != 0:
+		address = gdbAddress(address)
+		if insert {
+			g.watchpoints.AddRange(watchKinds[kind], address, length)
+			return "OK"
+		}
+		for _, w := range g.watchpoints.List {
+			if w.Kind == watchKinds[kind] && w.Start == address && w.End == address+length {
+				g.watchpoints.Delete(w.ID)
+				return "OK"
+			}
+		}
+		return "E01"
+	}
+	return ""
+}
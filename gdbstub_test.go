@@ -0,0 +1,206 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"testing"
+)
+
+// newTestGdbServer loads mov ax, 1 then hlt at 1000:0000 and makes a server for it with no connection
+func newTestGdbServer() *GdbServer {
+	ResetMachine()
+	copy(MemoryValues.Bytes[0x10000:], []byte{0xb8, 0x01, 0x00, 0xf4})
+	WriteU16(RegisterValues[Register_cs], 0, 0x1000)
+	program := Program{Format: "flat", Start: 0x10000, End: 0x10004, Entries: []int{0x10000}}
+	return &GdbServer{
+		Disassembly: DecodeFlow(MemoryValues.Bytes, program.Start, program.End, program.Entries...),
+		Program:     program,
+		packets:     make(chan string, 1),
+		breakpoints: &Breakpoints{},
+		watchpoints: NewWatchpoints(&MemoryValues),
+	}
+}
+
+func TestGdbPackets(t *testing.T) {
+	g := newTestGdbServer()
+	MemoryValues.Map(Region{Name: "rom", Start: 0x20000, End: 0x20010, Kind: RegionRom})
+	MemoryValues.Poke(0x20000, 0x5a, false)
+	// step, continue and the other packets that run the program are in TestGdbRun
+	tests := []struct {
+		packet string
+		reply  string
+	}{
+		{"?", "S05"},
+		{"qSupported:multiprocess+", "PacketSize=4000;ReverseStep+;ReverseContinue+"},
+		{"qAttached", "1"},
+		{"vMustReplyEmpty", ""},
+		{"Hg0", "OK"},
+		{"P0=34120000", "OK"},
+		{"p0", "34120000"},
+		{"p8", "00000000"},
+		{"pa", "00100000"},
+		{"P9=81000000", "OK"},
+		{"p9", "83000000"},
+		{"p20", "E01"},
+		{"Pzz=00", "E01"},
+		{"M100,2:abcd", "OK"},
+		{"m100,3", "abcd00"},
+		{"M100,2:ab", "E01"},
+		{"M100,1:zz", "E01"},
+		{"mfffff,1", "00"},
+		{"mfffff,2", "E01"},
+		{"mffffffff,2", "E01"},
+		{"m100", "E01"},
+		// rom ignores gdb's writes like it does the program's
+		{"M20000,1:00", "OK"},
+		{"m20000,1", "5a"},
+		{"Z0,3,1", "OK"},
+		{"z0,3,1", "OK"},
+		{"z0,3,1", "E01"},
+		{"Z2,100,2", "OK"},
+		{"z2,100,2", "OK"},
+		{"z3,100,2", "E01"},
+		{"Z9,100,2", ""},
+		{"Z0,zz", "E01"},
+	}
+	for _, test := range tests {
+		reply, keepGoing := g.handle(test.packet)
+		if reply == nil || *reply != test.reply || !keepGoing {
+			got := "nil"
+			if reply != nil {
+				got = fmt.Sprintf("%q", *reply)
+			}
+			t.Errorf("%q replied %s, %v, want %q", test.packet, got, keepGoing, test.reply)
+		}
+	}
+
+	if ax := ReadU16(RegisterValues[Register_a], 0); ax != 0x1234 {
+		t.Errorf("P0 set ax to %04x", ax)
+	}
+	if !CpuFlagValues[CarryFlag] || !CpuFlagValues[SignFlag] || CpuFlagValues[ZeroFlag] {
+		t.Errorf("P9 set the flags to %v", CpuFlagValues)
+	}
+	if value := MemoryValues.Peek(0x10100, true); value != 0xcdab {
+		t.Errorf("M100 wrote %04x", value)
+	}
+	if reply, keepGoing := g.handle("g"); len(*reply) != len(gdbRegisters)*8 || !keepGoing {
+		t.Errorf("g replied %q", *reply)
+	}
+	if _, keepGoing := g.handle("D"); keepGoing {
+		t.Errorf("D should end the session")
+	}
+}
+
+func TestGdbAddresses(t *testing.T) {
+	g := newTestGdbServer()
+	tests := []struct {
+		packet  string
+		address uint32
+	}{
+		// gdb's pc is ip so small addresses are offsets in cs
+		{"Z0,3,1", 0x10003},
+		{"Z1,0,1", 0x10000},
+		{"Z0,10003,1", 0x10003},
+		{"Z0,fffff,1", 0xfffff},
+	}
+	for _, test := range tests {
+		g.breakpoints = &Breakpoints{}
+		if reply, _ := g.handle(test.packet); *reply != "OK" {
+			t.Errorf("%q replied %q", test.packet, *reply)
+			continue
+		}
+		if b := g.breakpoints.List[0]; !b.HasAddress || b.Address != test.address {
+			t.Errorf("%q set a breakpoint at %05x, want %05x", test.packet, b.Address, test.address)
+		}
+	}
+
+	// memory and watchpoints use the same addresses, so x/i $pc reads the program at 1000:0000 not the vector table
+	MemoryValues.Poke(0, 0x1234, true)
+	memory := []struct {
+		packet string
+		reply  string
+	}{
+		{"m0,4", "b80100f4"},
+		{"m10000,4", "b80100f4"},
+		{"M3,1:90", "OK"},
+		{"m10003,1", "90"},
+		{"m0,1", "b8"},
+	}
+	for _, test := range memory {
+		if reply, _ := g.handle(test.packet); *reply != test.reply {
+			t.Errorf("%q replied %q, want %q", test.packet, *reply, test.reply)
+		}
+	}
+	if value := MemoryValues.Peek(0, true); value != 0x1234 {
+		t.Errorf("gdb's writes reached the vector table, it holds %04x", value)
+	}
+	g.handle("Z2,100,2")
+	if w := g.watchpoints.List[0]; w.Start != 0x10100 || w.End != 0x10102 {
+		t.Errorf("Z2,100,2 watches %05x-%05x, want 10100-10102", w.Start, w.End)
+	}
+}
+
+func TestGdbRun(t *testing.T) {
+	g := newTestGdbServer()
+	g.handle("Z0,3,1")
+	if reply, _ := g.handle("c"); *reply != "S05" || InstructionAddress() != 0x10003 {
+		t.Errorf("continue to the breakpoint replied %q at %05x", *reply, InstructionAddress())
+	}
+	if reply, _ := g.handle("s"); *reply != "W00" || !Halted {
+		t.Errorf("stepping the hlt replied %q", *reply)
+	}
+
+	// cs:ip in the middle of the mov isn't the end of the program, gdb should still be able to look around
+	g = newTestGdbServer()
+	WriteU16(RegisterValues[Register_ip], 0, 1)
+	if reply, _ := g.handle("s"); *reply != "S0b" {
+		t.Errorf("stepping at an undecoded address replied %q", *reply)
+	}
+
+	// packets that turn up while running are answered once the program stops instead of being dropped
+	g = newTestGdbServer()
+	g.packets <- "p0"
+	if reply, _ := g.handle("c"); *reply != "W00" {
+		t.Errorf("continue to the end replied %q", *reply)
+	}
+	if packet, ok := g.nextPacket(); !ok || packet != "p0" {
+		t.Errorf("the packet sent while running was %q, %v", packet, ok)
+	}
+}
+
+func TestGdbReadPackets(t *testing.T) {
+	server, client := net.Pipe()
+	defer client.Close()
+	g := &GdbServer{conn: server, packets: make(chan string)}
+	go g.readPackets()
+
+	tests := []struct {
+		sent   string
+		ack    string
+		packet string
+	}{
+		{"$m100,2#" + fmt.Sprintf("%02x", gdbChecksum("m100,2")), "+", "m100,2"},
+		{"$?#3f", "+", "?"},
+		{"$?#00", "-", ""},
+		{"\x03", "", "\x03"},
+	}
+	for _, test := range tests {
+		go client.Write([]byte(test.sent))
+		if test.ack != "" {
+			ack := make([]byte, 1)
+			if _, err := client.Read(ack); err != nil || string(ack) != test.ack {
+				t.Errorf("%q was acked with %q, %v want %q", test.sent, ack, err, test.ack)
+			}
+		}
+		if test.packet != "" {
+			if packet := <-g.packets; packet != test.packet {
+				t.Errorf("%q was read as %q", test.sent, packet)
+			}
+		}
+	}
+
+	client.Close()
+	if _, ok := <-g.packets; ok {
+		t.Errorf("packets should be closed once the connection is")
+	}
+}
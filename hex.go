@@ -0,0 +1,158 @@
+package main
+
+import (
+	"bufio"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// intel hex record types
+const (
+	hexData            = 0x00
+	hexEndOfFile       = 0x01
+	hexExtendedSegment = 0x02 // following addresses are offsets from this segment
+	hexStartSegment    = 0x03 // cs:ip to start at
+	hexExtendedLinear  = 0x04 // upper 16 bits of following addresses
+	hexStartLinear     = 0x05 // 32 bit entry point, only the low 20 bits mean anything here
+)
+
+// hexRecordSizes are how many data bytes the address records must have
+var hexRecordSizes = map[uint8]int{hexExtendedSegment: 2, hexStartSegment: 4, hexExtendedLinear: 2, hexStartLinear: 4}
+
+// HexChunk is a run of bytes a data record puts at Address
+type HexChunk struct {
+	Address uint32
+	Data    []byte
+}
+
+// HexImage is what an Intel HEX file holds, the data in file order and the cs:ip to start at if it says
+type HexImage struct {
+	Chunks   []HexChunk
+	HasEntry bool
+	CS, IP   uint16
+}
+
+// ParseHex reads Intel HEX records up to the end of file record. Addresses are 20 bits like the 8086's,
+// a record that reaches past 1MB is an error rather than wrapping round to 0
+func ParseHex(r io.Reader) (HexImage, error) {
+	var image HexImage
+	var base uint32
+	linear := false // base came from an extended linear address record
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" {
+			continue
+		}
+		if !strings.HasPrefix(text, ":") {
+			return HexImage{}, fmt.Errorf("line %d: records start with ':'", line)
+		}
+		record, err := hex.DecodeString(text[1:])
+		if err != nil {
+			return HexImage{}, fmt.Errorf("line %d: %v", line, err)
+		}
+		if len(record) < 5 || len(record) != int(record[0])+5 {
+			return HexImage{}, fmt.Errorf("line %d: record length doesn't match its byte count", line)
+		}
+		var checksum uint8
+		for _, b := range record {
+			checksum += b
+		}
+		if checksum != 0 {
+			return HexImage{}, fmt.Errorf("line %d: bad checksum", line)
+		}
+
+		offset := uint32(record[1])<<8 | uint32(record[2])
+		data := record[4 : len(record)-1]
+		if size, ok := hexRecordSizes[record[3]]; ok && len(data) != size {
+			return HexImage{}, fmt.Errorf("line %d: record type %02x should have %d bytes of data", line, record[3], size)
+		}
+		value := uint32(0)
+		for _, b := range data {
+			value = value<<8 | uint32(b)
+		}
+
+		switch record[3] {
+		case hexData:
+			// a segment's data wraps within its 64k like the segment would, a linear address carries on past it
+			for i, b := range data {
+				address, wraps := base+offset+uint32(i), false
+				if !linear {
+					address, wraps = base+(offset+uint32(i))&0xFFFF, (offset+uint32(i))&0xFFFF == 0
+				}
+				if address > 0xFFFFF {
+					return HexImage{}, fmt.Errorf("line %d: address %x is past the 1MB an 8086 can reach", line, address)
+				}
+				if i == 0 || wraps {
+					image.Chunks = append(image.Chunks, HexChunk{Address: address})
+				}
+				chunk := &image.Chunks[len(image.Chunks)-1]
+				chunk.Data = append(chunk.Data, b)
+			}
+		case hexEndOfFile:
+			return image, nil
+		case hexExtendedSegment:
+			base, linear = value<<4, false
+		case hexExtendedLinear:
+			base, linear = value<<16, true
+		case hexStartSegment:
+			image.CS, image.IP, image.HasEntry = uint16(value>>16), uint16(value), true
+		case hexStartLinear:
+			if value > 0xFFFFF {
+				return HexImage{}, fmt.Errorf("line %d: entry point %x is past the 1MB an 8086 can reach", line, value)
+			}
+			image.CS, image.IP, image.HasEntry = uint16(value>>4), uint16(value&0xF), true
+		default:
+			return HexImage{}, fmt.Errorf("line %d: unknown record type %02x", line, record[3])
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return HexImage{}, err
+	}
+	return HexImage{}, fmt.Errorf("no end of file record")
+}
+
+// LoadHex loads an Intel HEX file, data records go wherever their address says. A start segment
+// address record sets cs:ip, without one the run starts at the lowest address loaded
+func LoadHex(fileName string) (Program, error) {
+	file, err := os.Open(fileName)
+	if err != nil {
+		return Program{}, err
+	}
+	defer file.Close()
+
+	image, err := ParseHex(file)
+	if err != nil {
+		return Program{}, fmt.Errorf("%s %v", fileName, err)
+	}
+	program := Program{Format: "flat", Start: len(MemoryValues.Bytes)}
+	for _, chunk := range image.Chunks {
+		end := int(chunk.Address) + len(chunk.Data)
+		if end > len(MemoryValues.Bytes) {
+			return Program{}, fmt.Errorf("%s: %d bytes at %05x runs past the end of memory", fileName, len(chunk.Data), chunk.Address)
+		}
+		copy(MemoryValues.Bytes[chunk.Address:], chunk.Data)
+		program.Start = min(program.Start, int(chunk.Address))
+		program.End = max(program.End, end)
+	}
+	if image.HasEntry {
+		WriteU16(RegisterValues[Register_cs], 0, image.CS)
+		WriteU16(RegisterValues[Register_ip], 0, image.IP)
+	}
+	return finishHex(program, image.HasEntry), nil
+}
+
+func finishHex(program Program, hasEntry bool) Program {
+	if program.End == 0 {
+		program.Start = 0
+	}
+	if !hasEntry {
+		WriteU16(RegisterValues[Register_cs], 0, uint16(program.Start>>4))
+		WriteU16(RegisterValues[Register_ip], 0, uint16(program.Start&0xF))
+	}
+	program.Entries = []int{int(InstructionAddress())}
+	return program
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// hexRecord formats a record with its byte count and checksum filled in
+func hexRecord(offset uint16, kind uint8, data ...byte) string {
+	record := append([]byte{uint8(len(data)), uint8(offset >> 8), uint8(offset), kind}, data...)
+	var sum uint8
+	for _, b := range record {
+		sum += b
+	}
+	return fmt.Sprintf(":%s%02X\n", strings.ToUpper(hex.EncodeToString(record)), -sum)
+}
+
+func TestParseHex(t *testing.T) {
+	eof := hexRecord(0, hexEndOfFile)
+	tests := []struct {
+		name  string
+		file  string
+		image HexImage
+	}{
+		{"empty", eof, HexImage{}},
+		{
+			"data",
+			hexRecord(0x100, hexData, 0xb8, 0x01, 0x00) + "\n" + hexRecord(0x103, hexData, 0xf4) + eof,
+			HexImage{Chunks: []HexChunk{{0x100, []byte{0xb8, 0x01, 0x00}}, {0x103, []byte{0xf4}}}},
+		},
+		{
+			"extended segment",
+			hexRecord(0, hexExtendedSegment, 0x10, 0x00) + hexRecord(0x10, hexData, 0x90) + eof,
+			HexImage{Chunks: []HexChunk{{0x10010, []byte{0x90}}}},
+		},
+		{
+			"extended linear",
+			hexRecord(0, hexExtendedLinear, 0x00, 0x0f) + hexRecord(0xfff0, hexData, 0xea) + eof,
+			HexImage{Chunks: []HexChunk{{0xffff0, []byte{0xea}}}},
+		},
+		{
+			// a record running off the end of its 64k wraps to the start of it
+			"wrap",
+			hexRecord(0, hexExtendedSegment, 0x10, 0x00) + hexRecord(0xffff, hexData, 1, 2) + eof,
+			HexImage{Chunks: []HexChunk{{0x1ffff, []byte{1}}, {0x10000, []byte{2}}}},
+		},
+		{
+			// linear addresses are 32 bits so a record carries on into the next 64k
+			"linear crossing 64k",
+			hexRecord(0, hexExtendedLinear, 0x00, 0x01) + hexRecord(0xffff, hexData, 1, 2) + eof,
+			HexImage{Chunks: []HexChunk{{0x1ffff, []byte{1, 2}}}},
+		},
+		{
+			"start segment",
+			hexRecord(0, hexStartSegment, 0xf0, 0x00, 0xff, 0xf0) + eof,
+			HexImage{HasEntry: true, CS: 0xf000, IP: 0xfff0},
+		},
+		{
+			"start linear",
+			hexRecord(0, hexStartLinear, 0x00, 0x0f, 0xff, 0xf3) + eof,
+			HexImage{HasEntry: true, CS: 0xffff, IP: 3},
+		},
+	}
+	for _, test := range tests {
+		image, err := ParseHex(strings.NewReader(test.file))
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(image, test.image) {
+			t.Errorf("%s: got %+v, want %+v", test.name, image, test.image)
+		}
+	}
+}
+
+func TestParseHexErrors(t *testing.T) {
+	eof := hexRecord(0, hexEndOfFile)
+	tests := []struct {
+		name   string
+		file   string
+		reason string
+	}{
+		{"no colon", "00000001FF\n", "start with ':'"},
+		{"not hex", ":zz\n", "line 1"},
+		{"length", ":0100000001\n", "byte count"},
+		{"checksum", ":00000001FE\n", "bad checksum"},
+		{"record size", hexRecord(0, hexExtendedSegment, 1) + eof, "should have 2 bytes"},
+		{"unknown type", hexRecord(0, 0x09) + eof, "unknown record type"},
+		{"no end", hexRecord(0, hexData, 1), "no end of file"},
+		// 0x10 << 16 is past the 20 bit bus, it used to be masked back round to 0
+		{"past 1MB", hexRecord(0, hexExtendedLinear, 0x00, 0x10) + hexRecord(0, hexData, 1) + eof, "past the 1MB"},
+		{"segment past 1MB", hexRecord(0, hexExtendedSegment, 0xff, 0xff) + hexRecord(0x10, hexData, 1) + eof, "past the 1MB"},
+		{"linear crossing 1MB", hexRecord(0, hexExtendedLinear, 0x00, 0x0f) + hexRecord(0xffff, hexData, 1, 2) + eof, "address 100000 is past the 1MB"},
+		{"entry past 1MB", hexRecord(0, hexStartLinear, 0x00, 0x10, 0x00, 0x00) + eof, "past the 1MB"},
+	}
+	for _, test := range tests {
+		if _, err := ParseHex(strings.NewReader(test.file)); err == nil || !strings.Contains(err.Error(), test.reason) {
+			t.Errorf("%s: got %v, want an error about %q", test.name, err, test.reason)
+		}
+	}
+}
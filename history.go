@@ -0,0 +1,174 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"maps"
+	"slices"
+)
+
+// UndoRecord holds everything one instruction changed, enough to put the machine back to how it was before it ran
+type UndoRecord struct {
+	Step        int // how many instructions ran before this one
+	Instruction Instruction
+	IP          uint16
+
+	Registers map[Register]uint16 // values before the instruction, only for registers it changed
+	Flags     CpuFlags            // flags before the instruction
+	Writes    []MemoryAccess      // memory writes in the order they happened, Old is what to restore
+	Stack     [3]uint16           // words at ss:sp before, popping clears them without a write
+	TookJump  bool
+
+	Cycles          int // ElapsedCycles before
+	TotalCycles     int
+	Halted          bool
+	Fault           *Fault
+	InterruptShadow bool
+	RuntimeEntries  map[uint32]bool
+	Calls           []Frame                    // shadow call stack before, only if the instruction changed it
+	CallsChanged    bool                       // Calls can be empty so it needs saying
+	Devices         map[string]json.RawMessage // state before of the devices the instruction changed
+}
+
+func (r UndoRecord) String() string {
+	return fmt.Sprintf("step %d ip %x: %s", r.Step, r.IP, r.Instruction)
+}
+
+// History records an UndoRecord for every simulated instruction so execution can be stepped backwards
+type History struct {
+	Records []UndoRecord
+	Limit   int // oldest records are dropped past this many, 0 keeps everything
+
+	steps     int
+	recording bool
+	current   UndoRecord
+	registers map[Register]uint16
+	calls     []Frame
+	devices   map[string]json.RawMessage
+}
+
+// NewHistory starts recording every instruction simulated from now on, writes are seen by observing memory
+func NewHistory(memory *Memory, limit int) *History {
+	h := &History{Limit: limit}
+	memory.Observe(h.observeMemory)
+	ExecutionObservers = append(ExecutionObservers, h)
+	return h
+}
+
+func (h *History) observeMemory(access MemoryAccess) {
+	if h.recording && access.Kind == MemoryWrite {
+		h.current.Writes = append(h.current.Writes, access)
+	}
+}
+
+func (h *History) Before(instruction Instruction) {
+	h.registers = registerSnapshot()
+	h.current = UndoRecord{
+		Step:        h.steps,
+		Instruction: instruction,
+		IP:          h.registers[Register_ip],
+		Registers:   map[Register]uint16{},
+		Flags:       maps.Clone(CpuFlagValues),
+		TookJump:    tookJump,
+
+		Cycles:          ElapsedCycles,
+		TotalCycles:     totalCycles,
+		Halted:          Halted,
+		Fault:           CpuFault,
+		InterruptShadow: interruptShadow,
+		RuntimeEntries:  maps.Clone(runtimeEntries),
+	}
+	h.calls = slices.Clone(Calls.Frames)
+	// a device that can't be saved (dos with files open) just isn't rewound
+	h.devices, _ = deviceStates()
+	for i := range h.current.Stack {
+		h.current.Stack[i] = MemoryValues.PeekOffset(SegmentBase(Register_ss), h.registers[Register_sp]+uint16(2*i), true)
+	}
+	h.recording = true
+}
+
+func (h *History) After(instruction Instruction) {
+	for register, value := range registerSnapshot() {
+		if before := h.registers[register]; before != value {
+			h.current.Registers[register] = before
+		}
+	}
+	if !slices.Equal(h.calls, Calls.Frames) {
+		h.current.Calls, h.current.CallsChanged = h.calls, true
+	}
+	// timers and keys arriving change devices without the program touching a port, so compare every device
+	devices, _ := deviceStates()
+	for name, before := range h.devices {
+		if !bytes.Equal(before, devices[name]) {
+			if h.current.Devices == nil {
+				h.current.Devices = map[string]json.RawMessage{}
+			}
+			h.current.Devices[name] = before
+		}
+	}
+
+	h.Records = append(h.Records, h.current)
+	if h.Limit > 0 && len(h.Records) > h.Limit {
+		h.Records = h.Records[len(h.Records)-h.Limit:]
+	}
+	h.recording = false
+	h.steps++
+}
+
+// Steps is the number of instructions executed so far, it goes down as instructions are undone
+func (h *History) Steps() int {
+	return h.steps
+}
+
+// Undo reverts the most recent instruction, ok is false if there's nothing left in the history
+func (h *History) Undo() (UndoRecord, bool) {
+	if len(h.Records) == 0 {
+		return UndoRecord{}, false
+	}
+	record := h.Records[len(h.Records)-1]
+	h.Records = h.Records[:len(h.Records)-1]
+
+	for i := len(record.Writes) - 1; i >= 0; i-- {
+		write := record.Writes[i]
+		MemoryValues.Poke(write.Address, write.Old, write.Wide)
+	}
+	for register, value := range record.Registers {
+		WriteU16(RegisterValues[register], 0, value)
+	}
+	for i, value := range record.Stack {
+		MemoryValues.PokeOffset(SegmentBase(Register_ss), ReadU16(RegisterValues[Register_sp], 0)+uint16(2*i), value, true)
+	}
+	maps.Copy(CpuFlagValues, record.Flags)
+	tookJump = record.TookJump
+	ElapsedCycles = record.Cycles
+	totalCycles = record.TotalCycles
+	Halted = record.Halted
+	CpuFault = record.Fault
+	interruptShadow = record.InterruptShadow
+	runtimeEntries = maps.Clone(record.RuntimeEntries)
+	if record.CallsChanged {
+		Calls.Frames = record.Calls
+	}
+	// the states were saved by these same devices so loading them back can't fail
+	loadDeviceStates(record.Devices)
+	h.steps = record.Step
+	return record, true
+}
+
+// LastWrite finds the most recent recorded instruction that wrote to address and the write it made
+func (h *History) LastWrite(address uint32) (UndoRecord, MemoryAccess, bool) {
+	for i := len(h.Records) - 1; i >= 0; i-- {
+		writes := h.Records[i].Writes
+		for j := len(writes) - 1; j >= 0; j-- {
+			end := writes[j].Address + 1
+			if writes[j].Wide {
+				end++
+			}
+			if address >= writes[j].Address && address < end {
+				return h.Records[i], writes[j], true
+			}
+		}
+	}
+	return UndoRecord{}, MemoryAccess{}, false
+}
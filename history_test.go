@@ -0,0 +1,118 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"maps"
+	"slices"
+	"testing"
+)
+
+func TestHistoryUndo(t *testing.T) {
+	ResetMachine()
+	InstallTimer()
+	// mov sp, 1000h; call next; push ax; hlt
+	program := []byte{0xbc, 0x00, 0x10, 0xe8, 0x00, 0x00, 0x50, 0xf4}
+	copy(MemoryValues.Bytes, program)
+	disassembly := DecodeFlow(MemoryValues.Bytes, 0, len(program), 0)
+	// a short count on channel 0 so the timer raises irq0 while the program runs, if is clear so it stays pending
+	PortOut(pitControlPort, 0b00_11_010_0, false)
+	PortOut(pitChannelPort, 5, false)
+	PortOut(pitChannelPort, 0, false)
+	runtimeEntries[0x500] = true
+
+	before, err := deviceStates()
+	if err != nil {
+		t.Fatal(err)
+	}
+	memory := slices.Clone(MemoryValues.Bytes)
+	registers := registerSnapshot()
+	history := NewHistory(&MemoryValues, 0)
+	for !Halted {
+		Step(disassembly.Instructions, []bool{false, false, false})
+	}
+	if len(Calls.Frames) != 1 || InterruptController.Requests == 0 || ElapsedCycles == 0 {
+		t.Fatalf("the program should have called, raised irq0 and taken time: %v %x %d", Calls.Frames, InterruptController.Requests, ElapsedCycles)
+	}
+
+	for {
+		if _, ok := history.Undo(); !ok {
+			break
+		}
+	}
+	if Halted || ElapsedCycles != 0 || totalCycles != 0 || len(Calls.Frames) != 0 || CpuFault != nil {
+		t.Errorf("undo left halted %v, %d cycles, %d total, calls %v, fault %v", Halted, ElapsedCycles, totalCycles, Calls.Frames, CpuFault)
+	}
+	if !maps.Equal(runtimeEntries, map[uint32]bool{0x500: true}) {
+		t.Errorf("undo left runtime entries %v", runtimeEntries)
+	}
+	if !maps.Equal(registerSnapshot(), registers) || !bytes.Equal(MemoryValues.Bytes, memory) {
+		t.Errorf("undo didn't put registers and memory back")
+	}
+	after, _ := deviceStates()
+	for name, state := range before {
+		if !bytes.Equal(after[name], state) {
+			t.Errorf("undo left %s as %s, want %s", name, after[name], state)
+		}
+	}
+}
+
+func TestInterruptIsItsOwnStep(t *testing.T) {
+	ResetMachine()
+	InstallTimer()
+	CpuFlagValues[InterruptFlag] = true
+	WriteU16(RegisterValues[Register_sp], 0, 0x1000)
+	StartStack()
+	// mov ax, 1; hlt with irq0 already waiting, its handler at 0000:0100 is just iret
+	program := []byte{0xb8, 0x01, 0x00, 0xf4}
+	copy(MemoryValues.Bytes, program)
+	MemoryValues.Poke(0x100, 0xcf, false)
+	MemoryValues.Poke(0x08*4, 0x100, true)
+	disassembly := DecodeFlow(MemoryValues.Bytes, 0, len(program), 0)
+	InterruptController.Raise(0)
+
+	var trace bytes.Buffer
+	tracer := NewTracer(&trace, &MemoryValues)
+	history := NewHistory(&MemoryValues, 0)
+	Step(disassembly.Instructions, []bool{false, false, false})
+	tracer.Flush()
+
+	// the mov is one step and taking the irq after it another, with the pushes
+	if len(history.Records) != 2 {
+		t.Fatalf("recorded %v, want the mov then the irq", history.Records)
+	}
+	mov, irq := history.Records[0], history.Records[1]
+	if mov.Instruction.Op != Op_mov || len(mov.Writes) != 0 || mov.Registers[Register_sp] != 0 {
+		t.Errorf("the mov's record has the irq in it: writes %v registers %v", mov.Writes, mov.Registers)
+	}
+	if irq.Instruction.String() != "irq 8" || irq.IP != 3 || len(irq.Writes) != 3 {
+		t.Errorf("the irq was recorded as %s with writes %v", irq, irq.Writes)
+	}
+
+	var records []TraceRecord
+	scanner := bufio.NewScanner(&trace)
+	for scanner.Scan() {
+		var record TraceRecord
+		json.Unmarshal(scanner.Bytes(), &record)
+		records = append(records, record)
+	}
+	if len(records) != 2 || len(records[0].Writes) != 0 || records[1].Text != "irq 8" || len(records[1].Writes) != 3 ||
+		records[1].Address != 3 || records[1].RegsAfter["ip"] != 0x100 || records[1].Cycles != 0 {
+		t.Errorf("the trace is\n%s", trace.String())
+	}
+
+	// undoing the irq leaves it waiting again after the mov
+	history.Undo()
+	if ip, sp := ReadU16(RegisterValues[Register_ip], 0), ReadU16(RegisterValues[Register_sp], 0); ip != 3 || sp != 0x1000 {
+		t.Errorf("undoing the irq left ip %04x sp %04x, want 0003 1000", ip, sp)
+	}
+	if InterruptController.Requests != 1 || InterruptController.InService != 0 || len(Calls.Frames) != 0 {
+		t.Errorf("undoing the irq left requests %b in service %b calls %v", InterruptController.Requests,
+			InterruptController.InService, Calls.Frames)
+	}
+	history.Undo()
+	if ip := ReadU16(RegisterValues[Register_ip], 0); ip != 0 || ReadU16(RegisterValues[Register_a], 0) != 0 {
+		t.Errorf("undoing the mov left ip %04x", ip)
+	}
+}
@@ -22,6 +22,10 @@ var (
 	ADDR_HI = InstructionBits{Usage: Bits_Disp, BitCount: 0}
 
 	IS_JUMP = InstructionBits{Usage: Bits_IsJump, BitCount: 0}
+
+	SR = InstructionBits{Usage: Bits_SR, BitCount: 2}
+
+	PORT_DX = InstructionBits{Usage: Bits_PortDX, BitCount: 0}
 )
 
 func ImpRm(rm uint8) InstructionBits {
@@ -50,6 +54,16 @@ func ImpW(w uint8) InstructionBits {
 	}
 }
 
+// ImpS(1) keeps DATA to one byte even when w is set, e.g. the port number of in ax, 0x40
+func ImpS(s uint8) InstructionBits {
+	return InstructionBits{
+		Usage:       Bits_S,
+		BitCount:    0,
+		Value:       s,
+		HasValueSet: true,
+	}
+}
+
 func ImpMod(mod uint8) InstructionBits {
 	return InstructionBits{
 		Usage:       Bits_MOD,
@@ -83,8 +97,7 @@ var instTable = []InstructionEncoding{
 	{Op_mov, []InstructionBits{L("1011"), W, REG, DATA, DATA_IF_W, ImpD(1)}},                                    //Immediate to register, because source is always reg, d(swap src/dest) here is implicit
 	{Op_mov, []InstructionBits{L("1010000"), W, ADDR_LO, ADDR_HI, ImpRm(0b110), ImpD(1), ImpMod(0), ImpReg(0)}}, // Memory to accumulator
 	{Op_mov, []InstructionBits{L("1010001"), W, ADDR_LO, ADDR_HI, ImpRm(0b110), ImpD(0), ImpMod(0), ImpReg(0)}}, // Accumulator to memory
-	// MISSING Register/memory to segment register
-	// MISSING Segment register to register/memory
+	{Op_mov, []InstructionBits{L("100011"), D, L("0"), MOD, L("0"), SR, RM, ImpW(1)}},                           // Register/memory to/from segment register
 
 	{Op_add, []InstructionBits{L("000000"), D, W, MOD, REG, RM}},                       // Reg/memory with register to either
 	{Op_add, []InstructionBits{L("100000"), S, W, MOD, L("000"), RM, DATA, DATA_IF_W}}, // Immediate to register/memory
@@ -115,11 +128,26 @@ var instTable = []InstructionEncoding{
 
 	{Op_push, []InstructionBits{L("11111111"), MOD, L("110"), RM, ImpD(0), ImpW(1)}}, // Reg/Memory
 	{Op_push, []InstructionBits{L("01010"), REG, ImpD(1), ImpW(1)}},                  // Register
+	{Op_push, []InstructionBits{L("000"), SR, L("110"), ImpD(1), ImpW(1)}},           // Segment register
 
 	{Op_pop, []InstructionBits{L("10001111"), MOD, L("000"), RM, ImpD(0), ImpW(1)}}, // Reg/memory
 	{Op_pop, []InstructionBits{L("01011"), REG, ImpD(1), ImpW(1)}},                  // Register
+	{Op_pop, []InstructionBits{L("000"), SR, L("111"), ImpD(1), ImpW(1)}},           // Segment register
 
 	{Op_call, []InstructionBits{L("11101000"), DATA, DATA_IF_W, ImpW(1)}}, // direct within segment
 
 	{Op_ret, []InstructionBits{L("11000011")}}, // within segment
+
+	{Op_int, []InstructionBits{L("11001101"), DATA}}, // type specified
+	{Op_iret, []InstructionBits{L("11001111")}},
+	{Op_hlt, []InstructionBits{L("11110100")}},
+
+	// the accumulator is always the first operand and the port the second, out just prints them the other way round
+	{Op_in, []InstructionBits{L("1110010"), W, DATA, ImpS(1), ImpReg(0), ImpD(1)}},  // fixed port
+	{Op_in, []InstructionBits{L("1110110"), W, PORT_DX, ImpReg(0), ImpD(1)}},        // variable port
+	{Op_out, []InstructionBits{L("1110011"), W, DATA, ImpS(1), ImpReg(0), ImpD(1)}}, // fixed port
+	{Op_out, []InstructionBits{L("1110111"), W, PORT_DX, ImpReg(0), ImpD(1)}},       // variable port
+
+	{Op_cli, []InstructionBits{L("11111010")}},
+	{Op_sti, []InstructionBits{L("11111011")}},
 }
@@ -21,6 +21,8 @@ const (
 	Bits_Data_If_W
 
 	Bits_IsJump
+	Bits_SR     // segment register
+	Bits_PortDX // port number is in dx
 )
 
 // InstructionBits are some part of the instruction, could be mod/reg/rm/whatever
@@ -57,6 +59,17 @@ const (
 	Op_pop
 	Op_call
 	Op_ret
+
+	Op_int
+	Op_iret
+	Op_hlt
+
+	Op_in
+	Op_out
+	Op_cli
+	Op_sti
+
+	Op_irq // not an instruction, the cpu taking a hardware interrupt between two of them
 )
 
 var opTypeToString = map[OperationType]string{
@@ -82,6 +95,17 @@ var opTypeToString = map[OperationType]string{
 	Op_pop:  "pop",
 	Op_call: "call",
 	Op_ret:  "ret",
+
+	Op_int:  "int",
+	Op_iret: "iret",
+	Op_hlt:  "hlt",
+
+	Op_in:  "in",
+	Op_out: "out",
+	Op_cli: "cli",
+	Op_sti: "sti",
+
+	Op_irq: "irq",
 }
 
 type InstructionEncoding struct {
@@ -113,10 +137,16 @@ const (
 	Register_di
 
 	Register_ip // what
+
+	// segment registers, in the order the sr field encodes them
+	Register_es
+	Register_cs
+	Register_ss
+	Register_ds
 )
 
 func (r Register) String() string {
-	return []string{"none", "a", "b", "c", "d", "sp", "bp", "si", "di", "ip"}[r]
+	return []string{"none", "a", "b", "c", "d", "sp", "bp", "si", "di", "ip", "es", "cs", "ss", "ds"}[r]
 }
 
 // Flag - set during decode stage, different from flags involved in simulation
@@ -160,7 +190,35 @@ const (
 type EffectiveAddress struct {
 	EffectiveAddressExpression EffectiveAddressFieldEncoding // bx + si, bx + di, dp + di... etc whatever
 	Displacement               int
-	Size                       Size // byte or word
+	Size                       Size     // byte or word
+	Segment                    Register // set by a segment override prefix, Register_none uses the default segment
+}
+
+// SegmentBase is the physical address a segment register points at
+func SegmentBase(segment Register) uint32 {
+	return uint32(ReadU16(RegisterValues[segment], 0)) << 4
+}
+
+// SegmentRegister is the segment the address is in, without an override bp based addressing uses ss and everything else ds
+func (e EffectiveAddress) SegmentRegister() Register {
+	if e.Segment != Register_none {
+		return e.Segment
+	}
+	switch e.EffectiveAddressExpression {
+	case EffectiveAddress_bp, EffectiveAddress_bp_si, EffectiveAddress_bp_di:
+		return Register_ss
+	}
+	return Register_ds
+}
+
+// Base is where the segment the address is in starts
+func (e EffectiveAddress) Base() uint32 {
+	return SegmentBase(e.SegmentRegister())
+}
+
+// PhysicalAddress is the address on the bus the effective address refers to
+func (e EffectiveAddress) PhysicalAddress() uint32 {
+	return Physical(e.Base(), e.CalculateLocation())
 }
 
 func (e EffectiveAddress) CalculateLocation() uint16 {
@@ -202,6 +260,9 @@ var EffectiveAddressFieldEncodingToString = map[EffectiveAddressFieldEncoding]st
 
 func (e EffectiveAddress) String() string {
 	res := "["
+	if e.Segment != Register_none {
+		res += RegisterName(e.Segment) + ":"
+	}
 	if e.EffectiveAddressExpression == EffectiveAddress_Direct_Address {
 		res += strconv.Itoa(e.Displacement) + "]"
 		return res
@@ -252,6 +313,11 @@ func (r RegisterAccess) String() string {
 		{"bp", "bp", "bp"},
 		{"si", "si", "si"},
 		{"di", "di", "di"},
+		{"ip", "ip", "ip"},
+		{"es", "es", "es"},
+		{"cs", "cs", "cs"},
+		{"ss", "ss", "ss"},
+		{"ds", "ds", "ds"},
 	}
 
 	if r.Length == 2 {
@@ -272,6 +338,39 @@ type Instruction struct {
 	InstructionOperands [2]InstructionOperand
 }
 
+// IsCall is true for instructions that push a return address before transferring control
+func (i Instruction) IsCall() bool {
+	return i.Op == Op_call
+}
+
+// IsReturn is true for instructions that pop their destination off the stack
+func (i Instruction) IsReturn() bool {
+	return i.Op == Op_ret || i.Op == Op_iret
+}
+
+// IsTerminate is true for instructions that never continue, hlt and the dos int 20h exit
+func (i Instruction) IsTerminate() bool {
+	return i.Op == Op_hlt || (i.Op == Op_int && i.InstructionOperands[1].Immediate.Value == 0x20)
+}
+
+// IsConditional is true for jumps that may fall through to the next instruction
+func (i Instruction) IsConditional() bool {
+	return i.Flags[IsJump] && i.Op != Op_jmp
+}
+
+// Displacement is the signed ip relative offset encoded in a jump or call, short forms are 8 bits and near forms 16
+func (i Instruction) Displacement() int {
+	if i.Flags[Wide] {
+		return int(int16(uint16(i.InstructionOperands[1].Immediate.Value)))
+	}
+	return int(int8(uint8(i.InstructionOperands[1].Immediate.Value)))
+}
+
+// Target is the address a jump or call transfers control to, relative jumps are measured from the end of the instruction
+func (i Instruction) Target() uint32 {
+	return uint32(int(i.Address) + int(i.Size) + i.Displacement())
+}
+
 func (i Instruction) String() string {
 	var sizePrefix string
 	if i.InstructionOperands[0].Type != Operand_Register &&
@@ -283,17 +382,24 @@ func (i Instruction) String() string {
 		}
 	}
 
-	if i.Flags[IsJump] {
-		return fmt.Sprintf("%s %s", opTypeToString[i.Op], i.InstructionOperands[1])
+	if i.Flags[IsJump] || i.Op == Op_call {
+		res := fmt.Sprintf("%s %s", opTypeToString[i.Op], i.InstructionOperands[1])
+		if symbol := Symbolize(i.Target()); symbol != "" {
+			res += " <" + symbol + ">"
+		}
+		return res
 	}
 
 	switch i.Op {
 	case Op_push, Op_pop:
 		return fmt.Sprintf("%s%s %s", opTypeToString[i.Op], sizePrefix, i.InstructionOperands[0])
-	case Op_call:
-		return fmt.Sprintf("%s %s", opTypeToString[i.Op], i.InstructionOperands[1])
-	case Op_ret:
+	case Op_ret, Op_iret, Op_hlt, Op_cli, Op_sti:
 		return fmt.Sprintf("%s", opTypeToString[i.Op])
+	case Op_out:
+		// operands are stored the same way round as in, accumulator first
+		return fmt.Sprintf("%s %s, %s", opTypeToString[i.Op], i.InstructionOperands[1], i.InstructionOperands[0])
+	case Op_int, Op_irq:
+		return fmt.Sprintf("%s %s", opTypeToString[i.Op], i.InstructionOperands[1])
 	default:
 		return fmt.Sprintf("%s%s %s, %s", opTypeToString[i.Op], sizePrefix, i.InstructionOperands[0], i.InstructionOperands[1])
 	}
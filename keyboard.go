@@ -0,0 +1,337 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+const (
+	keyboardDataPort   = 0x60
+	keyboardStatusPort = 0x64
+	keyboardIrq        = 1
+)
+
+// keyboardStatus is what port 64h reads with the output buffer empty, the system flag and keyboard not inhibited
+const keyboardStatus = 0b00010100
+
+// scancodes are the set 1 make codes of the keys a script can name, the break code is the make code | 80h
+var scancodes = map[string]uint8{
+	"esc": 0x01, "1": 0x02, "2": 0x03, "3": 0x04, "4": 0x05, "5": 0x06, "6": 0x07, "7": 0x08, "8": 0x09,
+	"9": 0x0a, "0": 0x0b, "-": 0x0c, "=": 0x0d, "backspace": 0x0e, "tab": 0x0f,
+	"q": 0x10, "w": 0x11, "e": 0x12, "r": 0x13, "t": 0x14, "y": 0x15, "u": 0x16, "i": 0x17, "o": 0x18,
+	"p": 0x19, "[": 0x1a, "]": 0x1b, "enter": 0x1c, "ctrl": 0x1d,
+	"a": 0x1e, "s": 0x1f, "d": 0x20, "f": 0x21, "g": 0x22, "h": 0x23, "j": 0x24, "k": 0x25, "l": 0x26,
+	";": 0x27, "'": 0x28, "`": 0x29, "shift": 0x2a, "\\": 0x2b,
+	"z": 0x2c, "x": 0x2d, "c": 0x2e, "v": 0x2f, "b": 0x30, "n": 0x31, "m": 0x32, ",": 0x33, ".": 0x34,
+	"/": 0x35, "rshift": 0x36, "alt": 0x38, "space": 0x39, "capslock": 0x3a,
+	"f1": 0x3b, "f2": 0x3c, "f3": 0x3d, "f4": 0x3e, "f5": 0x3f, "f6": 0x40, "f7": 0x41, "f8": 0x42,
+	"f9": 0x43, "f10": 0x44, "numlock": 0x45, "scrolllock": 0x46,
+	"home": 0x47, "up": 0x48, "pgup": 0x49, "left": 0x4b, "right": 0x4d, "end": 0x4f, "down": 0x50,
+	"pgdn": 0x51, "ins": 0x52, "del": 0x53, "f11": 0x57, "f12": 0x58,
+}
+
+// shiftedKeys are the characters typed by holding shift on another key
+var shiftedKeys = map[rune]string{
+	'!': "1", '@': "2", '#': "3", '$': "4", '%': "5", '^': "6", '&': "7", '*': "8", '(': "9", ')': "0",
+	'_': "-", '+': "=", '{': "[", '}': "]", ':': ";", '"': "'", '~': "`", '|': "\\", '<': ",", '>': ".", '?': "/",
+}
+
+// keyChars is the ascii each make code types without and with shift, keys like f1 and the arrows type 0
+var keyChars = func() map[uint8][2]uint8 {
+	chars := map[uint8][2]uint8{
+		scancodes["esc"]: {0x1b, 0x1b}, scancodes["backspace"]: {'\b', '\b'}, scancodes["tab"]: {'\t', '\t'},
+		scancodes["enter"]: {'\r', '\r'}, scancodes["space"]: {' ', ' '},
+	}
+	for name, code := range scancodes {
+		if len(name) == 1 {
+			chars[code] = [2]uint8{name[0], name[0]}
+		}
+	}
+	for char := uint8('a'); char <= 'z'; char++ {
+		chars[scancodes[string(char)]] = [2]uint8{char, char - 'a' + 'A'}
+	}
+	for shifted, name := range shiftedKeys {
+		c := chars[scancodes[name]]
+		c[1] = uint8(shifted)
+		chars[scancodes[name]] = c
+	}
+	return chars
+}()
+
+// ScriptedKey is a scancode that becomes available once ElapsedCycles reaches At
+type ScriptedKey struct {
+	At   int   `json:"at"`
+	Code uint8 `json:"code"`
+}
+
+// ParseKeyScript reads keyboard input with timestamps, each line is the cycle it happens at then what happens:
+//
+//	1000 a enter       key names are pressed and released
+//	2000 +shift a -shift   + only presses and - only releases
+//	3000 0x1e 0x9e     raw scancodes
+//	4000 "Hello\n"     typed text, shift is pressed for capitals and symbols
+//
+// everything on a line is sent one scancode after another as the program reads them, # starts a comment
+func ParseKeyScript(r io.Reader) ([]ScriptedKey, error) {
+	var keys []ScriptedKey
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		timestamp, rest, _ := strings.Cut(text, " ")
+		at, err := strconv.Atoi(timestamp)
+		if err != nil || at < 0 {
+			return nil, fmt.Errorf("line %d: %q isn't a cycle count", line, timestamp)
+		}
+
+		codes, err := parseKeys(strings.TrimSpace(rest))
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", line, err)
+		}
+		for _, code := range codes {
+			keys = append(keys, ScriptedKey{At: at, Code: code})
+		}
+	}
+	return keys, scanner.Err()
+}
+
+// parseKeys turns what happens on one line of a key script into scancodes
+func parseKeys(keys string) ([]uint8, error) {
+	if strings.HasPrefix(keys, "\"") {
+		text, err := strconv.Unquote(keys)
+		if err != nil {
+			return nil, fmt.Errorf("invalid text %s", keys)
+		}
+		return typeText(text)
+	}
+
+	var codes []uint8
+	for _, key := range strings.Fields(keys) {
+		if strings.HasPrefix(key, "0x") {
+			code, err := strconv.ParseUint(key[2:], 16, 8)
+			if err != nil {
+				return nil, fmt.Errorf("invalid scancode %s", key)
+			}
+			codes = append(codes, uint8(code))
+			continue
+		}
+
+		press, release := true, true
+		if len(key) > 1 && (key[0] == '+' || key[0] == '-') {
+			press, release = key[0] == '+', key[0] == '-'
+			key = key[1:]
+		}
+		code, ok := scancodes[strings.ToLower(key)]
+		if !ok {
+			return nil, fmt.Errorf("unknown key %s", key)
+		}
+		if press {
+			codes = append(codes, code)
+		}
+		if release {
+			codes = append(codes, code|0x80)
+		}
+	}
+	return codes, nil
+}
+
+// typeText is the scancodes for typing text on a us keyboard
+func typeText(text string) ([]uint8, error) {
+	var codes []uint8
+	for _, char := range text {
+		key, shifted := string(char), false
+		switch {
+		case char >= 'A' && char <= 'Z':
+			key, shifted = strings.ToLower(key), true
+		case char == ' ':
+			key = "space"
+		case char == '\n' || char == '\r':
+			key = "enter"
+		case char == '\t':
+			key = "tab"
+		case shiftedKeys[char] != "":
+			key, shifted = shiftedKeys[char], true
+		}
+		code, ok := scancodes[key]
+		if !ok {
+			return nil, fmt.Errorf("can't type %q", char)
+		}
+		if shifted {
+			codes = append(codes, scancodes["shift"])
+		}
+		codes = append(codes, code, code|0x80)
+		if shifted {
+			codes = append(codes, scancodes["shift"]|0x80)
+		}
+	}
+	return codes, nil
+}
+
+// Keyboard is an 8042 keyboard controller with a keyboard attached, scancodes come from a script and are put in
+// the output buffer on port 60h one at a time, raising irq 1 for each. Replies to commands go ahead of the script.
+// Only the commands programs use to set the keyboard up are handled and everything sent to the keyboard is acked
+type Keyboard struct {
+	Script      []ScriptedKey `json:"script"` // still to be sent
+	Replies     []uint8       `json:"replies"`
+	Output      uint8         `json:"output"`
+	Full        bool          `json:"full"`
+	CommandByte uint8         `json:"command_byte"` // bit 0 enables irq 1
+	Disabled    bool          `json:"disabled"`
+	// the next write to port 60h is the command byte instead of something for the keyboard
+	SettingCommandByte bool `json:"setting_command_byte"`
+
+	pic *Pic
+}
+
+// NewKeyboard makes a keyboard that sends script, set up the way the bios leaves it with irqs on
+func NewKeyboard(pic *Pic, script []ScriptedKey) *Keyboard {
+	return &Keyboard{Script: script, CommandByte: 0x45, pic: pic}
+}
+
+// Install connects the keyboard controller to its ports and the clock
+func (k *Keyboard) Install() {
+	ConnectPorts(k, keyboardDataPort, keyboardStatusPort)
+	ClockedDevices = append(ClockedDevices, k)
+	SnapshotDevices = append(SnapshotDevices, k)
+}
+
+// StartKeyboard installs a keyboard from command line options, an empty script file name sends nothing and
+// "-" reads the script from stdin
+func StartKeyboard(scriptFileName string) (*Keyboard, error) {
+	var script []ScriptedKey
+	if scriptFileName != "" {
+		r := io.Reader(os.Stdin)
+		if scriptFileName != "-" {
+			file, err := os.Open(scriptFileName)
+			if err != nil {
+				return nil, err
+			}
+			defer file.Close()
+			r = file
+		}
+		var err error
+		if script, err = ParseKeyScript(r); err != nil {
+			return nil, err
+		}
+	}
+	keyboard := NewKeyboard(InterruptController, script)
+	keyboard.Install()
+	return keyboard, nil
+}
+
+// HasInput is true while there's a scancode waiting or still to come from the script
+func (k *Keyboard) HasInput() bool {
+	return k.Full || len(k.Script) > 0
+}
+
+// Take is the bios reading the output buffer itself rather than from an int 09h handler, the irq it raised is
+// withdrawn since nothing is going to handle it
+func (k *Keyboard) Take() (uint8, bool) {
+	if !k.Full {
+		return 0, false
+	}
+	k.Full = false
+	if k.pic != nil {
+		k.pic.Requests &^= 1 << keyboardIrq
+	}
+	return k.Output, true
+}
+
+// send puts a byte in the output buffer for the program to read
+func (k *Keyboard) send(value uint8) {
+	k.Output, k.Full = value, true
+	if k.CommandByte&1 != 0 && k.pic != nil {
+		k.pic.Raise(keyboardIrq)
+	}
+}
+
+func (k *Keyboard) Tick(now int) {
+	switch {
+	case k.Full:
+	case len(k.Replies) > 0:
+		k.send(k.Replies[0])
+		k.Replies = k.Replies[1:]
+	case !k.Disabled && len(k.Script) > 0 && k.Script[0].At <= now:
+		k.send(k.Script[0].Code)
+		k.Script = k.Script[1:]
+	}
+}
+
+func (k *Keyboard) NextEvent(now int) (int, bool) {
+	switch {
+	case k.Full:
+		// nothing else comes until the program reads what's there
+		return 0, false
+	case len(k.Replies) > 0:
+		return now, true
+	case !k.Disabled && len(k.Script) > 0:
+		return max(k.Script[0].At, now), true
+	}
+	return 0, false
+}
+
+func (k *Keyboard) In(port uint16) uint8 {
+	if port == keyboardStatusPort {
+		if k.Full {
+			return keyboardStatus | 1
+		}
+		return keyboardStatus
+	}
+	k.Full = false
+	return k.Output
+}
+
+func (k *Keyboard) Out(port uint16, value uint8) {
+	if port == keyboardStatusPort {
+		k.command(value)
+		return
+	}
+	if k.SettingCommandByte {
+		k.CommandByte, k.SettingCommandByte = value, false
+		return
+	}
+	// the keyboard acks every command and parameter, a reset also passes its self test
+	k.Replies = append(k.Replies, 0xfa)
+	if value == 0xff {
+		k.Replies = append(k.Replies, 0xaa)
+	}
+}
+
+// command handles a controller command written to port 64h
+func (k *Keyboard) command(value uint8) {
+	switch value {
+	case 0x20:
+		k.Replies = append(k.Replies, k.CommandByte)
+	case 0x60:
+		k.SettingCommandByte = true
+	case 0xaa:
+		// controller self test passed
+		k.Replies = append(k.Replies, 0x55)
+	case 0xab:
+		// keyboard interface test passed
+		k.Replies = append(k.Replies, 0x00)
+	case 0xad:
+		k.Disabled = true
+	case 0xae:
+		k.Disabled = false
+	}
+}
+
+func (k *Keyboard) SnapshotName() string {
+	return "keyboard"
+}
+
+func (k *Keyboard) SaveState() (json.RawMessage, error) {
+	return json.Marshal(k)
+}
+
+func (k *Keyboard) LoadState(state json.RawMessage) error {
+	return json.Unmarshal(state, k)
+}
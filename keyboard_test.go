@@ -0,0 +1,63 @@
+package main
+
+import (
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestParseKeyScript(t *testing.T) {
+	// keys builds the scripted keys for codes all sent at one cycle
+	keys := func(at int, codes ...uint8) []ScriptedKey {
+		var keys []ScriptedKey
+		for _, code := range codes {
+			keys = append(keys, ScriptedKey{At: at, Code: code})
+		}
+		return keys
+	}
+	tests := []struct {
+		name   string
+		script string
+		keys   []ScriptedKey
+	}{
+		{"empty", "", nil},
+		{"comments and blank lines", "# cycle keys\n\n   \n", nil},
+		{"names", "1000 a enter", keys(1000, 0x1e, 0x9e, 0x1c, 0x9c)},
+		{"names ignore case", "0 ESC F1", keys(0, 0x01, 0x81, 0x3b, 0xbb)},
+		{"press and release", "2000 +shift a -shift", keys(2000, 0x2a, 0x1e, 0x9e, 0xaa)},
+		{"a lone + or - is a key", "5 - =", keys(5, 0x0c, 0x8c, 0x0d, 0x8d)},
+		{"raw scancodes", "3000 0x1e 0x9e", keys(3000, 0x1e, 0x9e)},
+		{"text", `4000 "Hi!\n"`, keys(4000, 0x2a, 0x23, 0xa3, 0xaa, 0x17, 0x97, 0x2a, 0x02, 0x82, 0xaa, 0x1c, 0x9c)},
+		{"text with a space", `0 "a b"`, keys(0, 0x1e, 0x9e, 0x39, 0xb9, 0x30, 0xb0)},
+		{"several lines", "10 a\n# later\n20 b\n", append(keys(10, 0x1e, 0x9e), keys(20, 0x30, 0xb0)...)},
+	}
+	for _, test := range tests {
+		keys, err := ParseKeyScript(strings.NewReader(test.script))
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if !slices.Equal(keys, test.keys) {
+			t.Errorf("%s: got %v, want %v", test.name, keys, test.keys)
+		}
+	}
+
+	errors := []struct {
+		script string
+		reason string
+	}{
+		{"soon a", "line 1: \"soon\" isn't a cycle count"},
+		{"\n-5 a", "line 2: \"-5\" isn't a cycle count"},
+		{"10 nosuch", "unknown key nosuch"},
+		{"10 +nosuch", "unknown key nosuch"},
+		{"10 0xzz", "invalid scancode 0xzz"},
+		{"10 0x100", "invalid scancode 0x100"},
+		{`10 "unterminated`, "invalid text"},
+		{`10 "é"`, "can't type"},
+	}
+	for _, test := range errors {
+		if _, err := ParseKeyScript(strings.NewReader(test.script)); err == nil || !strings.Contains(err.Error(), test.reason) {
+			t.Errorf("ParseKeyScript(%q) = %v, want an error about %q", test.script, err, test.reason)
+		}
+	}
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// SourceLine is a line of assembly source, Address is only meaningful when the line assembled to something
+type SourceLine struct {
+	File       string `json:"file"`
+	Line       int    `json:"line"`
+	Text       string `json:"text"`
+	Address    uint32 `json:"-"`
+	HasAddress bool   `json:"-"`
+}
+
+func (l SourceLine) String() string {
+	return fmt.Sprintf("%s:%d: %s", l.File, l.Line, strings.TrimSpace(l.Text))
+}
+
+// SourceMap ties addresses back to the source lines they were assembled from, it's empty unless a listing was loaded
+type SourceMap struct {
+	Lines     []SourceLine // every line of the listing in order
+	addresses map[uint32]int
+}
+
+// Sources are used by traces, the debugger and coverage reports
+var Sources = &SourceMap{addresses: map[uint32]int{}}
+
+// Lookup finds the source line that assembled to address
+func (m *SourceMap) Lookup(address uint32) (SourceLine, bool) {
+	i, ok := m.addresses[address]
+	if !ok {
+		return SourceLine{}, false
+	}
+	return m.Lines[i], true
+}
+
+// listingLine matches "  line address bytes source", the address and bytes are missing for lines that don't assemble
+// to anything and bytes ending in - carry on to the next listing line with no source
+var listingLine = regexp.MustCompile(`^\s*(\d+)\s(?:([0-9A-Fa-f]{8})\s([0-9A-Fa-f()\[\]]+|<res\s[0-9A-Fa-f]+>)(-?))?\s*(?:<\d+>\s)?(.*)$`)
+
+// orgDirective matches nasm's org, listings show offsets from the start of the section without it
+var orgDirective = regexp.MustCompile(`(?i)^\s*\[?\s*org\s+([0-9A-Za-z]+)\s*\]?\s*(?:;.*)?$`)
+
+// parseNasmNumber parses the forms of number nasm programs usually write, 256, 0x100 and 100h
+func parseNasmNumber(s string) (uint32, error) {
+	s = strings.ToLower(s)
+	base := 10
+	switch {
+	case strings.HasPrefix(s, "0x"):
+		s, base = s[2:], 16
+	case strings.HasSuffix(s, "h"):
+		s, base = strings.TrimSuffix(s, "h"), 16
+	}
+	value, err := strconv.ParseUint(s, base, 32)
+	return uint32(value), err
+}
+
+// ParseListing reads a nasm -l listing, addresses are offsets from base plus the org the source sets
+func ParseListing(r io.Reader, source string, base uint32) ([]SourceLine, error) {
+	var lines []SourceLine
+	var org uint32
+	previous := 0
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		match := listingLine.FindStringSubmatch(scanner.Text())
+		if match == nil {
+			continue
+		}
+		number, _ := strconv.Atoi(match[1])
+		if number == previous && match[5] == "" {
+			// continuation of the previous line's bytes
+			continue
+		}
+		previous = number
+
+		line := SourceLine{File: source, Line: number, Text: strings.TrimRight(match[5], " \t\r")}
+		if directive := orgDirective.FindStringSubmatch(line.Text); directive != nil {
+			value, err := parseNasmNumber(directive[1])
+			if err != nil {
+				return nil, fmt.Errorf("line %d: can't read the org %q", number, directive[1])
+			}
+			org = value
+		}
+		if match[2] != "" {
+			offset, _ := strconv.ParseUint(match[2], 16, 32)
+			line.Address, line.HasAddress = base+org+uint32(offset), true
+		}
+		lines = append(lines, line)
+	}
+	return lines, scanner.Err()
+}
+
+// Add appends a line, the first line at an address is the one Lookup finds
+func (m *SourceMap) Add(line SourceLine) {
+	if _, seen := m.addresses[line.Address]; line.HasAddress && !seen {
+		m.addresses[line.Address] = len(m.Lines)
+	}
+	m.Lines = append(m.Lines, line)
+}
+
+// LoadListing adds the lines of a nasm -l listing to Sources. The source file is assumed to be the listing's
+// name with an .asm extension since listings don't record it
+func LoadListing(fileName string, base uint32) error {
+	file, err := os.Open(fileName)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	source := strings.TrimSuffix(filepath.Base(fileName), filepath.Ext(fileName)) + ".asm"
+	lines, err := ParseListing(file, source, base)
+	if err != nil {
+		return fmt.Errorf("%s %v", fileName, err)
+	}
+	for _, line := range lines {
+		Sources.Add(line)
+	}
+	return nil
+}
+
+// LoadListingFlag handles a -listing value, file[@segment] like -symbols
+func LoadListingFlag(spec string) error {
+	fileName, base, err := parseFileSegment(spec)
+	if err != nil {
+		return err
+	}
+	return LoadListing(fileName, base)
+}
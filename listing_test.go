@@ -0,0 +1,90 @@
+package main
+
+import (
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestParseListing(t *testing.T) {
+	listing := `     1                                  ; hello.asm
+     2                                  org 100h
+     3 00000000 B409                    mov ah, 9
+     4 00000002 BA[0900]                mov dx, message
+     5 00000005 CD21                    int 21h
+     6 00000007 CD20                    int 20h
+     7 00000009 68656C6C6F2C20776F-     message db "hello, world$"
+     7 00000012 726C6424
+     8 0000000E <res 00000004>          buffer resb 4
+`
+	tests := []struct {
+		name    string
+		listing string
+		base    uint32
+		lines   []SourceLine
+	}{
+		{
+			// listings show offsets from the start of the section, org moves them to where the program runs
+			"com at 1000:0000",
+			listing,
+			0x10000,
+			[]SourceLine{
+				{File: "hello.asm", Line: 1, Text: "; hello.asm"},
+				{File: "hello.asm", Line: 2, Text: "org 100h"},
+				{File: "hello.asm", Line: 3, Text: "mov ah, 9", Address: 0x10100, HasAddress: true},
+				{File: "hello.asm", Line: 4, Text: "mov dx, message", Address: 0x10102, HasAddress: true},
+				{File: "hello.asm", Line: 5, Text: "int 21h", Address: 0x10105, HasAddress: true},
+				{File: "hello.asm", Line: 6, Text: "int 20h", Address: 0x10107, HasAddress: true},
+				{File: "hello.asm", Line: 7, Text: `message db "hello, world$"`, Address: 0x10109, HasAddress: true},
+				{File: "hello.asm", Line: 8, Text: "buffer resb 4", Address: 0x1010e, HasAddress: true},
+			},
+		},
+		{
+			"no org",
+			"     1 00000000 F4                      hlt\n",
+			0,
+			[]SourceLine{{File: "hello.asm", Line: 1, Text: "hlt", HasAddress: true}},
+		},
+		{
+			"bracketed org",
+			"     1                                  [ORG 0x7c00] ; boot sector\n     2 00000000 F4                      hlt\n",
+			0,
+			[]SourceLine{
+				{File: "hello.asm", Line: 1, Text: "[ORG 0x7c00] ; boot sector"},
+				{File: "hello.asm", Line: 2, Text: "hlt", Address: 0x7c00, HasAddress: true},
+			},
+		},
+	}
+	for _, test := range tests {
+		lines, err := ParseListing(strings.NewReader(test.listing), "hello.asm", test.base)
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if !slices.Equal(lines, test.lines) {
+			t.Errorf("%s: got\n%v\nwant\n%v", test.name, lines, test.lines)
+		}
+	}
+
+	if _, err := ParseListing(strings.NewReader("     1                                  org zz\n"), "hello.asm", 0); err == nil {
+		t.Errorf("an org that isn't a number should fail")
+	}
+}
+
+func TestParseNasmNumber(t *testing.T) {
+	tests := []struct {
+		s    string
+		want uint32
+	}{
+		{"256", 256},
+		{"0x100", 0x100},
+		{"100h", 0x100},
+		{"0100H", 0x100},
+		{"7C00h", 0x7c00},
+	}
+	for _, test := range tests {
+		if value, err := parseNasmNumber(test.s); err != nil || value != test.want {
+			t.Errorf("parseNasmNumber(%q) = %x, %v want %x", test.s, value, err, test.want)
+		}
+	}
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// Program is where a loader put a program in memory, the run stops once cs:ip reaches End
+type Program struct {
+	Format  string `json:"format"` // flat, com or exe
+	Start   int    `json:"start"`
+	End     int    `json:"end"`
+	Entries []int  `json:"entries"` // addresses control flow decoding starts from
+}
+
+// dosSegment is where .com and .exe programs get their psp, low memory is left free for the interrupt vector table
+const dosSegment = 0x1000
+
+// dosMemoryEnd is the segment after the last paragraph dos programs can use, the 640k conventional memory limit
+// or the end of memory when there's less than that
+func dosMemoryEnd() uint16 {
+	return uint16(min(0xa000, len(MemoryValues.Bytes)/16))
+}
+
+// Loaders pick how to load a program from its file extension
+var Loaders = map[string]func(fileName string) (Program, error){
+	".com": func(fileName string) (Program, error) { return LoadCom(fileName, dosSegment) },
+	".exe": func(fileName string) (Program, error) { return LoadExe(fileName, dosSegment) },
+	".hex": LoadHex,
+}
+
+// LoadProgram loads a program with the loader for its extension, anything unknown is a flat binary at address 0
+func LoadProgram(fileName string) (Program, error) {
+	if loader, ok := Loaders[strings.ToLower(filepath.Ext(fileName))]; ok {
+		return loader(fileName)
+	}
+	program, err := LoadInstructions(fileName, 0)
+	program.Entries = []int{0}
+	StartStack()
+	keepStackOff(program)
+	return program, err
+}
+
+// LoadInstructions copies a raw image into memory at address, it has no entry point of its own
+func LoadInstructions(fileName string, address uint32) (Program, error) {
+	file, err := os.ReadFile(fileName)
+	if err != nil {
+		return Program{}, err
+	}
+	if int(address)+len(file) > len(MemoryValues.Bytes) {
+		return Program{}, fmt.Errorf("%d bytes at %05x runs past the end of memory", len(file), address)
+	}
+
+	copy(MemoryValues.Bytes[address:], file)
+	return Program{Format: "flat", Start: int(address), End: int(address) + len(file)}, nil
+}
+
+// Merge combines two programs loaded into memory side by side, the first one's format wins
+func (p Program) Merge(other Program) Program {
+	if p.Format == "" {
+		return other
+	}
+	p.Start = min(p.Start, other.Start)
+	p.End = max(p.End, other.End)
+	p.Entries = append(slices.Clone(p.Entries), other.Entries...)
+	return p
+}
+
+// LoadPrograms loads the program file if there is one then each `file@segment:offset` load spec, a spec without an
+// address goes through LoadProgram, then the rom specs. entry is an optional cs:ip to start at instead of what the
+// loaders set
+func LoadPrograms(fileName string, loadSpecs, romSpecs []string, entry string) (Program, error) {
+	var program Program
+	if fileName != "" {
+		loaded, err := LoadProgram(fileName)
+		if err != nil {
+			return Program{}, err
+		}
+		program = loaded
+	}
+
+	for _, spec := range loadSpecs {
+		var loaded Program
+		var err error
+		if at := strings.LastIndex(spec, "@"); at != -1 {
+			var address uint32
+			if address, err = ParseAddress(spec[at+1:]); err != nil {
+				return Program{}, fmt.Errorf("invalid load address in %q: %v", spec, err)
+			}
+			loaded, err = LoadInstructions(spec[:at], address)
+		} else {
+			loaded, err = LoadProgram(spec)
+		}
+		if err != nil {
+			return Program{}, err
+		}
+		program = program.Merge(loaded)
+	}
+
+	if len(romSpecs) > 0 {
+		roms, err := LoadRoms(romSpecs)
+		if err != nil {
+			return Program{}, err
+		}
+		program = program.Merge(roms)
+	}
+
+	if entry != "" {
+		segment, offset, found := strings.Cut(entry, ":")
+		if !found {
+			return Program{}, fmt.Errorf("entry %q should be cs:ip", entry)
+		}
+		cs, err := ParseSegmentValue(segment)
+		if err != nil {
+			return Program{}, err
+		}
+		ip, err := ParseSegmentValue(offset)
+		if err != nil {
+			return Program{}, err
+		}
+		WriteU16(RegisterValues[Register_cs], 0, cs)
+		WriteU16(RegisterValues[Register_ip], 0, ip)
+		program.Entries = append(program.Entries, int(InstructionAddress()))
+	}
+	return program, nil
+}
+
+// InstallHandlers sets up the go interrupt handlers the program's format expects, they aren't part of
+// memory so restoring a snapshot needs to call this again
+func (p Program) InstallHandlers() {
+	switch p.Format {
+	case "com", "exe":
+		// int 20h is the old way for dos programs to exit
+		InterruptHandlers[0x20] = func() { Halted = true }
+	}
+}
+
+// LoadCom loads a dos .com program the way dos would, a 256 byte psp at segment:0000 followed by the
+// program at segment:0100 with every segment register pointing at the psp. A zero is pushed so a final
+// ret lands on the int 20h at the start of the psp which ends the run
+func LoadCom(fileName string, segment uint16) (Program, error) {
+	file, err := os.ReadFile(fileName)
+	if err != nil {
+		return Program{}, err
+	}
+	// the program, psp and the word of stack all share one 64k segment
+	if len(file) > 0x10000-0x100-2 {
+		return Program{}, fmt.Errorf("%d bytes is too big for a .com program", len(file))
+	}
+	if int(segment)+0x1000 > int(dosMemoryEnd()) {
+		return Program{}, fmt.Errorf("not enough memory for the 64k segment a .com program gets")
+	}
+
+	psp := writePsp(segment, dosMemoryEnd())
+	copy(MemoryValues.Bytes[psp+0x100:], file)
+
+	for _, register := range []Register{Register_cs, Register_ds, Register_es, Register_ss} {
+		WriteU16(RegisterValues[register], 0, segment)
+	}
+	WriteU16(RegisterValues[Register_ip], 0, 0x100)
+	WriteU16(RegisterValues[Register_sp], 0, 0)
+	StartStack()
+	PushValueToStack(0)
+
+	program := Program{
+		Format:  "com",
+		Start:   int(psp),
+		End:     int(psp) + 0x100 + len(file),
+		Entries: []int{int(psp), int(psp) + 0x100},
+	}
+	keepStackOff(program)
+	program.InstallHandlers()
+	return program, nil
+}
+
+// writePsp fills in the parts of a program segment prefix programs look at and returns its physical address,
+// memoryEnd is the segment after the memory dos gave the program
+func writePsp(segment, memoryEnd uint16) uint32 {
+	psp := uint32(segment) << 4
+	MemoryValues.Poke(psp, 0x20cd, true)      // int 20h
+	MemoryValues.Poke(psp+2, memoryEnd, true) // segment after the end of our memory
+	MemoryValues.Poke(psp+0x80, 0, false)     // empty command tail
+	MemoryValues.Poke(psp+0x81, 0x0d, false)
+	return psp
+}
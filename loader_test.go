@@ -0,0 +1,103 @@
+package main
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestLoadAtDocumentedAddresses(t *testing.T) {
+	// the forms from the -load, -rom and -entry help
+	code := []byte{0xb8, 0x01, 0x00, 0xf4}
+	tests := []struct {
+		load, rom, entry string
+		address          uint32
+		cs, ip           uint16
+	}{
+		{"@f000:0000", "", "f000:0", 0xf0000, 0xf000, 0},
+		{"@0xf000:0x10", "", "0xf000:0x10", 0xf0010, 0xf000, 0x10},
+		{"", "@f000:fff0", "f000:fff0", 0xffff0, 0xf000, 0xfff0},
+		{"@9000:0", "", "9000:0", 0x90000, 0x9000, 0},
+	}
+	for _, test := range tests {
+		ResetMachine()
+		fileName := writeProgram(t, "h.bin", code)
+		var loads, roms []string
+		if test.load != "" {
+			loads = append(loads, fileName+test.load)
+		}
+		if test.rom != "" {
+			roms = append(roms, fileName+test.rom)
+		}
+		program, err := LoadPrograms("", loads, roms, test.entry)
+		if err != nil {
+			t.Errorf("%s%s -entry %s: %v", test.load, test.rom, test.entry, err)
+			continue
+		}
+		if program.Start != int(test.address) || MemoryValues.Peek(test.address, true) != 0x01b8 {
+			t.Errorf("%s%s: loaded at %05x, want %05x", test.load, test.rom, program.Start, test.address)
+		}
+		cs, ip := ReadU16(RegisterValues[Register_cs], 0), ReadU16(RegisterValues[Register_ip], 0)
+		if cs != test.cs || ip != test.ip {
+			t.Errorf("-entry %s: starts at %04x:%04x, want %04x:%04x", test.entry, cs, ip, test.cs, test.ip)
+		}
+	}
+
+	ResetMachine()
+	for _, entry := range []string{"f000", "f000:zz", "g000:0"} {
+		if _, err := LoadPrograms("", nil, nil, entry); err == nil {
+			t.Errorf("-entry %s should have failed", entry)
+		}
+	}
+}
+
+func TestLoadCom(t *testing.T) {
+	ResetMachine()
+	// ret, which should go back to the int 20h at the start of the psp
+	code := []byte{0xc3}
+	program, err := LoadProgram(writeProgram(t, "a.com", code))
+	if err != nil {
+		t.Fatal(err)
+	}
+	psp := uint32(dosSegment) << 4
+	if program.Format != "com" || program.Start != int(psp) || program.End != int(psp)+0x101 ||
+		!slices.Equal(program.Entries, []int{int(psp), int(psp) + 0x100}) {
+		t.Errorf("loaded %+v", program)
+	}
+
+	psps := []struct {
+		name   string
+		offset uint32
+		wide   bool
+		value  uint16
+	}{
+		{"int 20h", 0, true, 0x20cd},
+		{"end of memory", 2, true, 0xa000},
+		{"command tail length", 0x80, false, 0},
+		{"command tail", 0x81, false, 0x0d},
+		{"the program", 0x100, false, 0xc3},
+	}
+	for _, test := range psps {
+		if value := MemoryValues.Peek(psp+test.offset, test.wide); value != test.value {
+			t.Errorf("%s at psp+%x is %x, want %x", test.name, test.offset, value, test.value)
+		}
+	}
+
+	for _, register := range []Register{Register_cs, Register_ds, Register_es, Register_ss} {
+		if value := ReadU16(RegisterValues[register], 0); value != dosSegment {
+			t.Errorf("%s is %04x, want the psp's segment", RegisterName(register), value)
+		}
+	}
+	// sp starts at 0, the top of the segment, then the zero the final ret pops is pushed
+	sp := ReadU16(RegisterValues[Register_sp], 0)
+	if ip := ReadU16(RegisterValues[Register_ip], 0); ip != 0x100 || sp != 0xfffe || MemoryValues.Peek(psp+0xfffe, true) != 0 {
+		t.Errorf("starts at ip %04x with sp %04x, want ip 0100 and a zero pushed at fffe", ip, sp)
+	}
+
+	disassembly := DecodeFlow(MemoryValues.Bytes, program.Start, program.End, program.Entries...)
+	for i := 0; i < 2 && !Halted; i++ {
+		Step(disassembly.Instructions, []bool{false, false, false})
+	}
+	if !Halted || InstructionAddress() != psp+2 {
+		t.Errorf("the ret went to %05x and halted is %v, want the int 20h in the psp to end the run", InstructionAddress(), Halted)
+	}
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+)
+
+// MachineOptions are the command line options that set up memory, devices, the bios and what gets loaded,
+// every command that simulates takes the same ones
+type MachineOptions struct {
+	Loads    RepeatedFlag
+	Roms     RepeatedFlag
+	Entry    string
+	Snapshot string // resume from this snapshot instead of loading a program
+
+	MemorySize   string
+	A20          bool
+	Unmapped     string
+	StackBase    string
+	StackLimit   string
+	DebugConsole string
+
+	Bios         bool
+	KeysFileName string
+	KbdFileName  string
+	DiskFileName string
+	DosRoot      string
+	Screen       bool // the screen is shown so the bios clears it up front instead of on the first int 10h call
+
+	SymbolsFileName string
+	ListingFileName string
+}
+
+// AddFlags defines the machine options on flags
+func (o *MachineOptions) AddFlags(flags *flag.FlagSet) {
+	flags.Var(&o.Loads, "load", "load a raw image at an address e.g. rom.bin@f000:0000, or any program without the @ (repeatable)")
+	flags.Var(&o.Roms, "rom", "load an image at an address like -load and make it read only e.g. bios.bin@f000:0000 (repeatable)")
+	flags.StringVar(&o.Entry, "entry", "", "cs:ip to start at instead of the loader's entry point e.g. f000:fff0")
+	flags.StringVar(&o.MemorySize, "memory", "1m", "how much memory there is e.g. 640k, anything past it is unmapped")
+	flags.BoolVar(&o.A20, "a20", false, "let addresses past 1MB through instead of wrapping them round to 0")
+	flags.StringVar(&o.Unmapped, "unmapped", "zero", "what accessing unmapped memory does, zero, fault or log")
+	flags.StringVar(&o.StackBase, "stack-base", "", "offset in ss the stack grows down from, sp with nothing pushed (default where the loader puts sp)")
+	flags.StringVar(&o.StackLimit, "stack-limit", "", "lowest offset in ss sp can reach before pushing faults (default the end of the program or 0)")
+	flags.StringVar(&o.DebugConsole, "debugcon", "", "address of a byte that prints whatever the program writes to it e.g. 0xf000:0")
+	flags.BoolVar(&o.Bios, "bios", true, "handle bios (int 10h, 13h, 16h, 1ah) and dos (int 21h) calls in go, turn off for programs that bring their own")
+	flags.StringVar(&o.KeysFileName, "keys", "", "file of keystrokes for int 16h to hand out, - reads stdin")
+	flags.StringVar(&o.KbdFileName, "kbd", "", "script of timestamped scancodes for the port 60h keyboard to send, - reads stdin")
+	flags.StringVar(&o.DiskFileName, "disk", "", "disk image int 13h reads sectors from")
+	flags.StringVar(&o.DosRoot, "dos-root", ".", "host directory int 21h file calls are kept inside")
+	flags.StringVar(&o.SymbolsFileName, "symbols", "", "label addresses from a nasm map file or `address name` lines, file@segment picks the segment offsets are from")
+	flags.StringVar(&o.ListingFileName, "listing", "", "show source lines from a nasm -l listing, file@segment picks the segment offsets are from")
+}
+
+// setupMachine resets the machine, installs the devices and bios then loads the program (or the snapshot) with its
+// symbols and listing. Dos is returned for its exit code and the bios under it, it's nil when -bios is off
+func setupMachine(programFileName string, options MachineOptions) (Program, *Dos, error) {
+	ResetMachine()
+	// devices and the bios go in first so a snapshot can restore their state
+	if err := SetupMemory(options.MemorySize, options.A20, options.Unmapped); err != nil {
+		return Program{}, nil, err
+	}
+	if err := StartDebugConsole(options.DebugConsole); err != nil {
+		return Program{}, nil, fmt.Errorf("invalid -debugcon %v", err)
+	}
+	InstallTimer()
+	keyboard, err := StartKeyboard(options.KbdFileName)
+	if err != nil {
+		return Program{}, nil, fmt.Errorf("failed to read the keyboard script %v", err)
+	}
+	var dos *Dos
+	if options.Bios {
+		bios, err := StartBios(options.KeysFileName, options.DiskFileName, keyboard)
+		if err != nil {
+			return Program{}, nil, fmt.Errorf("failed to start the bios %v", err)
+		}
+		if options.Screen {
+			bios.InitVideo()
+		}
+		// dos sits on top of the bios for its console io
+		dos = NewDos(bios, os.Stderr, options.DosRoot)
+		dos.Install()
+	}
+
+	var program Program
+	if options.Snapshot != "" {
+		if len(options.Loads) > 0 || len(options.Roms) > 0 {
+			return Program{}, nil, fmt.Errorf("-load and -rom can't be used with a snapshot, its memory and roms are in it")
+		}
+		snapshot, err := LoadSnapshot(options.Snapshot)
+		if err != nil {
+			return Program{}, nil, fmt.Errorf("failed to load snapshot from %s\n%v", options.Snapshot, err)
+		}
+		program = snapshot.Program
+	} else {
+		var err error
+		if program, err = LoadPrograms(programFileName, options.Loads, options.Roms, options.Entry); err != nil {
+			return Program{}, nil, fmt.Errorf("failed to load instructions from %s\n%v", programFileName, err)
+		}
+	}
+	if err := SetStackBounds(options.StackBase, options.StackLimit); err != nil {
+		return Program{}, nil, err
+	}
+	if options.SymbolsFileName != "" {
+		if err := LoadSymbolsFlag(options.SymbolsFileName); err != nil {
+			return Program{}, nil, fmt.Errorf("failed to load symbols from %s\n%v", options.SymbolsFileName, err)
+		}
+	}
+	if options.ListingFileName != "" {
+		if err := LoadListingFlag(options.ListingFileName); err != nil {
+			return Program{}, nil, fmt.Errorf("failed to load listing from %s\n%v", options.ListingFileName, err)
+		}
+	}
+	return program, dos, nil
+}
+
+// Machine holds everything the simulator keeps in globals for one pc, so more than one can be run side by side
+// by activating each in turn
+type Machine struct {
+	memory    Memory
+	a20       bool
+	registers Registers
+	flags     CpuFlags
+
+	totalCycles        int
+	elapsedCycles      int
+	tookJump           bool
+	halted             bool
+	fault              *Fault
+	interruptShadow    bool
+	runtimeEntries     map[uint32]bool
+	currentInstruction Instruction
+	currentIP          uint16
+	stack              StackBounds
+	calls              CallStack
+
+	interruptHandlers   map[uint8]func()
+	executionObservers  []ExecutionObserver
+	ports               map[uint16]PortDevice
+	clockedDevices      []ClockedDevice
+	snapshotDevices     []SnapshotDevice
+	interruptController *Pic
+
+	symbols *SymbolTable
+	sources *SourceMap
+}
+
+// SaveMachine captures the machine the simulator is running now
+func SaveMachine() *Machine {
+	return &Machine{
+		memory:              MemoryValues,
+		a20:                 A20,
+		registers:           RegisterValues,
+		flags:               CpuFlagValues,
+		totalCycles:         totalCycles,
+		elapsedCycles:       ElapsedCycles,
+		tookJump:            tookJump,
+		halted:              Halted,
+		fault:               CpuFault,
+		interruptShadow:     interruptShadow,
+		runtimeEntries:      runtimeEntries,
+		currentInstruction:  CurrentInstruction,
+		currentIP:           CurrentIP,
+		stack:               Stack,
+		calls:               Calls,
+		interruptHandlers:   InterruptHandlers,
+		executionObservers:  ExecutionObservers,
+		ports:               Ports,
+		clockedDevices:      ClockedDevices,
+		snapshotDevices:     SnapshotDevices,
+		interruptController: InterruptController,
+		symbols:             Symbols,
+		sources:             Sources,
+	}
+}
+
+// Activate makes m the machine the simulator runs, save the current one first to come back to it
+func (m *Machine) Activate() {
+	MemoryValues = m.memory
+	A20 = m.a20
+	RegisterValues = m.registers
+	CpuFlagValues = m.flags
+	totalCycles = m.totalCycles
+	ElapsedCycles = m.elapsedCycles
+	tookJump = m.tookJump
+	Halted = m.halted
+	CpuFault = m.fault
+	interruptShadow = m.interruptShadow
+	runtimeEntries = m.runtimeEntries
+	CurrentInstruction = m.currentInstruction
+	CurrentIP = m.currentIP
+	Stack = m.stack
+	Calls = m.calls
+	InterruptHandlers = m.interruptHandlers
+	ExecutionObservers = m.executionObservers
+	Ports = m.ports
+	ClockedDevices = m.clockedDevices
+	SnapshotDevices = m.snapshotDevices
+	InterruptController = m.interruptController
+	Symbols = m.symbols
+	Sources = m.sources
+}
+
+// NewMachine switches to a machine that shares no registers, memory or tables with the current one, save the
+// current one first to keep it
+func NewMachine() {
+	registers := Registers{}
+	for register := range RegisterValues {
+		registers[register] = make([]uint8, 2)
+	}
+	flags := CpuFlags{}
+	for flag := range CpuFlagValues {
+		flags[flag] = false
+	}
+	(&Machine{
+		memory:    Memory{Bytes: make([]uint8, len(MemoryValues.Bytes))},
+		registers: registers,
+		flags:     flags,
+		calls:     CallStack{Log: Calls.Log},
+		symbols:   &SymbolTable{},
+		sources:   &SourceMap{addresses: map[uint32]int{}},
+	}).Activate()
+	ResetMachine()
+}
@@ -4,17 +4,21 @@ import (
 	_ "embed"
 	"flag"
 	"fmt"
+	"io"
 	"os"
+	"strings"
 )
 
-func LoadInstructions(fileName string) (int, error) {
-	file, err := os.ReadFile(fileName)
-	if err != nil {
-		return 0, err
-	}
+// RepeatedFlag collects every value of a flag that can be given more than once
+type RepeatedFlag []string
+
+func (f *RepeatedFlag) String() string {
+	return strings.Join(*f, ", ")
+}
 
-	copy(MemoryValues.Bytes[0:len(file)], file)
-	return len(file), nil
+func (f *RepeatedFlag) Set(value string) error {
+	*f = append(*f, value)
+	return nil
 }
 
 const (
@@ -23,41 +27,220 @@ const (
 	ShowInstBytes
 )
 
+// runProgram simulates until the program ends or a breakpoint fires, watchpoint hits are printed as they happen
+func runProgram(instructions map[int]Instruction, program Program, breakpointSpecs, watchpointSpecs []string, showEffect []bool) error {
+	breakpoints := &Breakpoints{}
+	for _, spec := range breakpointSpecs {
+		if _, err := breakpoints.Add(spec); err != nil {
+			return fmt.Errorf("invalid breakpoint %q: %v", spec, err)
+		}
+	}
+
+	watchpoints := NewWatchpoints(&MemoryValues)
+	for _, spec := range watchpointSpecs {
+		if _, err := watchpoints.Add(spec); err != nil {
+			return fmt.Errorf("invalid watchpoint %q: %v", spec, err)
+		}
+	}
+
+	ip := func() uint16 { return ReadU16(RegisterValues[Register_ip], 0) }
+	address := InstructionAddress
+	defer func() {
+		// something the simulator can't handle yet, show where the program was before the go stack trace
+		if r := recover(); r != nil {
+			fmt.Print(Calls.Backtrace())
+			panic(r)
+		}
+	}()
+	//  while the IP is within the range of memory keep doing stuff
+	for {
+		stop := Run(instructions, program.End, breakpoints, watchpoints, showEffect)
+		if stop.Watches != nil {
+			// watchpoints are only reported, keep going
+			for _, hit := range stop.Watches {
+				fmt.Println(hit)
+			}
+			continue
+		}
+
+		if stop.Breakpoint != nil {
+			fmt.Printf("breakpoint %s at ip %x: %s\n", stop.Breakpoint, ip(), instructions[int(address())])
+			fmt.Print(Calls.Backtrace())
+		} else if CpuFault != nil {
+			fmt.Println(CpuFault)
+			fmt.Print(Calls.Backtrace())
+		} else if Halted && CurrentInstruction.Op == Op_hlt && len(Calls.Frames) > 0 {
+			// a hlt inside a call is usually the program giving up somewhere it shouldn't be
+			fmt.Printf("halted at ip %x\n", ip())
+			fmt.Print(Calls.Backtrace())
+		} else if !Halted && address() < uint32(program.End) {
+			fmt.Printf("stopping: ip %x is not the start of a decoded instruction\n", ip())
+		}
+		return nil
+	}
+}
+
 func main() {
+	// subcommands get their own flags, anything else is the plain simulator
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "cfg":
+			RunCfgCommand(os.Args[2:])
+			return
+		case "debug":
+			RunDebugCommand(os.Args[2:])
+			return
+		case "tracediff":
+			RunTraceDiffCommand(os.Args[2:])
+			return
+		}
+	}
+
+	os.Exit(runSimulator())
+}
+
+// runSimulator is the plain simulator, the exit status is the one a dos program gave or 1 if the run couldn't start
+func runSimulator() int {
 	dumpMemory := flag.Bool("savemem", false, "save final memory state to .DATA file")
 	dumpRegisters := flag.Bool("dumpreg", false, "output final register state")
 	showInstructions := flag.Bool("print", false, "show instructions and their effect")
 	showCycles := flag.Bool("cycles", false, "show # of cycles required to execute instruction")
 	showInstBytes := flag.Bool("instbytes", false, "show the bytes that make up the instruction")
+	var breakpointSpecs RepeatedFlag
+	flag.Var(&breakpointSpecs, "break", "stop before an address, opcode or condition e.g. 0x1b, call, \"0x1b if ax == 0\" (repeatable)")
+	var watchpointSpecs RepeatedFlag
+	flag.Var(&watchpointSpecs, "watch", "report accesses to memory e.g. \"w 0x9c3e,2\", kinds are r, w, rw and change (repeatable)")
+	traceFileName := flag.String("trace", "", "write a json lines record of every executed instruction to this file")
+	gdbAddress := flag.String("gdb", "", "wait for gdb to connect on this address (e.g. :1234) and let it control the run")
+	loadSnapshotFileName := flag.String("load-snapshot", "", "resume from a snapshot instead of loading a program, the file argument is optional")
+	saveSnapshotFileName := flag.String("save-snapshot", "", "save registers, flags, memory and cycle counts to this file when the run stops")
+	showDisassembly := flag.Bool("disasm", false, "print the control flow disassembly and basic blocks instead of simulating")
+	pngFileName := flag.String("png", "", "write the -fb framebuffer to this png when the run ends")
+	framebufferSpec := flag.String("fb", "format=rgba", "framebuffer for -png e.g. offset=256,width=64,height=64,format=rgba, formats are rgba, rgb, gray, cga and mode13h")
+	var pngAtSpecs RepeatedFlag
+	flag.Var(&pngAtSpecs, "png-at", "also write numbered pngs before instructions matching this breakpoint spec (repeatable)")
+	screen := flag.String("screen", "", "show the 80x25 text screen at b800:0000, live redraws it as the program runs and final prints it at the end")
+	var options MachineOptions
+	options.AddFlags(flag.CommandLine)
 	flag.Parse()
 
 	var programFileName string
 	if len(flag.Args()) > 0 {
 		programFileName = flag.Args()[0]
+	} else if *loadSnapshotFileName != "" {
+		programFileName = *loadSnapshotFileName
+	} else if specs := append(options.Loads, options.Roms...); len(specs) > 0 {
+		programFileName, _, _ = strings.Cut(specs[0], "@")
 	} else {
 		fmt.Println("Error: no file provided")
 		flag.PrintDefaults()
-		return
+		return 1
+	}
+	if len(pngAtSpecs) > 0 && *pngFileName == "" {
+		// the numbered pngs are named after -png so there'd be nowhere to write them
+		fmt.Println("Error: -png-at needs -png to name the images")
+		return 1
 	}
 
-	length, err := LoadInstructions(programFileName)
+	options.Snapshot = *loadSnapshotFileName
+	options.Screen = *screen != ""
+	program, dos, err := setupMachine(flag.Arg(0), options)
 	if err != nil {
-		fmt.Printf("failed to load instructions from %s\n%v\n", programFileName, err)
-		return
+		fmt.Println("Error:", err)
+		return 1
+	}
+	if dos != nil && *screen == "live" {
+		// teletype text would scroll the screen we're drawing
+		dos.Bios.Out = io.Discard
 	}
 
-	At := 0
-	instructions := Decode(MemoryValues.Bytes, &At)
+	// only decode what's reachable from the entry point so data in the program isn't treated as code,
+	// a resumed snapshot can be part way through so decode from cs:ip too
+	disassembly := DecodeFlow(MemoryValues.Bytes, program.Start, program.End, append(program.Entries, int(InstructionAddress()))...)
+	if *showDisassembly {
+		fmt.Print(disassembly)
+		return 0
+	}
+	instructions := disassembly.Instructions
 
-	//  while the IP is within the range of memory keep doing stuff
-	for ReadU16(RegisterValues[Register_ip], 0) < uint16(length) {
-		Simulate(instructions[int(ReadU16(RegisterValues[Register_ip], 0))], []bool{*showInstructions, *showCycles, *showInstBytes})
+	if *traceFileName != "" {
+		traceFile, err := os.Create(*traceFileName)
+		if err != nil {
+			fmt.Println("Error: failed to create trace file", err)
+			return 1
+		}
+		defer traceFile.Close()
+
+		tracer := NewTracer(traceFile, &MemoryValues)
+		defer func() {
+			if err := tracer.Flush(); err != nil {
+				fmt.Println("Error: failed to write trace", err)
+			}
+		}()
+	}
+
+	var framebuffer Framebuffer
+	var capture *PngCapture
+	if *pngFileName != "" {
+		if framebuffer, err = ParseFramebuffer(*framebufferSpec); err != nil {
+			fmt.Println("Error: invalid -fb", err)
+			return 1
+		}
+		if capture, err = NewPngCapture(framebuffer, *pngFileName, pngAtSpecs); err != nil {
+			fmt.Println("Error:", err)
+			return 1
+		}
+	}
+
+	var liveScreen *LiveScreen
+	switch *screen {
+	case "":
+	case "live":
+		liveScreen = NewLiveScreen(os.Stdout)
+	case "final":
+	default:
+		fmt.Printf("Error: -screen should be live or final, not %q\n", *screen)
+		return 1
+	}
+
+	if *gdbAddress != "" {
+		if err := ServeGdb(*gdbAddress, disassembly, program); err != nil {
+			fmt.Println("Error: gdb server failed", err)
+			return 1
+		}
+	} else if err := runProgram(instructions, program, breakpointSpecs, watchpointSpecs, []bool{*showInstructions, *showCycles, *showInstBytes}); err != nil {
+		fmt.Println("Error:", err)
+		return 1
+	}
+
+	if capture != nil {
+		if capture.Err != nil {
+			fmt.Println("Error: failed to write png", capture.Err)
+		}
+		fmt.Println("saving framebuffer to", *pngFileName)
+		if err := framebuffer.WritePng(*pngFileName, MemoryValues.Bytes); err != nil {
+			fmt.Println("Error: failed to write png", err)
+		}
+	}
+
+	if liveScreen != nil {
+		liveScreen.Draw()
+	} else if *screen == "final" {
+		fmt.Print(RenderTextScreen(MemoryValues.Bytes))
+	}
+
+	if *saveSnapshotFileName != "" {
+		fmt.Println("saving snapshot to", *saveSnapshotFileName)
+		if err := SaveSnapshot(*saveSnapshotFileName, program); err != nil {
+			fmt.Println("Error: failed to save snapshot", err)
+		}
 	}
 
 	if *dumpRegisters {
 		fmt.Println()
 		fmt.Println(RegisterValues)
 		fmt.Println(CpuFlagValues)
+		fmt.Print(StackView(16))
 	}
 
 	if *dumpMemory {
@@ -69,4 +252,9 @@ func main() {
 			fmt.Println("Error: failed to save program's memory", err)
 		}
 	}
+
+	if dos != nil {
+		return int(dos.ExitCode)
+	}
+	return 0
 }
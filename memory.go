@@ -1,28 +1,274 @@
 package main
 
-import "fmt"
+import (
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
 
 type Memory struct {
-	Bytes []uint8
+	Bytes    []uint8
+	Log      io.Writer      // writes rom ignored and unmapped accesses are reported here, nil to not report them
+	Unmapped UnmappedPolicy // what happens when the program goes past the end of Bytes
+
+	observers []func(MemoryAccess)
+	regions   []Region
+}
+
+// UnmappedPolicy is what accessing an address with no memory behind it does
+type UnmappedPolicy int
+
+const (
+	UnmappedZero  UnmappedPolicy = iota // reads are 0 and writes go nowhere
+	UnmappedFault                       // the program stops with a fault
+	UnmappedLog                         // like zero but every access is reported
+)
+
+var unmappedPolicies = map[string]UnmappedPolicy{"zero": UnmappedZero, "fault": UnmappedFault, "log": UnmappedLog}
+
+// ParseUnmappedPolicy parses zero, fault or log
+func ParseUnmappedPolicy(name string) (UnmappedPolicy, error) {
+	policy, ok := unmappedPolicies[name]
+	if !ok {
+		return 0, fmt.Errorf("unmapped access should be zero, fault or log, not %q", name)
+	}
+	return policy, nil
+}
+
+// maxMemorySize is as far as an 8086 segment:offset can reach, ffff:ffff, with a20 on
+const maxMemorySize = 0x10fff0
+
+// A20 lets addresses past 1MB through instead of wrapping round to 0 like an 8086 does,
+// they only reach memory if it's been made bigger than 1MB
+var A20 = false
+
+// WrapAddress is the address the cpu puts on the bus, only 20 bits of it without a20
+func WrapAddress(address uint32) uint32 {
+	if A20 {
+		return address
+	}
+	return address & 0xFFFFF
+}
+
+// Physical is the bus address of offset in the segment starting at base
+func Physical(base uint32, offset uint16) uint32 {
+	return WrapAddress(base + uint32(offset))
+}
+
+// ParseMemorySize reads a size in bytes, with a k or m suffix for kilobytes or megabytes
+func ParseMemorySize(size string) (int, error) {
+	multiplier := 1
+	switch {
+	case strings.HasSuffix(strings.ToLower(size), "k"):
+		multiplier, size = 1024, size[:len(size)-1]
+	case strings.HasSuffix(strings.ToLower(size), "m"):
+		multiplier, size = 1024*1024, size[:len(size)-1]
+	}
+	value, err := strconv.ParseInt(size, 0, 32)
+	if err != nil {
+		return 0, fmt.Errorf("invalid memory size %q", size)
+	}
+	bytes := int(value) * multiplier
+	if bytes <= 0 || bytes > maxMemorySize {
+		return 0, fmt.Errorf("memory size %d should be between 1 and %d bytes", bytes, maxMemorySize)
+	}
+	return bytes, nil
+}
+
+// SetMemorySize replaces memory with size bytes of zeroes, anything above it is unmapped
+func SetMemorySize(size int) {
+	MemoryValues.Bytes = make([]uint8, size)
+}
+
+// SetupMemory configures memory from command line options, unmapped accesses and ignored rom writes are logged to stderr
+func SetupMemory(size string, a20 bool, unmapped string) error {
+	bytes, err := ParseMemorySize(size)
+	if err != nil {
+		return err
+	}
+	policy, err := ParseUnmappedPolicy(unmapped)
+	if err != nil {
+		return err
+	}
+	SetMemorySize(bytes)
+	A20 = a20
+	MemoryValues.Unmapped = policy
+	MemoryValues.Log = os.Stderr
+	return nil
+}
+
+type MemoryAccessKind int
+
+const (
+	MemoryRead MemoryAccessKind = iota
+	MemoryWrite
+)
+
+func (k MemoryAccessKind) String() string {
+	if k == MemoryRead {
+		return "read"
+	}
+	return "write"
+}
+
+// MemoryAccess describes one read or write made by the simulated program, for reads Old and New are the same
+type MemoryAccess struct {
+	Kind    MemoryAccessKind
+	Address uint32
+	Wide    bool
+	Old     uint16
+	New     uint16
+}
+
+// Fetch reads an instruction byte through whatever is mapped at address, it doesn't notify observers. Past the
+// end of memory it panics like indexing Bytes would, the decoder takes that as an instruction running off the end
+func (m *Memory) Fetch(address uint32) uint8 {
+	if region := m.regionAt(address); region != nil && region.OnRead != nil {
+		return region.OnRead(address)
+	}
+	return m.Bytes[address]
+}
+
+// Size is how many bytes of memory there are, addresses from there up are unmapped
+func (m *Memory) Size() int {
+	return len(m.Bytes)
+}
+
+// Observe registers f to be called after every Read and Write
+func (m *Memory) Observe(f func(MemoryAccess)) {
+	m.observers = append(m.observers, f)
+}
+
+func (m *Memory) notify(access MemoryAccess) {
+	for _, observer := range m.observers {
+		observer(access)
+	}
+}
+
+// Peek reads a byte or little endian word without notifying observers, for the debugger and display code.
+// Unmapped addresses read as 0
+func (m *Memory) Peek(address uint32, wide bool) uint16 {
+	value := uint16(m.peekByte(address))
+	if wide {
+		value |= uint16(m.peekByte(WrapAddress(address+1))) << 8
+	}
+	return value
+}
+
+func (m *Memory) peekByte(address uint32) uint8 {
+	if int(address) >= len(m.Bytes) {
+		return 0
+	}
+	return m.Bytes[address]
+}
+
+// Poke writes a byte or word without notifying observers, for restoring state rather than program writes.
+// Writes to unmapped addresses are dropped
+func (m *Memory) Poke(address uint32, value uint16, wide bool) {
+	m.pokeByte(address, uint8(value))
+	if wide {
+		m.pokeByte(WrapAddress(address+1), uint8(value>>8))
+	}
+}
+
+func (m *Memory) pokeByte(address uint32, value uint8) {
+	if int(address) < len(m.Bytes) {
+		m.Bytes[address] = value
+	}
+}
+
+// unmapped handles the program touching an address past the end of memory
+func (m *Memory) unmapped(kind MemoryAccessKind, address uint32) {
+	switch m.Unmapped {
+	case UnmappedFault:
+		RaiseFault(FaultUnmapped, address, "%s of unmapped address %05x", kind, address)
+	case UnmappedLog:
+		if m.Log != nil {
+			fmt.Fprintf(m.Log, "memory: %s of unmapped address %05x by %s\n", kind, address, CurrentInstruction)
+		}
+	}
+}
+
+// PeekOffset is Peek at offset in the segment starting at base, see ReadOffset
+func (m *Memory) PeekOffset(base uint32, offset uint16, wide bool) uint16 {
+	if wide && offset == 0xffff {
+		return m.Peek(Physical(base, offset), false) | m.Peek(base, false)<<8
+	}
+	return m.Peek(Physical(base, offset), wide)
 }
 
-func (m *Memory) ReadMemory(address *int) uint8 {
-	return m.Bytes[*address]
+// PokeOffset is Poke at offset in the segment starting at base, see WriteOffset
+func (m *Memory) PokeOffset(base uint32, offset uint16, value uint16, wide bool) {
+	if wide && offset == 0xffff {
+		m.Poke(Physical(base, offset), value, false)
+		m.Poke(base, value>>8, false)
+		return
+	}
+	m.Poke(Physical(base, offset), value, wide)
+}
+
+// ReadOffset reads at offset in the segment starting at base, a word at offset ffff gets its high byte from
+// offset 0 because offsets wrap round inside their segment
+func (m *Memory) ReadOffset(base uint32, offset uint16, wide bool) uint16 {
+	if wide && offset == 0xffff {
+		return m.Read(Physical(base, offset), false) | m.Read(Physical(base, 0), false)<<8
+	}
+	return m.Read(Physical(base, offset), wide)
+}
+
+// WriteOffset writes at offset in the segment starting at base, wrapping round inside the segment like ReadOffset
+func (m *Memory) WriteOffset(base uint32, offset uint16, value uint16, wide bool) {
+	if wide && offset == 0xffff {
+		m.Write(Physical(base, offset), value, false)
+		m.Write(Physical(base, 0), value>>8, false)
+		return
+	}
+	m.Write(Physical(base, offset), value, wide)
+}
+
+// Read is how the simulated program reads memory, every data access goes through here
+func (m *Memory) Read(address uint32, wide bool) uint16 {
+	value := uint16(m.readByte(address))
+	if wide {
+		value |= uint16(m.readByte(WrapAddress(address+1))) << 8
+	}
+	m.notify(MemoryAccess{Kind: MemoryRead, Address: address, Wide: wide, Old: value, New: value})
+	return value
+}
+
+// Write is how the simulated program writes memory, every data access goes through here
+func (m *Memory) Write(address uint32, value uint16, wide bool) {
+	old := m.Peek(address, wide)
+	m.writeByte(address, uint8(value))
+	if wide {
+		m.writeByte(WrapAddress(address+1), uint8(value>>8))
+	}
+	// rom can turn the write down so New is what memory actually holds now
+	m.notify(MemoryAccess{Kind: MemoryWrite, Address: address, Wide: wide, Old: old, New: m.Peek(address, wide)})
 }
 
-var MemoryValues = Memory{make([]uint8, 1024*1024)}
+var MemoryValues = Memory{Bytes: make([]uint8, 1024*1024)}
 
 type CpuFlag int
 
 const (
 	SignFlag CpuFlag = iota
 	ZeroFlag
+	CarryFlag // only set by interrupt services so far
+	InterruptFlag
 )
 
 func (c CpuFlag) String() string {
-	if c == SignFlag {
+	switch c {
+	case SignFlag:
 		return "signFlag"
-	} else {
+	case CarryFlag:
+		return "carryFlag"
+	case InterruptFlag:
+		return "interruptFlag"
+	default:
 		return "zeroFlag"
 	}
 }
@@ -31,8 +277,37 @@ type CpuFlags map[CpuFlag]bool
 
 // CpuFlagValues this is technically a register but for convenience i'm using a map
 var CpuFlagValues = CpuFlags{
-	SignFlag: false, // if the last op has a negative result signed is true
-	ZeroFlag: false, // if the last op resulted in a value of 0 this is true
+	SignFlag:  false, // if the last op has a negative result signed is true
+	ZeroFlag:  false, // if the last op resulted in a value of 0 this is true
+	CarryFlag: false, // bios and dos calls set this to say they failed
+	// hardware interrupts are only taken while this is set, sti and cli set and clear it
+	InterruptFlag: false,
+}
+
+// flagBits are where each flag sits in the 16 bit flags register
+var flagBits = map[CpuFlag]uint{
+	CarryFlag:     0,
+	ZeroFlag:      6,
+	SignFlag:      7,
+	InterruptFlag: 9,
+}
+
+// FlagsWord packs the flags into the layout of the flags register, e.g. for pushing it on the stack
+func FlagsWord() uint16 {
+	flags := uint16(0b10) // bit 1 is reserved and always reads as set
+	for flag, bit := range flagBits {
+		if CpuFlagValues[flag] {
+			flags |= 1 << bit
+		}
+	}
+	return flags
+}
+
+// SetFlagsWord unpacks a flags register value into the flags
+func SetFlagsWord(flags uint16) {
+	for flag, bit := range flagBits {
+		CpuFlagValues[flag] = flags&(1<<bit) != 0
+	}
 }
 
 type Registers map[Register][]uint8
@@ -44,12 +319,59 @@ var RegisterValues = Registers{
 	Register_c: []uint8{0b0, 0b0},
 	Register_d: []uint8{0b0, 0b0},
 
-	Register_sp: []uint8{0b01000000, 0b10011100}, // stack is from 40,000 -> 30,000 (grows up), little endina so most significant byte is 2nd [i+1]
+	Register_sp: []uint8{0b01000000, 0b10011100}, // stack starts at 40,000 and grows down, see Stack. little endian so most significant byte is 2nd [i+1]
 	Register_bp: []uint8{0b0, 0b0},
 	Register_si: []uint8{0b0, 0b0},
 	Register_di: []uint8{0b0, 0b0},
 
 	Register_ip: []uint8{0b0, 0b0},
+
+	Register_es: []uint8{0b0, 0b0},
+	Register_cs: []uint8{0b0, 0b0},
+	Register_ss: []uint8{0b0, 0b0},
+	Register_ds: []uint8{0b0, 0b0},
+}
+
+func registerSnapshot() map[Register]uint16 {
+	snapshot := map[Register]uint16{}
+	for register, value := range RegisterValues {
+		snapshot[register] = ReadU16(value, 0)
+	}
+	return snapshot
+}
+
+// powerOnRegisters are the register values before anything has run
+var powerOnRegisters = registerSnapshot()
+
+// ResetMachine puts registers, flags and memory back to how they start and detaches every observer,
+// so another program can be simulated from scratch in the same process
+func ResetMachine() {
+	for register, value := range powerOnRegisters {
+		WriteU16(RegisterValues[register], 0, value)
+	}
+	for flag := range CpuFlagValues {
+		CpuFlagValues[flag] = false
+	}
+	clear(MemoryValues.Bytes)
+	MemoryValues.observers = nil
+	MemoryValues.regions = nil
+	MemoryValues.Unmapped = UnmappedZero
+	A20 = false
+	CpuFault = nil
+	ExecutionObservers = nil
+	totalCycles = 0
+	ElapsedCycles = 0
+	tookJump = false
+	Halted = false
+	InterruptHandlers = map[uint8]func(){}
+	Ports = map[uint16]PortDevice{}
+	ClockedDevices = nil
+	SnapshotDevices = nil
+	InterruptController = nil
+	interruptShadow = false
+	runtimeEntries = map[uint32]bool{}
+	Stack = StackBounds{Base: powerOnRegisters[Register_sp]}
+	Calls.Frames = nil
 }
 
 func (r Registers) String() string {
@@ -64,3 +386,35 @@ func (r Registers) String() string {
 	}
 	return res
 }
+
+// RegisterByName maps an assembly register name (ax, al, ah, sp, ip...) to the part of the register it refers to
+func RegisterByName(name string) (RegisterAccess, bool) {
+	name = strings.ToLower(name)
+	for index := byte(0); index < 8; index++ {
+		for w := byte(0); w < 2; w++ {
+			access := GetRegisterOperand(index, w).Register
+			if access.String() == name {
+				return access, true
+			}
+		}
+	}
+	for register := Register_ip; register <= Register_ds; register++ {
+		if RegisterName(register) == name {
+			return RegisterAccess{register, 0, 2}, true
+		}
+	}
+	return RegisterAccess{}, false
+}
+
+// ReadRegister reads the byte or word a register access refers to
+func ReadRegister(r RegisterAccess) uint16 {
+	if r.Length == 2 {
+		return ReadU16(RegisterValues[r.RegisterIndex], uint16(r.ByteOffset))
+	}
+	return uint16(ReadU8(RegisterValues[r.RegisterIndex], uint16(r.ByteOffset)))
+}
+
+// WriteRegister sets the byte or word a register access refers to
+func WriteRegister(r RegisterAccess, value uint16) {
+	Write(RegisterValues[r.RegisterIndex], uint16(r.ByteOffset), value, r.Length == 2)
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestOffsetWrap(t *testing.T) {
+	tests := []struct {
+		name    string
+		base    uint32
+		offset  uint16
+		wide    bool
+		value   uint16
+		low     uint32 // where the low byte lands
+		high    uint32 // and the high byte, unused for bytes
+		readsAs uint16
+	}{
+		{"word inside the segment", 0x10000, 0xfffe, true, 0xbeef, 0x1fffe, 0x1ffff, 0xbeef},
+		{"word at ffff wraps to offset 0", 0x10000, 0xffff, true, 0xbeef, 0x1ffff, 0x10000, 0xbeef},
+		{"byte at ffff", 0x10000, 0xffff, false, 0x12, 0x1ffff, 0, 0x12},
+		{"word at ffff of segment 0", 0, 0xffff, true, 0x5678, 0xffff, 0, 0x5678},
+	}
+	for _, test := range tests {
+		ResetMachine()
+		MemoryValues.WriteOffset(test.base, test.offset, test.value, test.wide)
+		if value := MemoryValues.Peek(test.low, false); value != test.value&0xff {
+			t.Errorf("%s: the low byte at %05x is %02x, want %02x", test.name, test.low, value, test.value&0xff)
+		}
+		if test.wide {
+			if value := MemoryValues.Peek(test.high, false); value != test.value>>8 {
+				t.Errorf("%s: the high byte at %05x is %02x, want %02x", test.name, test.high, value, test.value>>8)
+			}
+		}
+		if value := MemoryValues.ReadOffset(test.base, test.offset, test.wide); value != test.readsAs {
+			t.Errorf("%s: read back %04x, want %04x", test.name, value, test.readsAs)
+		}
+		if value := MemoryValues.PeekOffset(test.base, test.offset, test.wide); value != test.readsAs {
+			t.Errorf("%s: peeked %04x, want %04x", test.name, value, test.readsAs)
+		}
+	}
+}
+
+func TestA20(t *testing.T) {
+	defer ResetMachine()
+	defer SetMemorySize(0x100000)
+	tests := []struct {
+		a20      bool
+		physical uint32 // of ffff:0010
+		word     uint16 // read at fffff, its high byte comes from 0 or 100000
+	}{
+		{false, 0x00000, 0xaa11},
+		{true, 0x100000, 0xbb11},
+	}
+	for _, test := range tests {
+		ResetMachine()
+		SetMemorySize(maxMemorySize)
+		A20 = test.a20
+		MemoryValues.Poke(0xfffff, 0x11, false)
+		MemoryValues.Poke(0, 0xaa, false)
+		MemoryValues.Poke(0x100000, 0xbb, false)
+		if physical := Physical(0xffff0, 0x10); physical != test.physical {
+			t.Errorf("a20 %v: ffff:0010 is %05x, want %05x", test.a20, physical, test.physical)
+		}
+		if value := MemoryValues.Read(0xfffff, true); value != test.word {
+			t.Errorf("a20 %v: the word at fffff is %04x, want %04x", test.a20, value, test.word)
+		}
+	}
+}
+
+func TestParseMemorySize(t *testing.T) {
+	tests := []struct {
+		size  string
+		bytes int
+	}{
+		{"640k", 640 * 1024},
+		{"640K", 640 * 1024},
+		{"1m", 1024 * 1024},
+		{"65536", 0x10000},
+		{"0x1000", 0x1000},
+		{"1114096", maxMemorySize},
+	}
+	for _, test := range tests {
+		bytes, err := ParseMemorySize(test.size)
+		if err != nil || bytes != test.bytes {
+			t.Errorf("ParseMemorySize(%q) = %d, %v, want %d", test.size, bytes, err, test.bytes)
+		}
+	}
+
+	for _, size := range []string{"", "k", "lots", "1.5m", "0", "-1k", "2m", "1114097"} {
+		if _, err := ParseMemorySize(size); err == nil {
+			t.Errorf("ParseMemorySize(%q) should have failed", size)
+		}
+	}
+}
+
+func TestUnmappedPolicies(t *testing.T) {
+	defer ResetMachine()
+	defer SetMemorySize(0x100000)
+	tests := []struct {
+		name  string
+		fault bool
+		log   string
+	}{
+		{"zero", false, ""},
+		{"fault", true, ""},
+		{"log", false, "memory: read of unmapped address a0000"},
+	}
+	for _, test := range tests {
+		ResetMachine()
+		SetMemorySize(0xa0000)
+		policy, err := ParseUnmappedPolicy(test.name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var log bytes.Buffer
+		MemoryValues.Unmapped, MemoryValues.Log = policy, &log
+
+		value := uint16(0xffff)
+		func() {
+			defer catchFault()
+			value = MemoryValues.Read(0xa0000, false)
+			MemoryValues.Write(0xa0001, 0x12, false)
+		}()
+		MemoryValues.Log = nil
+
+		if test.fault {
+			if CpuFault == nil || CpuFault.Kind != FaultUnmapped || CpuFault.Address != 0xa0000 {
+				t.Errorf("%s: the read should have faulted at a0000, got %v", test.name, CpuFault)
+			}
+			continue
+		}
+		if CpuFault != nil || value != 0 {
+			t.Errorf("%s: the read gave %x and fault %v, want 0 and no fault", test.name, value, CpuFault)
+		}
+		if test.log == "" && log.Len() != 0 || !strings.Contains(log.String(), test.log) {
+			t.Errorf("%s: logged %q, want %q", test.name, log.String(), test.log)
+		}
+		if test.log != "" && !strings.Contains(log.String(), "write of unmapped address a0001") {
+			t.Errorf("%s: the write wasn't logged, got %q", test.name, log.String())
+		}
+	}
+
+	if _, err := ParseUnmappedPolicy("ignore"); err == nil {
+		t.Errorf("ParseUnmappedPolicy(%q) should have failed", "ignore")
+	}
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"encoding/json"
+)
+
+// Pic is an 8259 programmable interrupt controller on ports 20h and 21h. Devices raise irqs 0-7 on it and it
+// interrupts the cpu with the highest priority one that isn't masked, irq 0 is the highest. Only fixed priority
+// and a single controller are emulated, rotation commands are ignored
+type Pic struct {
+	VectorBase uint8 `json:"vector_base"` // irq n is interrupt VectorBase+n
+	Mask       uint8 `json:"mask"`        // imr, a set bit ignores that irq
+	Requests   uint8 `json:"requests"`    // irr, irqs raised but not taken yet
+	InService  uint8 `json:"in_service"`  // isr, irqs being handled that haven't had an eoi
+	AutoEoi    bool  `json:"auto_eoi"`
+	ReadIsr    bool  `json:"read_isr"` // port 20h reads isr instead of irr
+
+	// which initialisation command word comes next, 0 once initialised
+	InitStep int  `json:"init_step"`
+	NeedIcw3 bool `json:"need_icw3"`
+	NeedIcw4 bool `json:"need_icw4"`
+}
+
+const (
+	picCommandPort = 0x20
+	picDataPort    = 0x21
+)
+
+// NewPic makes a pic set up the way the pc bios leaves it, irqs on interrupts 08h-0fh and nothing masked
+func NewPic() *Pic {
+	return &Pic{VectorBase: 0x08}
+}
+
+// Install connects the pic to its ports and makes it the one devices raise irqs on
+func (p *Pic) Install() {
+	ConnectPorts(p, picCommandPort, picDataPort)
+	InterruptController = p
+	SnapshotDevices = append(SnapshotDevices, p)
+}
+
+// Raise signals irq, it stays requested until the cpu takes it
+func (p *Pic) Raise(irq uint8) {
+	p.Requests |= 1 << irq
+}
+
+// next is the irq that should interrupt the cpu, an irq already in service blocks itself and everything below it
+func (p *Pic) next() (uint8, bool) {
+	if p.InitStep != 0 {
+		return 0, false
+	}
+	for irq := uint8(0); irq < 8; irq++ {
+		bit := uint8(1) << irq
+		if p.InService&bit != 0 {
+			return 0, false
+		}
+		if p.Requests&^p.Mask&bit != 0 {
+			return irq, true
+		}
+	}
+	return 0, false
+}
+
+// Pending is true when there's an irq waiting for the cpu to take it
+func (p *Pic) Pending() bool {
+	_, ok := p.next()
+	return ok
+}
+
+// NextVector is the vector Acknowledge would return, without taking the irq
+func (p *Pic) NextVector() (uint8, bool) {
+	irq, ok := p.next()
+	return p.VectorBase + irq, ok
+}
+
+// Acknowledge is the cpu taking the next irq, it moves to in service and its vector is returned
+func (p *Pic) Acknowledge() (uint8, bool) {
+	irq, ok := p.next()
+	if !ok {
+		return 0, false
+	}
+	p.Requests &^= 1 << irq
+	if !p.AutoEoi {
+		p.InService |= 1 << irq
+	}
+	return p.VectorBase + irq, true
+}
+
+func (p *Pic) In(port uint16) uint8 {
+	if port == picDataPort {
+		return p.Mask
+	}
+	if p.ReadIsr {
+		return p.InService
+	}
+	return p.Requests
+}
+
+func (p *Pic) Out(port uint16, value uint8) {
+	if port == picCommandPort {
+		p.command(value)
+		return
+	}
+
+	switch p.InitStep {
+	case 2:
+		p.VectorBase = value &^ 0b111
+		p.InitStep = 3
+	case 3:
+		// cascade setup, there's only ever one pic
+		p.InitStep = 4
+	case 4:
+		p.AutoEoi = value&0b10 != 0
+		p.InitStep = 0
+	default:
+		p.Mask = value
+		return
+	}
+	if p.InitStep == 3 && !p.NeedIcw3 {
+		p.InitStep = 4
+	}
+	if p.InitStep == 4 && !p.NeedIcw4 {
+		p.InitStep = 0
+	}
+}
+
+// command handles a write to port 20h, icw1 starts initialisation, ocw2 is an eoi and ocw3 picks what reads see
+func (p *Pic) command(value uint8) {
+	switch {
+	case value&0x10 != 0:
+		// icw1, everything is forgotten and the icws that follow are expected
+		p.NeedIcw4 = value&0b1 != 0
+		p.NeedIcw3 = value&0b10 == 0
+		p.Mask, p.InService, p.ReadIsr, p.AutoEoi = 0, 0, false, false
+		p.InitStep = 2
+	case value&0x08 != 0:
+		// ocw3
+		if value&0b10 != 0 {
+			p.ReadIsr = value&0b1 != 0
+		}
+	default:
+		// ocw2
+		switch value >> 5 {
+		case 0b001:
+			// non specific eoi ends the highest priority irq in service
+			for irq := uint8(0); irq < 8; irq++ {
+				if p.InService&(1<<irq) != 0 {
+					p.InService &^= 1 << irq
+					break
+				}
+			}
+		case 0b011:
+			p.InService &^= 1 << (value & 0b111)
+		}
+	}
+}
+
+func (p *Pic) SnapshotName() string {
+	return "pic"
+}
+
+func (p *Pic) SaveState() (json.RawMessage, error) {
+	return json.Marshal(p)
+}
+
+func (p *Pic) LoadState(state json.RawMessage) error {
+	return json.Unmarshal(state, p)
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestPicAcknowledge(t *testing.T) {
+	tests := []struct {
+		name      string
+		mask      uint8
+		requests  uint8
+		inService uint8
+		vector    uint8
+		ok        bool
+	}{
+		{"nothing raised", 0, 0, 0, 0, false},
+		{"irq 0 is the highest", 0, 0b101, 0, 0x08, true},
+		{"masked irqs are skipped", 0b001, 0b101, 0, 0x0a, true},
+		{"everything masked", 0xff, 0xff, 0, 0, false},
+		{"higher than in service", 0, 0b001, 0b100, 0x08, true},
+		{"lower than in service", 0, 0b1000, 0b100, 0, false},
+		{"in service blocks itself", 0, 0b100, 0b100, 0, false},
+		// a masked irq still in service blocks lower ones
+		{"masked in service", 0b001, 0b010, 0b001, 0, false},
+	}
+	for _, test := range tests {
+		pic := NewPic()
+		pic.Mask, pic.Requests, pic.InService = test.mask, test.requests, test.inService
+		if pending := pic.Pending(); pending != test.ok {
+			t.Errorf("%s: pending is %v, want %v", test.name, pending, test.ok)
+		}
+		vector, ok := pic.Acknowledge()
+		if vector != test.vector || ok != test.ok {
+			t.Errorf("%s: acknowledged %02x %v, want %02x %v", test.name, vector, ok, test.vector, test.ok)
+			continue
+		}
+		if !ok {
+			continue
+		}
+		bit := uint8(1) << (vector - pic.VectorBase)
+		if pic.Requests&bit != 0 || pic.InService&bit == 0 {
+			t.Errorf("%s: irq %d didn't move from requested to in service", test.name, vector-pic.VectorBase)
+		}
+	}
+}
+
+func TestPicEoi(t *testing.T) {
+	tests := []struct {
+		name      string
+		inService uint8
+		command   uint8
+		want      uint8
+	}{
+		{"non specific ends the highest", 0b1010, 0x20, 0b1000},
+		{"non specific with nothing in service", 0, 0x20, 0},
+		{"specific", 0b1010, 0x63, 0b0010},
+		{"specific not in service", 0b1010, 0x62, 0b1010},
+		{"rotation is ignored", 0b1010, 0xa0, 0b1010},
+	}
+	for _, test := range tests {
+		pic := NewPic()
+		pic.InService = test.inService
+		pic.Out(picCommandPort, test.command)
+		if pic.InService != test.want {
+			t.Errorf("%s: in service is %08b, want %08b", test.name, pic.InService, test.want)
+		}
+	}
+
+	// the timer's eoi lets the keyboard's irq through
+	pic := NewPic()
+	pic.Raise(1)
+	pic.Raise(0)
+	if vector, _ := pic.Acknowledge(); vector != 0x08 {
+		t.Errorf("took %02x first, want 08", vector)
+	}
+	if pic.Pending() {
+		t.Errorf("irq 1 got through while irq 0 was in service")
+	}
+	pic.Out(picCommandPort, 0x20)
+	if vector, ok := pic.Acknowledge(); vector != 0x09 || !ok {
+		t.Errorf("took %02x %v after the eoi, want 09", vector, ok)
+	}
+}
+
+func TestPicPorts(t *testing.T) {
+	pic := NewPic()
+	pic.Out(picDataPort, 0xfe)
+	pic.Raise(3)
+	pic.InService = 0b1
+	if mask := pic.In(picDataPort); mask != 0xfe {
+		t.Errorf("mask reads %02x, want fe", mask)
+	}
+	if irr := pic.In(picCommandPort); irr != 0b1000 {
+		t.Errorf("port 20h reads %08b before ocw3, want irr", irr)
+	}
+	pic.Out(picCommandPort, 0x0b)
+	if isr := pic.In(picCommandPort); isr != 0b1 {
+		t.Errorf("port 20h reads %08b after ocw3 0bh, want isr", isr)
+	}
+	pic.Out(picCommandPort, 0x0a)
+	if irr := pic.In(picCommandPort); irr != 0b1000 {
+		t.Errorf("port 20h reads %08b after ocw3 0ah, want irr", irr)
+	}
+
+	// icw1 wanting icw4, then the vector base, the cascade word and auto eoi
+	pic.Out(picCommandPort, 0x11)
+	if pic.Pending() {
+		t.Errorf("irq 3 got through part way through initialisation")
+	}
+	pic.Out(picDataPort, 0x70)
+	pic.Out(picDataPort, 0x04)
+	pic.Out(picDataPort, 0x03)
+	if pic.InitStep != 0 || pic.VectorBase != 0x70 || !pic.AutoEoi || pic.Mask != 0 {
+		t.Errorf("after initialisation %+v, want vector base 70, auto eoi and nothing masked", *pic)
+	}
+	if vector, ok := pic.Acknowledge(); vector != 0x73 || !ok || pic.InService != 0 {
+		t.Errorf("auto eoi took %02x %v with %08b in service, want 73 and nothing", vector, ok, pic.InService)
+	}
+
+	// single mode skips icw3
+	pic.Out(picCommandPort, 0x13)
+	pic.Out(picDataPort, 0x08)
+	pic.Out(picDataPort, 0x01)
+	if pic.InitStep != 0 || pic.VectorBase != 0x08 || pic.AutoEoi {
+		t.Errorf("single mode initialisation left %+v", *pic)
+	}
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"encoding/json"
+)
+
+// cyclesPerPitTick is how many cpu cycles go by per pit clock, 4.77MHz / 1.193182MHz on a pc
+const cyclesPerPitTick = 4
+
+const (
+	pitChannelPort = 0x40 // channels are 40h-42h
+	pitControlPort = 0x43
+)
+
+// PitChannel is one 16 bit counter of the pit, it counts down from Reload once a count has been written
+type PitChannel struct {
+	Mode   uint8  `json:"mode"`
+	Access uint8  `json:"access"` // 1 low byte, 2 high byte, 3 low then high
+	Reload uint16 `json:"reload"` // 0 counts 65536
+	Start  int    `json:"start"`  // pit tick counting started at, -1 while it's waiting for a count
+	Edges  int    `json:"edges"`  // rising edges of the output so far, each one is an irq on channel 0
+
+	Latched  bool   `json:"latched"`
+	Latch    uint16 `json:"latch"`
+	LowByte  uint8  `json:"low_byte"`  // first half of a low then high write
+	HighNext bool   `json:"high_next"` // the next read or write of a low then high count is the high byte
+}
+
+func (c *PitChannel) period() int {
+	if c.Reload == 0 {
+		return 0x10000
+	}
+	return int(c.Reload)
+}
+
+// oneShot modes only count down once, 2 and 3 (and their 6 and 7 aliases) reload and go forever.
+// The gated modes 1 and 5 can't be triggered on a pc's channel 0 so they're treated like 0 and 4
+func (c *PitChannel) oneShot() bool {
+	mode := c.Mode & 0b11
+	return mode != 2 && mode != 3
+}
+
+// Count is what the counter reads at pit tick now
+func (c *PitChannel) Count(now int) uint16 {
+	if c.Start < 0 {
+		return c.Reload
+	}
+	elapsed := now - c.Start
+	period := c.period()
+	switch {
+	case c.oneShot():
+		return uint16(period - elapsed)
+	case c.Mode&0b11 == 3:
+		// square wave counts down by two each half of the period
+		half := max(period/2, 1)
+		return uint16(period - 2*(elapsed%half))
+	default:
+		return uint16(period - elapsed%period)
+	}
+}
+
+// edgesAt is how many times the output has gone high by pit tick now, it goes high every time the count
+// runs out and one shot modes only run out once
+func (c *PitChannel) edgesAt(now int) int {
+	if c.Start < 0 {
+		return 0
+	}
+	edges := (now - c.Start) / c.period()
+	if c.oneShot() {
+		edges = min(edges, 1)
+	}
+	return edges
+}
+
+// Pit is an 8253 programmable interval timer, channel 0 raises irq 0 on the pic every time its output
+// goes high. It counts in pit ticks worked out from ElapsedCycles so runs are repeatable. Bcd counting
+// and channel 2's speaker gate on port 61h aren't emulated
+type Pit struct {
+	Channels [3]PitChannel `json:"channels"`
+	pic      *Pic
+}
+
+// NewPit makes a pit with nothing counting, channel 0 raises its irqs on pic
+func NewPit(pic *Pic) *Pit {
+	p := &Pit{pic: pic}
+	for i := range p.Channels {
+		p.Channels[i] = PitChannel{Access: 3, Start: -1}
+	}
+	return p
+}
+
+// Install connects the pit to its ports and the clock
+func (p *Pit) Install() {
+	ConnectPorts(p, pitChannelPort, pitChannelPort+1, pitChannelPort+2, pitControlPort)
+	ClockedDevices = append(ClockedDevices, p)
+	SnapshotDevices = append(SnapshotDevices, p)
+}
+
+// InstallTimer puts a pic and pit on the bus, they sit idle until the program programs them
+func InstallTimer() {
+	pic := NewPic()
+	pic.Install()
+	NewPit(pic).Install()
+}
+
+func pitNow(cycles int) int {
+	return cycles / cyclesPerPitTick
+}
+
+func (p *Pit) Tick(now int) {
+	channel := &p.Channels[0]
+	if edges := channel.edgesAt(pitNow(now)); edges > channel.Edges {
+		// edges between two instructions merge into one irq, the pic only remembers that there was one
+		channel.Edges = edges
+		p.pic.Raise(0)
+	}
+}
+
+func (p *Pit) NextEvent(now int) (int, bool) {
+	channel := &p.Channels[0]
+	if channel.Start < 0 || (channel.oneShot() && channel.Edges > 0) {
+		return 0, false
+	}
+	return (channel.Start + (channel.Edges+1)*channel.period()) * cyclesPerPitTick, true
+}
+
+func (p *Pit) In(port uint16) uint8 {
+	if port == pitControlPort {
+		// the 8253 control word is write only
+		return 0xff
+	}
+	channel := &p.Channels[port-pitChannelPort]
+	value := channel.Count(pitNow(ElapsedCycles))
+	if channel.Latched {
+		value = channel.Latch
+	}
+
+	switch channel.Access {
+	case 1:
+		channel.Latched = false
+		return uint8(value)
+	case 2:
+		channel.Latched = false
+		return uint8(value >> 8)
+	default:
+		channel.HighNext = !channel.HighNext
+		if channel.HighNext {
+			return uint8(value)
+		}
+		channel.Latched = false
+		return uint8(value >> 8)
+	}
+}
+
+func (p *Pit) Out(port uint16, value uint8) {
+	if port == pitControlPort {
+		p.control(value)
+		return
+	}
+	channel := &p.Channels[port-pitChannelPort]
+	switch channel.Access {
+	case 1:
+		channel.Reload = uint16(value)
+	case 2:
+		channel.Reload = uint16(value) << 8
+	default:
+		channel.HighNext = !channel.HighNext
+		if channel.HighNext {
+			channel.LowByte = value
+			return
+		}
+		channel.Reload = uint16(value)<<8 | uint16(channel.LowByte)
+	}
+	// a new count starts counting straight away
+	channel.Start = pitNow(ElapsedCycles)
+	channel.Edges = 0
+}
+
+// control handles a control word, bits 7-6 pick the channel, 5-4 how the count is accessed with 0 latching
+// it and 3-1 the mode
+func (p *Pit) control(value uint8) {
+	index := value >> 6
+	if index == 3 {
+		// read back is an 8254 command
+		return
+	}
+	channel := &p.Channels[index]
+	access := (value >> 4) & 0b11
+	if access == 0 {
+		if !channel.Latched {
+			channel.Latched = true
+			channel.Latch = channel.Count(pitNow(ElapsedCycles))
+		}
+		return
+	}
+	// setting the mode stops the channel until it gets a new count
+	*channel = PitChannel{Mode: (value >> 1) & 0b111, Access: access, Start: -1}
+}
+
+func (p *Pit) SnapshotName() string {
+	return "pit"
+}
+
+func (p *Pit) SaveState() (json.RawMessage, error) {
+	return json.Marshal(p)
+}
+
+func (p *Pit) LoadState(state json.RawMessage) error {
+	return json.Unmarshal(state, p)
+}
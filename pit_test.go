@@ -0,0 +1,158 @@
+package main
+
+import (
+	"slices"
+	"testing"
+)
+
+// readPit reads count bytes from a channel port
+func readPit(pit *Pit, port uint16, count int) []uint8 {
+	var values []uint8
+	for i := 0; i < count; i++ {
+		values = append(values, pit.In(port))
+	}
+	return values
+}
+
+func TestPitCounterAccess(t *testing.T) {
+	// each channel 0 count is written at cycle 0 in mode 2, read live at pit tick 10 then latched there and read
+	// again at tick 0x110 where the latch has to hold until it's been read out
+	tests := []struct {
+		name    string
+		control uint8
+		writes  []uint8
+		atTick  []uint8 // the count at tick 10
+		later   []uint8 // the count at tick 0x110
+	}{
+		{"low byte", 0x14, []uint8{0x34}, []uint8{0x2a}, []uint8{0x28}},
+		{"high byte", 0x24, []uint8{0x12}, []uint8{0x11}, []uint8{0x10}},
+		{"low then high", 0x34, []uint8{0x34, 0x12}, []uint8{0x2a, 0x12}, []uint8{0x24, 0x11}},
+	}
+	for _, test := range tests {
+		ResetMachine()
+		pit := NewPit(NewPic())
+		pit.Out(pitControlPort, test.control)
+		for _, value := range test.writes {
+			pit.Out(pitChannelPort, value)
+		}
+
+		ElapsedCycles = 10 * cyclesPerPitTick
+		if values := readPit(pit, pitChannelPort, len(test.atTick)); !slices.Equal(values, test.atTick) {
+			t.Errorf("%s: read % x at tick 10, want % x", test.name, values, test.atTick)
+		}
+
+		pit.Out(pitControlPort, 0x00)
+		ElapsedCycles = 0x100 * cyclesPerPitTick
+		// latching again before the first latch is read doesn't move it
+		pit.Out(pitControlPort, 0x00)
+		ElapsedCycles = 0x110 * cyclesPerPitTick
+		if values := readPit(pit, pitChannelPort, len(test.atTick)); !slices.Equal(values, test.atTick) {
+			t.Errorf("%s: read % x from the latch, want % x", test.name, values, test.atTick)
+		}
+		if values := readPit(pit, pitChannelPort, len(test.later)); !slices.Equal(values, test.later) {
+			t.Errorf("%s: read % x once the latch was read, want % x", test.name, values, test.later)
+		}
+	}
+}
+
+func TestPitCount(t *testing.T) {
+	tests := []struct {
+		name   string
+		mode   uint8
+		reload uint16
+		start  int
+		tick   int
+		want   uint16
+	}{
+		{"waiting for a count", 2, 100, -1, 50, 100},
+		{"one shot", 0, 100, 0, 30, 70},
+		{"one shot past zero", 0, 100, 0, 130, 0xffe2},
+		{"rate generator", 2, 100, 0, 130, 70},
+		{"started later", 2, 100, 20, 50, 70},
+		{"square wave", 3, 100, 0, 30, 40},
+		{"square wave second half", 3, 100, 0, 50, 100},
+		{"0 counts 65536", 2, 0, 0, 1, 0xffff},
+	}
+	for _, test := range tests {
+		channel := PitChannel{Mode: test.mode, Access: 3, Reload: test.reload, Start: test.start}
+		if count := channel.Count(test.tick); count != test.want {
+			t.Errorf("%s: count is %04x at tick %d, want %04x", test.name, count, test.tick, test.want)
+		}
+	}
+}
+
+func TestPitEdges(t *testing.T) {
+	type step struct {
+		cycle   int
+		edges   int
+		irq     bool // irq 0 was raised by this tick
+		next    int
+		hasNext bool
+	}
+	// a count of 10 pit ticks is an edge every 40 cycles
+	tests := []struct {
+		name  string
+		mode  uint8
+		steps []step
+	}{
+		{
+			"rate generator",
+			2,
+			[]step{
+				{0, 0, false, 40, true},
+				{39, 0, false, 40, true},
+				{40, 1, true, 80, true},
+				{79, 1, false, 80, true},
+				{100, 2, true, 120, true},
+				// edges between two ticks are one irq
+				{200, 5, true, 240, true},
+				{200, 5, false, 240, true},
+			},
+		},
+		{
+			"one shot",
+			0,
+			[]step{
+				{39, 0, false, 40, true},
+				{40, 1, true, 0, false},
+				{400, 1, false, 0, false},
+			},
+		},
+	}
+	for _, test := range tests {
+		ResetMachine()
+		pic := NewPic()
+		pit := NewPit(pic)
+		pit.Out(pitControlPort, 0x30|test.mode<<1)
+		pit.Out(pitChannelPort, 10)
+		pit.Out(pitChannelPort, 0)
+		for _, step := range test.steps {
+			pic.Requests = 0
+			pit.Tick(step.cycle)
+			channel := pit.Channels[0]
+			if channel.Edges != step.edges || (pic.Requests&1 != 0) != step.irq {
+				t.Errorf("%s: at cycle %d edges %d irq %v, want %d %v",
+					test.name, step.cycle, channel.Edges, pic.Requests&1 != 0, step.edges, step.irq)
+			}
+			if next, ok := pit.NextEvent(step.cycle); next != step.next || ok != step.hasNext {
+				t.Errorf("%s: at cycle %d the next event is %d %v, want %d %v",
+					test.name, step.cycle, next, ok, step.next, step.hasNext)
+			}
+		}
+	}
+
+	// a new count restarts the channel from the cycle it was written at
+	ResetMachine()
+	pit := NewPit(NewPic())
+	pit.Out(pitControlPort, 0x34)
+	pit.Out(pitChannelPort, 10)
+	pit.Out(pitChannelPort, 0)
+	pit.Tick(100)
+	ElapsedCycles = 100
+	pit.Out(pitChannelPort, 10)
+	pit.Out(pitChannelPort, 0)
+	if next, ok := pit.NextEvent(100); pit.Channels[0].Edges != 0 || next != 140 || !ok {
+		t.Errorf("reloading at cycle 100 has %d edges and the next at %d %v, want 0 at 140",
+			pit.Channels[0].Edges, next, ok)
+	}
+}
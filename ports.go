@@ -0,0 +1,142 @@
+package main
+
+// PortDevice is hardware on the io port bus, in and out talk to it a byte at a time
+type PortDevice interface {
+	In(port uint16) uint8
+	Out(port uint16, value uint8)
+}
+
+// Ports maps io port numbers to the device answering them, nothing there reads as ff and ignores writes
+var Ports = map[uint16]PortDevice{}
+
+// ConnectPorts puts device on the bus at each of ports
+func ConnectPorts(device PortDevice, ports ...uint16) {
+	for _, port := range ports {
+		Ports[port] = device
+	}
+}
+
+// PortIn reads a byte from port, or a word from port and port+1
+func PortIn(port uint16, wide bool) uint16 {
+	value := uint16(portIn(port))
+	if wide {
+		value |= uint16(portIn(port+1)) << 8
+	}
+	return value
+}
+
+func portIn(port uint16) uint8 {
+	if device, ok := Ports[port]; ok {
+		return device.In(port)
+	}
+	return 0xff
+}
+
+// PortOut writes a byte to port, or a word to port and port+1
+func PortOut(port uint16, value uint16, wide bool) {
+	portOut(port, uint8(value))
+	if wide {
+		portOut(port+1, uint8(value>>8))
+	}
+}
+
+func portOut(port uint16, value uint8) {
+	if device, ok := Ports[port]; ok {
+		device.Out(port, value)
+	}
+}
+
+// ClockedDevice is hardware that runs off ElapsedCycles instead of being stepped, so a run with the same
+// program and input always sees it do the same thing at the same point
+type ClockedDevice interface {
+	// Tick catches the device up to cycle now
+	Tick(now int)
+	// NextEvent is the cycle the device next raises an interrupt at, false if it won't without being told to
+	NextEvent(now int) (int, bool)
+}
+
+// ClockedDevices are ticked after every instruction
+var ClockedDevices []ClockedDevice
+
+// TickDevices catches every clocked device up to ElapsedCycles
+func TickDevices() {
+	for _, device := range ClockedDevices {
+		device.Tick(ElapsedCycles)
+	}
+}
+
+// nextDeviceEvent is the soonest cycle any clocked device will do something at
+func nextDeviceEvent() (int, bool) {
+	next, found := 0, false
+	for _, device := range ClockedDevices {
+		if at, ok := device.NextEvent(ElapsedCycles); ok && (!found || at < next) {
+			next, found = at, true
+		}
+	}
+	return next, found
+}
+
+// InterruptController is the pic devices raise irqs on, nil when there isn't one
+var InterruptController *Pic
+
+// interruptShadow holds off interrupts for the instruction after sti, so sti followed by hlt can't miss one
+var interruptShadow = false
+
+// ServiceInterrupts lets the interrupt controller interrupt the cpu between instructions, only while
+// interrupts are enabled. Taking an irq is a step of its own for the execution observers, so the trace and
+// history don't put its pushes down to the instruction it came after
+func ServiceInterrupts() {
+	if interruptShadow {
+		interruptShadow = false
+		return
+	}
+	if InterruptController == nil || !CpuFlagValues[InterruptFlag] {
+		return
+	}
+	vector, ok := InterruptController.NextVector()
+	if !ok {
+		return
+	}
+
+	irq := Instruction{Address: InstructionAddress(), Op: Op_irq, Flags: map[Flag]bool{}}
+	irq.InstructionOperands[1] = InstructionOperand{Type: Operand_Immediate, Immediate: Immediate{Value: int(vector)}}
+	CurrentInstruction, CurrentIP = irq, ReadU16(RegisterValues[Register_ip], 0)
+	for _, observer := range ExecutionObservers {
+		observer.Before(irq)
+	}
+	func() {
+		// taking an irq pushes onto the stack which can fault too
+		defer catchFault()
+		InterruptController.Acknowledge()
+		Interrupt(vector, ReadU16(RegisterValues[Register_ip], 0))
+	}()
+	for _, observer := range ExecutionObservers {
+		observer.After(irq)
+	}
+}
+
+// maxIdleEvents stops hlt waiting forever on a device whose interrupts never get through e.g. a masked timer
+const maxIdleEvents = 1 << 16
+
+// idle is hlt waiting for an interrupt, the clock skips straight to the next device event until one is
+// pending. If nothing can wake the cpu it stays halted for good
+func idle() {
+	if InterruptController == nil || !CpuFlagValues[InterruptFlag] {
+		Halted = true
+		return
+	}
+	for i := 0; i < maxIdleEvents; i++ {
+		if InterruptController.Pending() {
+			return
+		}
+		next, ok := nextDeviceEvent()
+		if !ok {
+			break
+		}
+		ElapsedCycles = max(next, ElapsedCycles)
+		TickDevices()
+	}
+	if !InterruptController.Pending() {
+		Halted = true
+	}
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"slices"
+	"testing"
+)
+
+// recordingDevice answers every port with its low byte and remembers the writes
+type recordingDevice struct {
+	writes []uint16 // port<<8 | value
+}
+
+func (d *recordingDevice) In(port uint16) uint8 {
+	return uint8(port)
+}
+
+func (d *recordingDevice) Out(port uint16, value uint8) {
+	d.writes = append(d.writes, port<<8|uint16(value))
+}
+
+func TestPorts(t *testing.T) {
+	ResetMachine()
+	device := &recordingDevice{}
+	ConnectPorts(device, 0x60, 0x61)
+
+	tests := []struct {
+		port uint16
+		wide bool
+		want uint16
+	}{
+		{0x60, false, 0x60},
+		{0x60, true, 0x6160},
+		{0x61, true, 0xff61},
+		{0x62, false, 0xff},
+		{0x62, true, 0xffff},
+	}
+	for _, test := range tests {
+		if value := PortIn(test.port, test.wide); value != test.want {
+			t.Errorf("PortIn(%x, %v) = %x, want %x", test.port, test.wide, value, test.want)
+		}
+	}
+
+	PortOut(0x60, 0x1234, true)
+	PortOut(0x61, 0x5678, false)
+	PortOut(0x62, 0xff, false)
+	if want := []uint16{0x6034, 0x6112, 0x6178}; !slices.Equal(device.writes, want) {
+		t.Errorf("the device saw % x, want % x", device.writes, want)
+	}
+}
+
+func TestIdle(t *testing.T) {
+	// the timer is programmed at cycle 12 (pit tick 3) with a count of 100 pit ticks so its first edge is at cycle 412
+	tests := []struct {
+		name       string
+		control    uint8 // 0 leaves the timer idle
+		interrupts bool
+		mask       uint8
+		raised     bool // irq 1 is already waiting
+		cycles     int
+		halted     bool
+	}{
+		{"wakes on the timer", 0x34, true, 0, false, 412, false},
+		{"one shot", 0x30, true, 0, false, 412, false},
+		{"already pending", 0x34, true, 0, true, 12, false},
+		{"interrupts off", 0x34, false, 0, false, 12, true},
+		{"nothing counting", 0, true, 0, false, 12, true},
+		// a one shot timer that's masked runs out of events after its only edge
+		{"masked one shot", 0x30, true, 0b1, false, 412, true},
+		// a masked rate generator keeps having events, idle gives up after maxIdleEvents of them
+		{"masked timer", 0x34, true, 0b1, false, 12 + 400*maxIdleEvents, true},
+	}
+	for _, test := range tests {
+		ResetMachine()
+		InstallTimer()
+		ElapsedCycles = 12
+		CpuFlagValues[InterruptFlag] = test.interrupts
+		PortOut(picDataPort, uint16(test.mask), false)
+		if test.control != 0 {
+			PortOut(pitControlPort, uint16(test.control), false)
+			PortOut(pitChannelPort, 100, false)
+			PortOut(pitChannelPort, 0, false)
+		}
+		if test.raised {
+			InterruptController.Raise(1)
+		}
+
+		idle()
+		if ElapsedCycles != test.cycles || Halted != test.halted {
+			t.Errorf("%s: idle left the clock at %d halted %v, want %d %v",
+				test.name, ElapsedCycles, Halted, test.cycles, test.halted)
+		}
+	}
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// Bus is the cpu's view of memory. Fetch is an instruction byte, Read and Write are the program's data accesses,
+// all of them go through whatever is mapped at an address. Peek and Poke go straight to the backing bytes for
+// display code and loaders
+type Bus interface {
+	Fetch(address uint32) uint8
+	Read(address uint32, wide bool) uint16
+	Write(address uint32, value uint16, wide bool)
+	Peek(address uint32, wide bool) uint16
+	Poke(address uint32, value uint16, wide bool)
+	Size() int
+}
+
+var _ Bus = (*Memory)(nil)
+
+type RegionKind int
+
+const (
+	RegionRam RegionKind = iota
+	RegionRom
+	RegionMmio
+)
+
+func (k RegionKind) String() string {
+	return []string{"ram", "rom", "mmio"}[k]
+}
+
+// Region is a range of addresses [Start, End) that isn't plain ram, anything not in a region is ram.
+// Rom keeps its contents and ignores program writes. Mmio calls its callbacks on every byte the program
+// accesses or fetches, a nil callback falls back to the backing bytes like ram. Loaders write straight to the
+// backing bytes
+type Region struct {
+	Name       string
+	Start, End uint32
+	Kind       RegionKind
+
+	OnRead  func(address uint32) uint8
+	OnWrite func(address uint32, value uint8)
+}
+
+func (r Region) String() string {
+	return fmt.Sprintf("%05x-%05x %s %s", r.Start, r.End-1, r.Kind, r.Name)
+}
+
+// Map adds a region to memory, it can't overlap a region that's already mapped
+func (m *Memory) Map(region Region) error {
+	if region.Start >= region.End || int(region.End) > len(m.Bytes) {
+		return fmt.Errorf("%s doesn't fit in memory", region)
+	}
+	for _, other := range m.regions {
+		if region.Start < other.End && other.Start < region.End {
+			return fmt.Errorf("%s overlaps %s", region, other)
+		}
+	}
+	m.regions = append(m.regions, region)
+	slices.SortFunc(m.regions, func(a, b Region) int { return int(a.Start) - int(b.Start) })
+	return nil
+}
+
+// Regions are the mapped regions in address order
+func (m *Memory) Regions() []Region {
+	return m.regions
+}
+
+// regionAt is the region address is in, nil for plain ram
+func (m *Memory) regionAt(address uint32) *Region {
+	for i := range m.regions {
+		if address < m.regions[i].Start {
+			break
+		}
+		if address < m.regions[i].End {
+			return &m.regions[i]
+		}
+	}
+	return nil
+}
+
+func (m *Memory) readByte(address uint32) uint8 {
+	if int(address) >= len(m.Bytes) {
+		m.unmapped(MemoryRead, address)
+		return 0
+	}
+	if region := m.regionAt(address); region != nil && region.OnRead != nil {
+		return region.OnRead(address)
+	}
+	return m.Bytes[address]
+}
+
+func (m *Memory) writeByte(address uint32, value uint8) {
+	if int(address) >= len(m.Bytes) {
+		m.unmapped(MemoryWrite, address)
+		return
+	}
+	if region := m.regionAt(address); region != nil {
+		switch region.Kind {
+		case RegionRom:
+			if m.Log != nil {
+				fmt.Fprintf(m.Log, "memory: ignored write of %02x to %s at %05x by %s\n", value, region.Name, address, CurrentInstruction)
+			}
+			return
+		case RegionMmio:
+			if region.OnWrite != nil {
+				region.OnWrite(address, value)
+			}
+		}
+	}
+	m.Bytes[address] = value
+}
+
+// LoadRoms copies each `file@segment:offset` spec into memory like -load does and maps it as rom
+func LoadRoms(specs []string) (Program, error) {
+	var program Program
+	for _, spec := range specs {
+		at := strings.LastIndex(spec, "@")
+		if at == -1 {
+			return Program{}, fmt.Errorf("rom %q needs an address, file@segment:offset", spec)
+		}
+		address, err := ParseAddress(spec[at+1:])
+		if err != nil {
+			return Program{}, fmt.Errorf("invalid rom address in %q: %v", spec, err)
+		}
+		loaded, err := LoadInstructions(spec[:at], address)
+		if err != nil {
+			return Program{}, err
+		}
+		if loaded.End == loaded.Start {
+			return Program{}, fmt.Errorf("rom %s is empty", spec[:at])
+		}
+		region := Region{Name: filepath.Base(spec[:at]), Start: uint32(loaded.Start), End: uint32(loaded.End), Kind: RegionRom}
+		if err := MemoryValues.Map(region); err != nil {
+			return Program{}, err
+		}
+		program = program.Merge(loaded)
+	}
+	return program, nil
+}
+
+// MapDebugConsole maps a one byte register at address that prints whatever the program writes to it to out,
+// handy for getting text out of a program without a bios. It reads back as e9h like the bochs debug port
+func MapDebugConsole(address uint32, out io.Writer) error {
+	return MemoryValues.Map(Region{
+		Name:    "debug console",
+		Start:   address,
+		End:     address + 1,
+		Kind:    RegionMmio,
+		OnRead:  func(uint32) uint8 { return 0xe9 },
+		OnWrite: func(_ uint32, value uint8) { out.Write([]byte{value}) },
+	})
+}
+
+// StartDebugConsole maps the debug console from a command line address, empty means there isn't one
+func StartDebugConsole(spec string) error {
+	if spec == "" {
+		return nil
+	}
+	address, err := ParseAddress(spec)
+	if err != nil {
+		return err
+	}
+	return MapDebugConsole(address, os.Stdout)
+}
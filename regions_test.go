@@ -0,0 +1,139 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestMap(t *testing.T) {
+	ResetMachine()
+	if err := MemoryValues.Map(Region{Name: "rom", Start: 0xf0000, End: 0xf1000, Kind: RegionRom}); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name   string
+		region Region
+		reason string
+	}{
+		{"empty", Region{Name: "empty", Start: 0x100, End: 0x100}, "doesn't fit"},
+		{"backwards", Region{Name: "backwards", Start: 0x200, End: 0x100}, "doesn't fit"},
+		{"past the end", Region{Name: "big", Start: 0xff000, End: 0x100001}, "doesn't fit"},
+		{"overlaps the start", Region{Name: "a", Start: 0xefff0, End: 0xf0001}, "overlaps"},
+		{"overlaps the end", Region{Name: "b", Start: 0xf0fff, End: 0xf2000}, "overlaps"},
+		{"inside", Region{Name: "c", Start: 0xf0100, End: 0xf0200}, "overlaps"},
+		{"touching before", Region{Name: "d", Start: 0xe0000, End: 0xf0000}, ""},
+		{"touching after", Region{Name: "e", Start: 0xf1000, End: 0xf1001}, ""},
+	}
+	for _, test := range tests {
+		err := MemoryValues.Map(test.region)
+		if test.reason == "" && err != nil {
+			t.Errorf("%s: %v", test.name, err)
+		}
+		if test.reason != "" && (err == nil || !strings.Contains(err.Error(), test.reason)) {
+			t.Errorf("%s: got %v, want an error about %q", test.name, err, test.reason)
+		}
+	}
+
+	var starts []uint32
+	for _, region := range MemoryValues.Regions() {
+		starts = append(starts, region.Start)
+	}
+	if len(starts) != 3 || starts[0] != 0xe0000 || starts[1] != 0xf0000 || starts[2] != 0xf1000 {
+		t.Errorf("regions start at %x, want them in address order", starts)
+	}
+}
+
+func TestRegionAccess(t *testing.T) {
+	ResetMachine()
+	var log bytes.Buffer
+	MemoryValues.Log = &log
+	defer func() { MemoryValues.Log = nil }()
+
+	var reads []uint32
+	var writes []uint16
+	MemoryValues.Map(Region{Name: "rom", Start: 0x1000, End: 0x1010, Kind: RegionRom})
+	MemoryValues.Map(Region{
+		Name:    "device",
+		Start:   0x2000,
+		End:     0x2002,
+		Kind:    RegionMmio,
+		OnRead:  func(address uint32) uint8 { reads = append(reads, address); return uint8(address) + 0x40 },
+		OnWrite: func(address uint32, value uint8) { writes = append(writes, uint16(address)<<8|uint16(value)) },
+	})
+	MemoryValues.Map(Region{Name: "plain", Start: 0x3000, End: 0x3002, Kind: RegionMmio})
+	MemoryValues.Poke(0x1000, 0x1234, true)
+
+	// rom keeps its contents and says so
+	MemoryValues.Write(0x1000, 0xffff, true)
+	if value := MemoryValues.Read(0x1000, true); value != 0x1234 {
+		t.Errorf("rom reads %04x after a write, want 1234", value)
+	}
+	if !strings.Contains(log.String(), "ignored write of ff to rom at 01000") {
+		t.Errorf("the rom write wasn't reported, the log has %q", log.String())
+	}
+
+	// mmio sees every byte, reads come from the callback and writes still reach the backing bytes
+	if value := MemoryValues.Read(0x2000, true); value != 0x4140 {
+		t.Errorf("mmio reads %04x, want 4140", value)
+	}
+	MemoryValues.Write(0x2000, 0xbeef, true)
+	if len(reads) != 2 || len(writes) != 2 || writes[0] != 0x00ef || writes[1] != 0x01be {
+		t.Errorf("mmio saw reads %x and writes %x", reads, writes)
+	}
+	if value := MemoryValues.Peek(0x2000, true); value != 0xbeef {
+		t.Errorf("peek under mmio is %04x, want the backing bytes", value)
+	}
+	if value := MemoryValues.Fetch(0x2001); value != 0x41 || len(reads) != 3 {
+		t.Errorf("fetching from mmio gave %02x after %d reads, want it through the callback", value, len(reads))
+	}
+
+	// no callbacks behaves like ram
+	MemoryValues.Write(0x3000, 0x5678, true)
+	if value := MemoryValues.Read(0x3000, true); value != 0x5678 {
+		t.Errorf("mmio without callbacks reads %04x, want 5678", value)
+	}
+}
+
+func TestFetchFromMmio(t *testing.T) {
+	ResetMachine()
+	// the device hands out a different instruction each time it's fetched, cli then sti
+	code := []uint8{0xfa, 0xfb}
+	fetches := 0
+	MemoryValues.Map(Region{Name: "code", Start: 0x500, End: 0x501, Kind: RegionMmio, OnRead: func(uint32) uint8 {
+		fetches++
+		return code[(fetches-1)%2]
+	}})
+
+	instructions := DecodeFlow(MemoryValues.Bytes, 0, 0x1000, 0x500).Instructions
+	for _, want := range []OperationType{Op_cli, Op_sti} {
+		instruction, ok := FetchInstruction(instructions, 0x500)
+		if !ok || instruction.Op != want {
+			t.Errorf("fetched %v %v from mmio, want %v", instruction, ok, want)
+		}
+	}
+	// trying every encoding doesn't fetch the byte again
+	if fetches != 2 {
+		t.Errorf("the device saw %d fetches for two instructions", fetches)
+	}
+}
+
+func TestMapDebugConsole(t *testing.T) {
+	ResetMachine()
+	var out bytes.Buffer
+	if err := MapDebugConsole(0x90000, &out); err != nil {
+		t.Fatal(err)
+	}
+	for _, char := range []byte("hi\n") {
+		MemoryValues.Write(0x90000, uint16(char), false)
+	}
+	if out.String() != "hi\n" {
+		t.Errorf("the debug console printed %q, want %q", out.String(), "hi\n")
+	}
+	if value := MemoryValues.Read(0x90000, false); value != 0xe9 {
+		t.Errorf("the debug console reads %02x, want e9", value)
+	}
+	if err := MapDebugConsole(0x90000, &out); err == nil {
+		t.Errorf("mapping a second console at the same address should fail")
+	}
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+// text mode video memory, 80x25 cells of a character byte then an attribute byte
+const (
+	textScreenBase    = 0xb8000
+	textScreenColumns = 80
+	textScreenRows    = 25
+	textScreenSize    = textScreenColumns * textScreenRows * 2
+)
+
+// cgaToAnsi maps the cga colour order (blue is 1, red 4) onto ansi's (red is 1, blue 4)
+var cgaToAnsi = [8]int{0, 4, 2, 6, 1, 5, 3, 7}
+
+// cp437 is the pc character set, control characters are the symbols the video card draws for them
+var cp437 = []rune(" ☺☻♥♦♣♠•◘○◙♂♀♪♫☼►◄↕‼¶§▬↨↑↓→←∟↔▲▼" +
+	" !\"#$%&'()*+,-./0123456789:;<=>?@ABCDEFGHIJKLMNOPQRSTUVWXYZ[\\]^_`abcdefghijklmnopqrstuvwxyz{|}~⌂" +
+	"ÇüéâäàåçêëèïîìÄÅÉæÆôöòûùÿÖÜ¢£¥₧ƒáíóúñÑªº¿⌐¬½¼¡«»░▒▓│┤╡╢╖╕╣║╗╝╜╛┐└┴┬├─┼╞╟╚╔╩╦╠═╬╧╨╤╥╙╘╒╓╫╪┘┌█▄▌▐▀" +
+	"αßΓπΣσµτΦΘΩδ∞φε∩≡±≥≤⌠⌡÷≈°∙·√ⁿ²■ ")
+
+// ansiAttribute is the escape sequence that sets an attribute's colours, bit 7 (blink) is ignored
+func ansiAttribute(attribute uint8) string {
+	foreground := 30 + cgaToAnsi[attribute&7]
+	if attribute&8 != 0 {
+		foreground += 60 // bright
+	}
+	return fmt.Sprintf("\x1b[%d;%dm", foreground, 40+cgaToAnsi[(attribute>>4)&7])
+}
+
+// RenderTextScreen draws the 80x25 text buffer at b800:0000 with ansi colours, blank cells at the end of each row
+// are left off
+func RenderTextScreen(memory []byte) string {
+	if len(memory) < textScreenBase+textScreenSize {
+		// there's no memory behind the screen, it's blank
+		memory = make([]byte, textScreenBase+textScreenSize)
+	}
+	var res strings.Builder
+	for row := 0; row < textScreenRows; row++ {
+		cells := memory[textScreenBase+row*textScreenColumns*2 : textScreenBase+(row+1)*textScreenColumns*2]
+		end := len(cells)
+		for end > 0 && (cells[end-2] == 0 || cells[end-2] == ' ') && cells[end-1]&0x70 == 0 {
+			end -= 2
+		}
+
+		current := -1
+		for i := 0; i < end; i += 2 {
+			if attribute := int(cells[i+1]); attribute != current {
+				res.WriteString(ansiAttribute(uint8(attribute)))
+				current = attribute
+			}
+			res.WriteRune(cp437[cells[i]])
+		}
+		res.WriteString("\x1b[0m\x1b[K\n")
+	}
+	return res.String()
+}
+
+// LiveScreen redraws the text screen on Out while the program runs, at most every Interval and only when it changed
+type LiveScreen struct {
+	Out      io.Writer
+	Interval time.Duration
+
+	last     []byte
+	lastDraw time.Time
+}
+
+// NewLiveScreen clears the terminal and starts redrawing the text screen as instructions run
+func NewLiveScreen(out io.Writer) *LiveScreen {
+	s := &LiveScreen{Out: out, Interval: time.Second / 30}
+	fmt.Fprint(out, "\x1b[2J")
+	ExecutionObservers = append(ExecutionObservers, s)
+	return s
+}
+
+func (s *LiveScreen) Before(instruction Instruction) {}
+
+func (s *LiveScreen) After(instruction Instruction) {
+	if time.Since(s.lastDraw) >= s.Interval {
+		s.Draw()
+	}
+}
+
+// Draw redraws the screen if video memory changed since it was last drawn
+func (s *LiveScreen) Draw() {
+	s.lastDraw = time.Now()
+	if len(MemoryValues.Bytes) < textScreenBase+textScreenSize {
+		return
+	}
+	screen := MemoryValues.Bytes[textScreenBase : textScreenBase+textScreenSize]
+	if s.last != nil && string(s.last) == string(screen) {
+		return
+	}
+	s.last = append(s.last[:0], screen...)
+	fmt.Fprint(s.Out, "\x1b[H"+RenderTextScreen(MemoryValues.Bytes))
+}
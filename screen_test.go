@@ -0,0 +1,64 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestAnsiAttribute(t *testing.T) {
+	tests := []struct {
+		attribute uint8
+		want      string
+	}{
+		{0x07, "\x1b[37;40m"}, // light grey on black
+		{0x01, "\x1b[34;40m"}, // cga blue is ansi 4
+		{0x04, "\x1b[31;40m"}, // cga red is ansi 1
+		{0x03, "\x1b[36;40m"}, // cyan
+		{0x06, "\x1b[33;40m"}, // brown
+		{0x0f, "\x1b[97;40m"}, // bright white
+		{0x0c, "\x1b[91;40m"}, // bright red
+		{0x1e, "\x1b[93;44m"}, // yellow on blue
+		{0x47, "\x1b[37;41m"}, // on red
+		{0xf0, "\x1b[30;47m"}, // blink is ignored
+	}
+	for _, test := range tests {
+		if got := ansiAttribute(test.attribute); got != test.want {
+			t.Errorf("ansiAttribute(%02x) = %q, want %q", test.attribute, got, test.want)
+		}
+	}
+}
+
+func TestRenderTextScreen(t *testing.T) {
+	memory := make([]byte, 0x100000)
+	cells := func(row, column int, text string, attribute uint8) {
+		for i := range text {
+			address := textScreenBase + (row*textScreenColumns+column+i)*2
+			memory[address], memory[address+1] = text[i], attribute
+		}
+	}
+	cells(0, 0, "Hi", 0x07)
+	cells(0, 2, "!", 0x1e)
+	// a blank cell with a background colour still shows
+	cells(1, 0, " ", 0x40)
+	cells(2, 0, "\x01", 0x07)
+
+	rows := strings.Split(RenderTextScreen(memory), "\n")
+	if len(rows) != textScreenRows+1 {
+		t.Fatalf("rendered %d rows", len(rows)-1)
+	}
+	for i, want := range []string{
+		"\x1b[37;40mHi\x1b[93;44m!\x1b[0m\x1b[K",
+		"\x1b[30;41m \x1b[0m\x1b[K",
+		"\x1b[37;40m☺\x1b[0m\x1b[K",
+		"\x1b[0m\x1b[K",
+	} {
+		if rows[i] != want {
+			t.Errorf("row %d is %q, want %q", i, rows[i], want)
+		}
+	}
+
+	// with no memory behind the screen it's blank
+	if blank := RenderTextScreen(make([]byte, 0xa0000)); blank != strings.Repeat("\x1b[0m\x1b[K\n", textScreenRows) {
+		t.Errorf("a screen with no memory rendered %q", blank)
+	}
+}
@@ -7,8 +7,34 @@ import (
 )
 
 var totalCycles = 0
+
+// ElapsedCycles counts the cycles of every simulated instruction, it's the clock devices run off
+var ElapsedCycles = 0
 var tookJump = false
 
+// Halted is set once the program stops itself, by hlt or asking the OS to exit
+var Halted = false
+
+// InterruptHandlers are interrupts implemented in go instead of by code in the simulated machine,
+// they run in place of jumping through the interrupt vector table
+var InterruptHandlers = map[uint8]func(){}
+
+// CurrentInstruction is the instruction being simulated, memory observers use it to say who made an access
+var CurrentInstruction Instruction
+
+// CurrentIP is the ip CurrentInstruction started at, cs and ip may have moved on by the time it makes an access
+var CurrentIP uint16
+
+// ExecutionObserver is told about every instruction Simulate runs,
+// Before is called before the instruction has any effect and After once it's completely done
+type ExecutionObserver interface {
+	Before(instruction Instruction)
+	After(instruction Instruction)
+}
+
+// ExecutionObservers are notified around every simulated instruction
+var ExecutionObservers []ExecutionObserver
+
 func WriteU16(memory []uint8, position, value uint16) {
 	// in little endian the least significant byte is stored at the lowest address
 	memory[position] = uint8(value)
@@ -36,26 +62,39 @@ func Write(memory []uint8, position, value uint16, isWide bool) {
 	}
 }
 
-func ParseOperand(operand InstructionOperand) ([]uint8, uint16, uint16) {
+// ReadOperand gets the value of an operand, memory goes through MemoryValues.Read so observers see the access
+func ReadOperand(operand InstructionOperand) uint16 {
+	return readOperand(operand, MemoryValues.ReadOffset)
+}
+
+// PeekOperand is ReadOperand without notifying memory observers, used when printing
+func PeekOperand(operand InstructionOperand) uint16 {
+	return readOperand(operand, MemoryValues.PeekOffset)
+}
+
+func readOperand(operand InstructionOperand, readMemory func(uint32, uint16, bool) uint16) uint16 {
 	switch operand.Type {
 	case Operand_Immediate:
-		return nil, 0, uint16(uint(operand.Immediate.Value))
+		return uint16(uint(operand.Immediate.Value))
 	case Operand_Register:
-		var registerValue uint16
-		if operand.Register.Length == 2 {
-			// whole register
-			registerValue = ReadU16(RegisterValues[operand.Register.RegisterIndex], uint16(operand.Register.ByteOffset))
-		} else {
-			// partial register read 1 byte from offset
-			registerValue = uint16(ReadU8(RegisterValues[operand.Register.RegisterIndex], uint16(operand.Register.ByteOffset)))
-		}
-		return RegisterValues[operand.Register.RegisterIndex], uint16(operand.Register.ByteOffset), registerValue
+		return ReadRegister(operand.Register)
 	case Operand_Memory:
-		loc := operand.EffectiveAddress.CalculateLocation()
-		value := ReadU16(MemoryValues.Bytes, loc)
-		return MemoryValues.Bytes, loc, value
+		ea := operand.EffectiveAddress
+		return readMemory(ea.Base(), ea.CalculateLocation(), ea.Size == Word)
 	default:
-		return nil, 0, 0
+		return 0
+	}
+}
+
+// WriteOperand stores value in a register or memory operand
+func WriteOperand(operand InstructionOperand, value uint16, isWide bool) {
+	switch operand.Type {
+	case Operand_Register:
+		Write(RegisterValues[operand.Register.RegisterIndex], uint16(operand.Register.ByteOffset), value, isWide)
+	case Operand_Memory:
+		MemoryValues.WriteOffset(operand.EffectiveAddress.Base(), operand.EffectiveAddress.CalculateLocation(), value, isWide)
+	default:
+		panic(fmt.Sprintf("can't write to operand %v", operand))
 	}
 }
 
@@ -73,25 +112,12 @@ func UpdateFlags(result uint16) {
 	}
 }
 
-func HandleJump(jumpDistance uint16, flag bool, instSize uint32) {
-	var calcJumpDistance int
-
-	// need to trim to 8bits for when i flip the bits
-	trimmedJumpDistance := uint8(jumpDistance)
-
-	// do two's complement if its negative
-	if trimmedJumpDistance&(1<<7) != 0 {
-		calcJumpDistance = int(^trimmedJumpDistance + 0b1)
-		calcJumpDistance *= -1
-	} else {
-		calcJumpDistance = int(jumpDistance)
-	}
-
+func HandleJump(jumpDistance int, flag bool, instSize uint32) {
 	ipValue := ReadU16(RegisterValues[Register_ip], 0)
 
 	if flag {
 		tookJump = true
-		newPosition := int(ipValue) + calcJumpDistance + int(instSize)
+		newPosition := int(ipValue) + jumpDistance + int(instSize)
 		WriteU16(RegisterValues[Register_ip], 0, uint16(newPosition))
 	} else {
 		tookJump = false
@@ -99,26 +125,61 @@ func HandleJump(jumpDistance uint16, flag bool, instSize uint32) {
 	}
 }
 
+// StackAddress is the physical address of ss:sp
+func StackAddress(sp uint16) uint32 {
+	return Physical(SegmentBase(Register_ss), sp)
+}
+
 func PushValueToStack(value uint16) {
-	spValue := ReadU16(RegisterValues[Register_sp], 0)     // get current stack position
-	Write(MemoryValues.Bytes, spValue-2, value, true)      // write new value to stack
-	Write(RegisterValues[Register_sp], 0, spValue-2, true) // update stack pointer
+	spValue := ReadU16(RegisterValues[Register_sp], 0) // get current stack position
+	checkPush(spValue)
+	MemoryValues.WriteOffset(SegmentBase(Register_ss), spValue-2, value, true) // write new value to stack
+	Write(RegisterValues[Register_sp], 0, spValue-2, true)                     // update stack pointer
 }
 
-func PopValueFromStack(dest []uint8, destPos uint16) {
+func PopValueFromStack() uint16 {
 	spValue := ReadU16(RegisterValues[Register_sp], 0) // get current stack position
-	stackValue := ReadU16(MemoryValues.Bytes, spValue)
-	if spValue == 40_000 {
-		panic("attempt to pop from empty stack")
-	}
-	Write(MemoryValues.Bytes, spValue, 0, true)            // clear values on stack (set to 0) (lowk don't need)
+	checkPop(spValue)
+	stackValue := MemoryValues.ReadOffset(SegmentBase(Register_ss), spValue, true)
+	// clear values on stack (set to 0), it's not a program write so watchpoints and traces don't see it
+	MemoryValues.PokeOffset(SegmentBase(Register_ss), spValue, 0, true)
 	Write(RegisterValues[Register_sp], 0, spValue+2, true) // update stack pointer
-	Write(dest, destPos, stackValue, true)                 // put value from sp into dest
+	return stackValue
+}
+
+// InstructionAddress is the physical address of cs:ip, where the next instruction is fetched from
+func InstructionAddress() uint32 {
+	return Physical(SegmentBase(Register_cs), ReadU16(RegisterValues[Register_ip], 0))
+}
+
+// Interrupt runs interrupt vector with returnIP as the address to come back to, if there's a go handler it's
+// called directly otherwise flags, cs and ip are pushed and execution continues at the vector table entry
+func Interrupt(vector uint8, returnIP uint16) {
+	interrupted := InstructionAddress()
+	WriteU16(RegisterValues[Register_ip], 0, returnIP)
+	if handler, ok := InterruptHandlers[vector]; ok {
+		handler()
+		return
+	}
+
+	// all three words fit or the interrupt faults without pushing any of them
+	checkPush(ReadU16(RegisterValues[Register_sp], 0) - 4)
+	PushValueToStack(FlagsWord())
+	PushValueToStack(ReadU16(RegisterValues[Register_cs], 0))
+	PushValueToStack(returnIP)
+	// handlers start with interrupts off, iret puts the flag back
+	CpuFlagValues[InterruptFlag] = false
+	entry := uint32(vector) * 4
+	WriteU16(RegisterValues[Register_ip], 0, MemoryValues.Read(entry, true))
+	returnAddress := Physical(SegmentBase(Register_cs), returnIP)
+	WriteU16(RegisterValues[Register_cs], 0, MemoryValues.Read(entry+2, true))
+	runtimeEntries[InstructionAddress()] = true
+	Calls.Enter(interrupted, returnAddress, int(vector))
 }
 
 func HandlePrint(instruction Instruction, showEffect []bool, initalIp uint16) {
-	_, _, destValue := ParseOperand(instruction.InstructionOperands[0])
-	_, _, srcValue := ParseOperand(instruction.InstructionOperands[1])
+	destValue := PeekOperand(instruction.InstructionOperands[0])
+	srcValue := PeekOperand(instruction.InstructionOperands[1])
 
 	currFlags := CpuFlags{}
 	maps.Copy(currFlags, CpuFlagValues)
@@ -138,7 +199,7 @@ func HandlePrint(instruction Instruction, showEffect []bool, initalIp uint16) {
 	}
 
 	if showEffect[ShowInst] {
-		if instruction.InstructionOperands[0].Type == Operand_Register {
+		if instruction.InstructionOperands[0].Type == Operand_Register && instruction.Op != Op_out {
 			// print register update if there is one
 			fmt.Printf("%s", fmt.Sprintf("%s:%x->%x ", instruction.InstructionOperands[0].Register.String(), destValue, srcValue))
 		}
@@ -164,64 +225,121 @@ func HandlePrint(instruction Instruction, showEffect []bool, initalIp uint16) {
 
 func Simulate(instruction Instruction, showEffect []bool) {
 	initialIPVal := ReadU16(RegisterValues[Register_ip], 0)
+	CurrentInstruction = instruction
+	CurrentIP = initialIPVal
 	defer HandlePrint(instruction, showEffect, initialIPVal)
 
-	dest, destPos, destValue := ParseOperand(instruction.InstructionOperands[0])
-	_, _, srcValue := ParseOperand(instruction.InstructionOperands[1])
+	for _, observer := range ExecutionObservers {
+		observer.Before(instruction)
+	}
+	defer func() {
+		// a faulting instruction never finished so it takes no time and can't be interrupted
+		if CpuFault == nil {
+			ElapsedCycles += CalculateInstructionCycles(instruction, tookJump)
+			TickDevices()
+			if instruction.Op == Op_hlt {
+				idle()
+			}
+		}
+		for _, observer := range ExecutionObservers {
+			observer.After(instruction)
+		}
+		if CpuFault == nil {
+			ServiceInterrupts()
+		}
+	}()
+	defer catchFault()
+
+	dest := instruction.InstructionOperands[0]
+	srcValue := ReadOperand(instruction.InstructionOperands[1])
 	isWide := instruction.Flags[Wide]
+	jumpDistance := instruction.Displacement()
 
 	switch instruction.Op {
 	case Op_mov:
-		Write(dest, destPos, srcValue, isWide)
+		WriteOperand(dest, srcValue, isWide)
+		if dest.Type == Operand_Register && (dest.Register.RegisterIndex == Register_ss ||
+			dest.Register.RegisterIndex == Register_sp && instruction.InstructionOperands[1].Type == Operand_Immediate) {
+			// the program is setting up a stack of its own
+			StartStack()
+		}
 	case Op_add:
-		Write(dest, destPos, srcValue+destValue, isWide)
+		destValue := ReadOperand(dest)
+		WriteOperand(dest, srcValue+destValue, isWide)
 		UpdateFlags(destValue + srcValue)
 	case Op_sub:
-		Write(dest, destPos, destValue-srcValue, isWide)
+		destValue := ReadOperand(dest)
+		WriteOperand(dest, destValue-srcValue, isWide)
 		UpdateFlags(destValue - srcValue)
 	case Op_cmp:
-		UpdateFlags(destValue - srcValue)
+		UpdateFlags(ReadOperand(dest) - srcValue)
 	case Op_jne:
-		HandleJump(srcValue, !CpuFlagValues[ZeroFlag], 2)
+		HandleJump(jumpDistance, !CpuFlagValues[ZeroFlag], 2)
 		return
 	case Op_je:
-		HandleJump(srcValue, CpuFlagValues[ZeroFlag], instruction.Size)
+		HandleJump(jumpDistance, CpuFlagValues[ZeroFlag], instruction.Size)
 		return
 	case Op_jl, Op_js:
-		HandleJump(srcValue, CpuFlagValues[SignFlag], instruction.Size)
+		HandleJump(jumpDistance, CpuFlagValues[SignFlag], instruction.Size)
 		return
 	case Op_jns:
-		HandleJump(srcValue, !CpuFlagValues[SignFlag], instruction.Size)
+		HandleJump(jumpDistance, !CpuFlagValues[SignFlag], instruction.Size)
 		return
 	case Op_jnl, Op_jg:
-		HandleJump(srcValue, !CpuFlagValues[SignFlag], instruction.Size)
+		HandleJump(jumpDistance, !CpuFlagValues[SignFlag], instruction.Size)
 		return
 	case Op_jle:
-		HandleJump(srcValue, CpuFlagValues[ZeroFlag] || CpuFlagValues[SignFlag], instruction.Size)
+		HandleJump(jumpDistance, CpuFlagValues[ZeroFlag] || CpuFlagValues[SignFlag], instruction.Size)
 		return
 	case Op_ja:
-		HandleJump(srcValue, !CpuFlagValues[SignFlag] && !CpuFlagValues[ZeroFlag], instruction.Size)
+		HandleJump(jumpDistance, !CpuFlagValues[SignFlag] && !CpuFlagValues[ZeroFlag], instruction.Size)
 		return
 	case Op_jbe:
-		HandleJump(srcValue, CpuFlagValues[SignFlag] || CpuFlagValues[ZeroFlag], instruction.Size)
+		HandleJump(jumpDistance, CpuFlagValues[SignFlag] || CpuFlagValues[ZeroFlag], instruction.Size)
 		return
 	case Op_jb:
-		HandleJump(srcValue, CpuFlagValues[SignFlag] && !CpuFlagValues[ZeroFlag], instruction.Size)
+		HandleJump(jumpDistance, CpuFlagValues[SignFlag] && !CpuFlagValues[ZeroFlag], instruction.Size)
 		return
 	case Op_jmp:
-		HandleJump(srcValue, true, instruction.Size)
+		HandleJump(jumpDistance, true, instruction.Size)
 		return
 	case Op_push:
-		PushValueToStack(destValue)
+		PushValueToStack(ReadOperand(dest))
 	case Op_pop:
-		PopValueFromStack(dest, destPos)
+		WriteOperand(dest, PopValueFromStack(), true)
 	case Op_call:
-		PushValueToStack(ReadU16(RegisterValues[Register_ip], 0) + uint16(instruction.Size)) // end of this instruction not start
-		HandleJump(srcValue, true, instruction.Size)
+		call := InstructionAddress()
+		returnIP := ReadU16(RegisterValues[Register_ip], 0) + uint16(instruction.Size) // end of this instruction not start
+		PushValueToStack(returnIP)
+		HandleJump(jumpDistance, true, instruction.Size)
+		Calls.Enter(call, Physical(SegmentBase(Register_cs), returnIP), -1)
 		return
 	case Op_ret:
-		PopValueFromStack(RegisterValues[Register_ip], 0)
+		WriteU16(RegisterValues[Register_ip], 0, PopValueFromStack())
+		Calls.Return()
+		return
+	case Op_int:
+		Interrupt(uint8(srcValue), ReadU16(RegisterValues[Register_ip], 0)+uint16(instruction.Size))
 		return
+	case Op_iret:
+		checkPop(ReadU16(RegisterValues[Register_sp], 0) + 4)
+		WriteU16(RegisterValues[Register_ip], 0, PopValueFromStack())
+		WriteU16(RegisterValues[Register_cs], 0, PopValueFromStack())
+		SetFlagsWord(PopValueFromStack())
+		runtimeEntries[InstructionAddress()] = true
+		Calls.Return()
+		return
+	case Op_hlt:
+		// the wait for an interrupt happens once the clock has caught up, see idle
+	case Op_in:
+		WriteOperand(dest, PortIn(srcValue, isWide), isWide)
+	case Op_out:
+		PortOut(srcValue, ReadOperand(dest), isWide)
+	case Op_cli:
+		CpuFlagValues[InterruptFlag] = false
+	case Op_sti:
+		CpuFlagValues[InterruptFlag] = true
+		interruptShadow = true
 	default:
 		panic(fmt.Sprintf("unimplemented instruction %v", instruction))
 	}
@@ -229,3 +347,59 @@ func Simulate(instruction Instruction, showEffect []bool) {
 	// move IP
 	WriteU16(RegisterValues[Register_ip], 0, ReadU16(RegisterValues[Register_ip], 0)+uint16(instruction.Size))
 }
+
+// runtimeEntries are addresses control only reaches while running, decoding from the entry points can't find them
+var runtimeEntries = map[uint32]bool{}
+
+// FetchInstruction is the decoded instruction at address. Interrupt handlers are only reachable through the
+// vector table, which is filled in while the program runs, and the code after a hlt only runs once an interrupt
+// returns to it. These get decoded the first time execution reaches them
+func FetchInstruction(instructions map[int]Instruction, address uint32) (Instruction, bool) {
+	if region := MemoryValues.regionAt(address); region != nil && region.Kind == RegionMmio {
+		// mmio can give different bytes every time so code there is fetched through the bus each time it runs
+		instruction, err := DecodeAt(&MemoryValues, int(address))
+		return instruction, err == nil
+	}
+	instruction, ok := instructions[int(address)]
+	if !ok && runtimeEntries[address] {
+		maps.Copy(instructions, DecodeFlow(MemoryValues.Bytes, 0, len(MemoryValues.Bytes), int(address)).Instructions)
+		instruction, ok = instructions[int(address)]
+	}
+	delete(runtimeEntries, address)
+	return instruction, ok
+}
+
+// Step simulates the instruction at cs:ip, ok is false when that isn't the start of a decoded instruction
+func Step(instructions map[int]Instruction, showEffect []bool) (Instruction, bool) {
+	instruction, ok := FetchInstruction(instructions, InstructionAddress())
+	if !ok {
+		return Instruction{}, false
+	}
+	Simulate(instruction, showEffect)
+	return instruction, true
+}
+
+// StopReason says why Run returned before the program finished, it's empty when the program ran to the end
+type StopReason struct {
+	Breakpoint *Breakpoint
+	Watches    []WatchHit
+}
+
+// Run steps through the program until it halts, cs:ip reaches end or lands somewhere that wasn't decoded,
+// a breakpoint fires or an instruction triggers a watchpoint. Breakpoints and watchpoints can be nil
+func Run(instructions map[int]Instruction, end int, breakpoints *Breakpoints, watchpoints *Watchpoints, showEffect []bool) StopReason {
+	for !Halted && InstructionAddress() < uint32(end) {
+		instruction, ok := FetchInstruction(instructions, InstructionAddress())
+		if !ok {
+			return StopReason{}
+		}
+		if hit := breakpoints.Check(instruction); hit != nil {
+			return StopReason{Breakpoint: hit}
+		}
+		Simulate(instruction, showEffect)
+		if hits := watchpoints.TakeHits(); len(hits) > 0 {
+			return StopReason{Watches: hits}
+		}
+	}
+	return StopReason{}
+}
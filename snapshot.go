@@ -0,0 +1,230 @@
+package main
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"os"
+)
+
+const snapshotVersion = 3
+
+// SnapshotDevice is implemented by simulated devices that have state of their own to save
+type SnapshotDevice interface {
+	SnapshotName() string
+	SaveState() (json.RawMessage, error)
+	LoadState(state json.RawMessage) error
+}
+
+// SnapshotDevices are saved and restored along with the cpu and memory
+var SnapshotDevices []SnapshotDevice
+
+// Snapshot is the complete machine state at some point in a run, files are gzipped json
+type Snapshot struct {
+	Version       int                        `json:"version"`
+	Program       Program                    `json:"program"`
+	Halted        bool                       `json:"halted"`
+	Registers     map[string]uint16          `json:"registers"`
+	Flags         map[string]bool            `json:"flags"`
+	TotalCycles   int                        `json:"total_cycles"`
+	ElapsedCycles int                        `json:"elapsed_cycles"`
+	TookJump      bool                       `json:"took_jump"`
+	Memory        []byte                     `json:"memory"`
+	Regions       []snapshotRegion           `json:"regions"`
+	A20           bool                       `json:"a20"`
+	Unmapped      UnmappedPolicy             `json:"unmapped"`
+	Stack         StackBounds                `json:"stack"`
+	Calls         []Frame                    `json:"calls"`
+	Shadow        bool                       `json:"interrupt_shadow"`
+	Fault         *snapshotFault             `json:"fault"`
+	Entries       map[uint32]bool            `json:"runtime_entries"`
+	Devices       map[string]json.RawMessage `json:"devices"`
+}
+
+// snapshotRegion is a mapped region without its callbacks, mmio can't be recreated from a file so it has to be
+// mapped again by the same options before restoring
+type snapshotRegion struct {
+	Name  string     `json:"name"`
+	Start uint32     `json:"start"`
+	End   uint32     `json:"end"`
+	Kind  RegionKind `json:"kind"`
+}
+
+// snapshotFault is CpuFault with the instruction kept as its address, it's decoded again from memory on restore
+type snapshotFault struct {
+	Kind    FaultKind `json:"kind"`
+	At      uint32    `json:"at"`
+	Address uint32    `json:"address"`
+	Reason  string    `json:"reason"`
+}
+
+// TakeSnapshot captures the current machine state
+func TakeSnapshot(program Program) (Snapshot, error) {
+	snapshot := Snapshot{
+		Version:       snapshotVersion,
+		Program:       program,
+		Halted:        Halted,
+		Registers:     traceRegisters(),
+		Flags:         traceFlags(),
+		ElapsedCycles: ElapsedCycles,
+		TotalCycles:   totalCycles,
+		TookJump:      tookJump,
+		Memory:        append([]byte(nil), MemoryValues.Bytes...),
+		A20:           A20,
+		Unmapped:      MemoryValues.Unmapped,
+		Stack:         Stack,
+		Calls:         Calls.Frames,
+		Shadow:        interruptShadow,
+		Entries:       runtimeEntries,
+	}
+	for _, region := range MemoryValues.Regions() {
+		snapshot.Regions = append(snapshot.Regions, snapshotRegion{region.Name, region.Start, region.End, region.Kind})
+	}
+	if CpuFault != nil {
+		snapshot.Fault = &snapshotFault{CpuFault.Kind, CpuFault.Instruction.Address, CpuFault.Address, CpuFault.Reason}
+	}
+	devices, err := deviceStates()
+	if err != nil {
+		return Snapshot{}, err
+	}
+	snapshot.Devices = devices
+	return snapshot, nil
+}
+
+// deviceStates saves every SnapshotDevice keyed by its name, devices that can't be saved right now are left out
+// and the first of their errors is returned
+func deviceStates() (map[string]json.RawMessage, error) {
+	states := map[string]json.RawMessage{}
+	var firstErr error
+	for _, device := range SnapshotDevices {
+		state, err := device.SaveState()
+		if err != nil {
+			if firstErr == nil {
+				firstErr = fmt.Errorf("saving %s: %v", device.SnapshotName(), err)
+			}
+			continue
+		}
+		states[device.SnapshotName()] = state
+	}
+	return states, firstErr
+}
+
+// loadDeviceStates restores the installed devices that have a state in states, others are left alone
+func loadDeviceStates(states map[string]json.RawMessage) error {
+	for _, device := range SnapshotDevices {
+		state, ok := states[device.SnapshotName()]
+		if !ok {
+			continue
+		}
+		if err := device.LoadState(state); err != nil {
+			return fmt.Errorf("restoring %s: %v", device.SnapshotName(), err)
+		}
+	}
+	return nil
+}
+
+// Restore puts the machine back into the state the snapshot was taken in
+func (s Snapshot) Restore() error {
+	if s.Version != snapshotVersion {
+		return fmt.Errorf("snapshot version %d isn't supported", s.Version)
+	}
+	if len(s.Memory) != len(MemoryValues.Bytes) {
+		return fmt.Errorf("snapshot has %d bytes of memory, expected %d", len(s.Memory), len(MemoryValues.Bytes))
+	}
+	if err := s.mapRegions(); err != nil {
+		return err
+	}
+
+	for register := range RegisterValues {
+		WriteU16(RegisterValues[register], 0, s.Registers[RegisterName(register)])
+	}
+	for name, flag := range flagNames {
+		CpuFlagValues[flag] = s.Flags[name]
+	}
+	copy(MemoryValues.Bytes, s.Memory)
+	A20 = s.A20
+	MemoryValues.Unmapped = s.Unmapped
+	totalCycles = s.TotalCycles
+	ElapsedCycles = s.ElapsedCycles
+	tookJump = s.TookJump
+	Halted = s.Halted
+	Stack = s.Stack
+	Calls.Frames = s.Calls
+	interruptShadow = s.Shadow
+	runtimeEntries = s.Entries
+	if runtimeEntries == nil {
+		runtimeEntries = map[uint32]bool{}
+	}
+	CpuFault = nil
+	if s.Fault != nil {
+		instruction, _ := DecodeAt(&MemoryValues, int(s.Fault.At))
+		CpuFault = &Fault{Kind: s.Fault.Kind, Instruction: instruction, Address: s.Fault.Address, Reason: s.Fault.Reason}
+	}
+	s.Program.InstallHandlers()
+	return loadDeviceStates(s.Devices)
+}
+
+// mapRegions maps the snapshot's rom regions and checks everything else mapped matches, rom contents are part of
+// memory but mmio callbacks have to come from the same options as the run the snapshot was taken in
+func (s Snapshot) mapRegions() error {
+	mapped := map[snapshotRegion]bool{}
+	for _, region := range MemoryValues.Regions() {
+		mapped[snapshotRegion{region.Name, region.Start, region.End, region.Kind}] = true
+	}
+	for _, region := range s.Regions {
+		if mapped[region] {
+			delete(mapped, region)
+			continue
+		}
+		if region.Kind != RegionRom {
+			return fmt.Errorf("snapshot has %s %s at %05x-%05x, run with the same options it was saved with",
+				region.Kind, region.Name, region.Start, region.End-1)
+		}
+		if err := MemoryValues.Map(Region{Name: region.Name, Start: region.Start, End: region.End, Kind: region.Kind}); err != nil {
+			return err
+		}
+	}
+	for region := range mapped {
+		return fmt.Errorf("%s %s at %05x-%05x isn't in the snapshot", region.Kind, region.Name, region.Start, region.End-1)
+	}
+	return nil
+}
+
+// SaveSnapshot writes the current machine state to a file
+func SaveSnapshot(fileName string, program Program) error {
+	snapshot, err := TakeSnapshot(program)
+	if err != nil {
+		return err
+	}
+
+	file, err := os.Create(fileName)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	compressed := gzip.NewWriter(file)
+	if err := json.NewEncoder(compressed).Encode(snapshot); err != nil {
+		return err
+	}
+	return compressed.Close()
+}
+
+// LoadSnapshot restores the machine from a file written by SaveSnapshot and returns the snapshot
+func LoadSnapshot(fileName string) (Snapshot, error) {
+	file, err := os.Open(fileName)
+	if err != nil {
+		return Snapshot{}, err
+	}
+	defer file.Close()
+
+	compressed, err := gzip.NewReader(file)
+	if err != nil {
+		return Snapshot{}, err
+	}
+	var snapshot Snapshot
+	if err := json.NewDecoder(compressed).Decode(&snapshot); err != nil {
+		return Snapshot{}, err
+	}
+	return snapshot, snapshot.Restore()
+}
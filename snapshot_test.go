@@ -0,0 +1,86 @@
+package main
+
+import (
+	"io"
+	"maps"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestSnapshotRoundTrip(t *testing.T) {
+	ResetMachine()
+	InstallTimer()
+	NewDos(NewBios(io.Discard, io.Discard, nil, nil), io.Discard, t.TempDir()).Install()
+	if err := MemoryValues.Map(Region{Name: "rom", Start: 0xf0000, End: 0xf0010, Kind: RegionRom}); err != nil {
+		t.Fatal(err)
+	}
+	// mov ax, 1 at 100h to fault on
+	copy(MemoryValues.Bytes[0x100:], []byte{0xb8, 0x01, 0x00})
+	A20 = true
+	MemoryValues.Unmapped = UnmappedFault
+	interruptShadow = true
+	runtimeEntries[0x500] = true
+	Calls.Frames = []Frame{{Call: 0x10, Return: 0x13}}
+	CpuFault = &Fault{Kind: FaultStackOverflow, Instruction: Instruction{Address: 0x100}, Address: 0x20, Reason: "full"}
+	ElapsedCycles = 1234
+
+	fileName := filepath.Join(t.TempDir(), "snap")
+	if err := SaveSnapshot(fileName, Program{Format: "flat", End: 0x103}); err != nil {
+		t.Fatal(err)
+	}
+
+	ResetMachine()
+	InstallTimer()
+	NewDos(NewBios(io.Discard, io.Discard, nil, nil), io.Discard, t.TempDir()).Install()
+	A20 = false
+	MemoryValues.Unmapped = UnmappedZero
+	snapshot, err := LoadSnapshot(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if snapshot.Program.End != 0x103 || ElapsedCycles != 1234 || !A20 || MemoryValues.Unmapped != UnmappedFault || !interruptShadow {
+		t.Errorf("restored end %x, %d cycles, a20 %v, unmapped %v, shadow %v", snapshot.Program.End, ElapsedCycles, A20, MemoryValues.Unmapped, interruptShadow)
+	}
+	if !maps.Equal(runtimeEntries, map[uint32]bool{0x500: true}) || len(Calls.Frames) != 1 {
+		t.Errorf("restored runtime entries %v and calls %v", runtimeEntries, Calls.Frames)
+	}
+	if CpuFault == nil || CpuFault.Kind != FaultStackOverflow || CpuFault.Address != 0x20 || CpuFault.Reason != "full" ||
+		CpuFault.Instruction.Address != 0x100 || CpuFault.Instruction.Op != Op_mov {
+		t.Errorf("restored fault %+v", CpuFault)
+	}
+	if regions := MemoryValues.Regions(); len(regions) != 1 || regions[0].Kind != RegionRom || regions[0].Start != 0xf0000 {
+		t.Errorf("restored regions %v", regions)
+	}
+}
+
+func TestSnapshotRefusals(t *testing.T) {
+	ResetMachine()
+	root := t.TempDir()
+	dos := NewDos(NewBios(io.Discard, io.Discard, nil, nil), io.Discard, root)
+	dos.Install()
+	file, err := os.Create(filepath.Join(root, "OPEN.TXT"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	dos.files[5] = file
+	if _, err := TakeSnapshot(Program{}); err == nil || !strings.Contains(err.Error(), "files open") {
+		t.Errorf("saving with a file open gave %v", err)
+	}
+	delete(dos.files, 5)
+
+	// the debug console's callbacks can't come from the file so the run restoring it has to map it again
+	if err := StartDebugConsole("0xf000:0"); err != nil {
+		t.Fatal(err)
+	}
+	snapshot, err := TakeSnapshot(Program{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ResetMachine()
+	if err := snapshot.Restore(); err == nil || !strings.Contains(err.Error(), "same options") {
+		t.Errorf("restoring without the debug console gave %v", err)
+	}
+}
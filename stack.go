@@ -0,0 +1,114 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// StackBounds is the part of the stack segment the stack can use. It grows down from Base, where sp is with
+// nothing pushed, towards Limit, the lowest offset sp can reach. Both are offsets in ss and a Base of 0 is the
+// very top of the segment
+type StackBounds struct {
+	Base  uint16 `json:"base"`
+	Limit uint16 `json:"limit"`
+	Fixed bool   `json:"fixed"` // set from the command line, the program moving its stack doesn't change them
+}
+
+// Stack is the current stack's bounds, loaders start one wherever they leave ss:sp
+var Stack = StackBounds{Base: 40_000}
+
+// Size is how many bytes fit on the stack, Base and Limit being the same means the whole segment
+func (s StackBounds) Size() int {
+	if size := int(s.Base - s.Limit); size != 0 {
+		return size
+	}
+	return 0x10000
+}
+
+// Depth is how many bytes have been pushed with sp where it is. When sp is outside the stack it's negative if
+// it's nearer the base (more was popped than pushed) and past Size if it's nearer the limit
+func (s StackBounds) Depth(sp uint16) int {
+	depth := int(s.Base - sp)
+	if above := 0x10000 - depth; depth > s.Size() && above < depth-s.Size() {
+		return -above
+	}
+	return depth
+}
+
+// StartStack makes ss:sp the base of a new empty stack that can use the rest of the segment below it, it's
+// called when a program is loaded and when it switches stacks by loading ss or putting a constant in sp
+func StartStack() {
+	if Stack.Fixed {
+		return
+	}
+	Stack.Base, Stack.Limit = ReadU16(RegisterValues[Register_sp], 0), 0
+}
+
+// keepStackOff raises the limit so the stack can't grow down into a program loaded below it in the same segment
+func keepStackOff(program Program) {
+	end := program.End - int(SegmentBase(Register_ss))
+	base := int(Stack.Base)
+	if base == 0 {
+		base = 0x10000
+	}
+	if end > int(Stack.Limit) && end <= base {
+		Stack.Limit = uint16(end + end%2)
+	}
+}
+
+// SetStackBounds fixes the stack's base and limit from the command line, an empty value keeps what the loader
+// worked out
+func SetStackBounds(base, limit string) error {
+	if base != "" {
+		value, err := ParseValue(base)
+		if err != nil {
+			return fmt.Errorf("invalid stack base: %v", err)
+		}
+		Stack.Base, Stack.Fixed = value, true
+	}
+	if limit != "" {
+		value, err := ParseValue(limit)
+		if err != nil {
+			return fmt.Errorf("invalid stack limit: %v", err)
+		}
+		Stack.Limit, Stack.Fixed = value, true
+	}
+	return nil
+}
+
+// checkPush faults if pushing a word would take sp past the limit
+func checkPush(sp uint16) {
+	if Stack.Depth(sp)+2 > Stack.Size() {
+		RaiseFault(FaultStackOverflow, StackAddress(sp-2), "stack overflow, push with ss:sp %04x:%04x goes past the limit %04x",
+			ReadU16(RegisterValues[Register_ss], 0), sp, Stack.Limit)
+	}
+}
+
+// checkPop faults if there isn't a word on the stack to pop
+func checkPop(sp uint16) {
+	if Stack.Depth(sp) < 2 {
+		RaiseFault(FaultStackUnderflow, StackAddress(sp), "stack underflow, pop with ss:sp %04x:%04x but the stack starts at %04x",
+			ReadU16(RegisterValues[Register_ss], 0), sp, Stack.Base)
+	}
+}
+
+// StackView lists the words on the stack from sp up, at most words of them
+func StackView(words int) string {
+	ss, sp := ReadU16(RegisterValues[Register_ss], 0), ReadU16(RegisterValues[Register_sp], 0)
+	depth := Stack.Depth(sp)
+
+	var view strings.Builder
+	fmt.Fprintf(&view, "stack\tss:sp %04x:%04x, %d bytes used, base %04x limit %04x\n", ss, sp, depth, Stack.Base, Stack.Limit)
+	if depth < 0 || depth > Stack.Size() {
+		fmt.Fprintf(&view, "\tsp is outside the stack\n")
+		return view.String()
+	}
+	for offset := 0; offset+1 < depth && offset/2 < words; offset += 2 {
+		address := sp + uint16(offset)
+		fmt.Fprintf(&view, "\t%04x\t%04x\n", address, MemoryValues.PeekOffset(SegmentBase(Register_ss), address, true))
+	}
+	if depth/2 > words {
+		fmt.Fprintf(&view, "\t... %d more\n", depth/2-words)
+	}
+	return view.String()
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+// stackFault runs check and returns the fault it raised, nil when it didn't
+func stackFault(check func(sp uint16), sp uint16) *Fault {
+	CpuFault = nil
+	func() {
+		defer catchFault()
+		check(sp)
+	}()
+	fault := CpuFault
+	CpuFault, Halted = nil, false
+	return fault
+}
+
+func TestStackChecks(t *testing.T) {
+	ResetMachine()
+	WriteU16(RegisterValues[Register_ss], 0, 0x100)
+	tests := []struct {
+		name  string
+		stack StackBounds
+		check func(sp uint16)
+		sp    uint16
+		fault string // empty for none
+	}{
+		{"push into the last word", StackBounds{Base: 0x100, Limit: 0xf0}, checkPush, 0xf2, ""},
+		{"push past the limit", StackBounds{Base: 0x100, Limit: 0xf0}, checkPush, 0xf0, "stack overflow"},
+		{"push with sp odd near the limit", StackBounds{Base: 0x100, Limit: 0xf0}, checkPush, 0xf1, "stack overflow"},
+		{"pop the last word", StackBounds{Base: 0x100, Limit: 0xf0}, checkPop, 0xfe, ""},
+		{"pop an empty stack", StackBounds{Base: 0x100, Limit: 0xf0}, checkPop, 0x100, "stack underflow"},
+		{"pop above the base", StackBounds{Base: 0x100, Limit: 0xf0}, checkPop, 0x102, "stack underflow"},
+		{"push at the top of a whole segment", StackBounds{}, checkPush, 0, ""},
+		{"push at the bottom of a whole segment", StackBounds{}, checkPush, 2, ""},
+		{"pop an empty whole segment", StackBounds{}, checkPop, 0, "stack underflow"},
+		{"pop wraps to the top of a whole segment", StackBounds{}, checkPop, 0xfffe, ""},
+	}
+	for _, test := range tests {
+		Stack = test.stack
+		fault := stackFault(test.check, test.sp)
+		switch {
+		case test.fault == "" && fault != nil:
+			t.Errorf("%s: %v", test.name, fault)
+		case test.fault != "" && (fault == nil || fault.Kind.String() != test.fault):
+			t.Errorf("%s: got fault %v, want a %v", test.name, fault, test.fault)
+		}
+	}
+
+	// the fault points at the word that didn't fit
+	Stack = StackBounds{Base: 0x100, Limit: 0xf0}
+	if fault := stackFault(checkPush, 0xf0); fault == nil || fault.Address != 0x10ee {
+		t.Errorf("the overflow fault is %v, want it at 010ee", fault)
+	}
+}
+
+func TestDefaultStackBounds(t *testing.T) {
+	defer ResetMachine()
+	ResetMachine()
+	if Stack != (StackBounds{Base: 40_000}) {
+		t.Errorf("the power on stack is %+v, want it from sp 40000 down", Stack)
+	}
+
+	// a flat program at 0 keeps the stack off its code
+	flat := writeProgram(t, "flat.bin", []byte{0x90, 0x90, 0x90, 0xf4})
+	if _, err := LoadProgram(flat); err != nil {
+		t.Fatal(err)
+	}
+	if Stack != (StackBounds{Base: 40_000, Limit: 4}) {
+		t.Errorf("a flat program's stack is %+v", Stack)
+	}
+
+	// a .com program gets its whole segment above the program, an odd end is rounded up to a word
+	ResetMachine()
+	com := writeProgram(t, "a.com", []byte{0x90, 0x90, 0xc3})
+	if _, err := LoadProgram(com); err != nil {
+		t.Fatal(err)
+	}
+	if Stack != (StackBounds{Base: 0, Limit: 0x104}) {
+		t.Errorf("a .com program's stack is %+v", Stack)
+	}
+
+	// moving ss:sp starts a new stack unless the bounds came from the command line
+	WriteU16(RegisterValues[Register_sp], 0, 0x8000)
+	StartStack()
+	if Stack != (StackBounds{Base: 0x8000}) {
+		t.Errorf("starting a stack at sp 8000 gave %+v", Stack)
+	}
+	Stack.Fixed = true
+	WriteU16(RegisterValues[Register_sp], 0, 0x4000)
+	StartStack()
+	if Stack.Base != 0x8000 {
+		t.Errorf("a fixed stack moved to %04x", Stack.Base)
+	}
+}
+
+func TestSetStackBounds(t *testing.T) {
+	ResetMachine()
+	WriteU16(RegisterValues[Register_bp], 0, 0x1234)
+	loaded := StackBounds{Base: 0x100, Limit: 0x10}
+	tests := []struct {
+		base, limit string
+		want        StackBounds
+	}{
+		{"", "", loaded},
+		{"0x2000", "", StackBounds{Base: 0x2000, Limit: 0x10, Fixed: true}},
+		{"", "0x80", StackBounds{Base: 0x100, Limit: 0x80, Fixed: true}},
+		{"4096", "256", StackBounds{Base: 0x1000, Limit: 0x100, Fixed: true}},
+		{"bp", "0", StackBounds{Base: 0x1234, Fixed: true}},
+	}
+	for _, test := range tests {
+		Stack = loaded
+		if err := SetStackBounds(test.base, test.limit); err != nil {
+			t.Errorf("SetStackBounds(%q, %q) failed: %v", test.base, test.limit, err)
+			continue
+		}
+		if Stack != test.want {
+			t.Errorf("SetStackBounds(%q, %q) gave %+v, want %+v", test.base, test.limit, Stack, test.want)
+		}
+	}
+
+	errors := []struct {
+		base, limit string
+		reason      string
+	}{
+		{"top", "", "invalid stack base"},
+		{"0x10000", "", "invalid stack base"},
+		{"", "1.5", "invalid stack limit"},
+		{"", "-0x9000", "invalid stack limit"},
+	}
+	for _, test := range errors {
+		Stack = loaded
+		err := SetStackBounds(test.base, test.limit)
+		if err == nil || !strings.Contains(err.Error(), test.reason) {
+			t.Errorf("SetStackBounds(%q, %q) = %v, want an error about %q", test.base, test.limit, err, test.reason)
+		}
+	}
+}
+
+func TestStackView(t *testing.T) {
+	ResetMachine()
+	WriteU16(RegisterValues[Register_ss], 0, 0x100)
+	Stack = StackBounds{Base: 0x1000, Limit: 0xf00}
+	WriteU16(RegisterValues[Register_sp], 0, 0x1000)
+	for _, value := range []uint16{0x1111, 0x2222, 0x3333} {
+		PushValueToStack(value)
+	}
+
+	tests := []struct {
+		name  string
+		sp    uint16
+		words int
+		want  string
+	}{
+		{"every word", 0xffa, 4, "stack\tss:sp 0100:0ffa, 6 bytes used, base 1000 limit 0f00\n" +
+			"\t0ffa\t3333\n\t0ffc\t2222\n\t0ffe\t1111\n"},
+		{"more than fit", 0xffa, 2, "stack\tss:sp 0100:0ffa, 6 bytes used, base 1000 limit 0f00\n" +
+			"\t0ffa\t3333\n\t0ffc\t2222\n\t... 1 more\n"},
+		{"empty", 0x1000, 4, "stack\tss:sp 0100:1000, 0 bytes used, base 1000 limit 0f00\n"},
+		{"above the base", 0x1004, 4, "stack\tss:sp 0100:1004, -4 bytes used, base 1000 limit 0f00\n" +
+			"\tsp is outside the stack\n"},
+	}
+	for _, test := range tests {
+		WriteU16(RegisterValues[Register_sp], 0, test.sp)
+		if view := StackView(test.words); view != test.want {
+			t.Errorf("%s: got\n%s\nwant\n%s", test.name, view, test.want)
+		}
+	}
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// Symbol names an address in the program, usually a label from the source
+type Symbol struct {
+	Address uint32
+	Name    string
+}
+
+// SymbolTable looks up the symbol an address is in, it's empty unless a symbol file was loaded
+type SymbolTable struct {
+	symbols []Symbol // ordered by address
+}
+
+// Symbols are used when printing instructions, traces and debugger locations
+var Symbols = &SymbolTable{}
+
+func (t *SymbolTable) Add(address uint32, name string) {
+	at, _ := slices.BinarySearchFunc(t.symbols, address, func(s Symbol, address uint32) int { return int(s.Address) - int(address) })
+	t.symbols = slices.Insert(t.symbols, at, Symbol{address, name})
+}
+
+// Lookup finds the closest symbol at or before address
+func (t *SymbolTable) Lookup(address uint32) (Symbol, bool) {
+	at, found := slices.BinarySearchFunc(t.symbols, address, func(s Symbol, address uint32) int { return int(s.Address) - int(address) })
+	if found {
+		// several names for one address, use the first one loaded
+		for at > 0 && t.symbols[at-1].Address == address {
+			at--
+		}
+		return t.symbols[at], true
+	}
+	if at == 0 {
+		return Symbol{}, false
+	}
+	return t.symbols[at-1], true
+}
+
+// Find looks up a symbol by name
+func (t *SymbolTable) Find(name string) (Symbol, bool) {
+	for _, symbol := range t.symbols {
+		if symbol.Name == name {
+			return symbol, true
+		}
+	}
+	return Symbol{}, false
+}
+
+// Symbolize describes address as symbol+offset, it's empty when there's no symbol before the address
+func Symbolize(address uint32) string {
+	symbol, ok := Symbols.Lookup(address)
+	if !ok {
+		return ""
+	}
+	if symbol.Address == address {
+		return symbol.Name
+	}
+	return fmt.Sprintf("%s+%x", symbol.Name, address-symbol.Address)
+}
+
+// AddressString is the address in hex followed by its symbol if it has one e.g. 000c <loop_start>
+func AddressString(address uint32) string {
+	if symbol := Symbolize(address); symbol != "" {
+		return fmt.Sprintf("%04x <%s>", address, symbol)
+	}
+	return fmt.Sprintf("%04x", address)
+}
+
+// ParseSymbols reads a nasm map file ([map symbols file.map] in the source) or a file of `address name` lines,
+// addresses are hex offsets from base unless they're written as segment:offset
+func ParseSymbols(r io.Reader, base uint32) ([]Symbol, error) {
+	var symbols []Symbol
+	scanner := bufio.NewScanner(r)
+	isMap := false
+	inSymbols := false
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if line == 1 && strings.HasPrefix(text, "- NASM Map file") {
+			isMap = true
+			continue
+		}
+
+		if isMap {
+			// symbols are listed as "real virtual name" rows under the symbols heading, labels are virtual addresses
+			if strings.HasPrefix(text, "-- ") {
+				inSymbols = strings.HasPrefix(text, "-- Symbols")
+				continue
+			}
+			fields := strings.Fields(text)
+			if !inSymbols || len(fields) != 3 {
+				continue
+			}
+			if _, err := strconv.ParseUint(fields[0], 16, 32); err != nil {
+				continue
+			}
+			address, err := strconv.ParseUint(fields[1], 16, 32)
+			if err != nil {
+				continue
+			}
+			symbols = append(symbols, Symbol{base + uint32(address), fields[2]})
+			continue
+		}
+
+		if text == "" || strings.HasPrefix(text, ";") || strings.HasPrefix(text, "#") {
+			continue
+		}
+		fields := strings.Fields(text)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("line %d: expected `address name`", line)
+		}
+		address, err := parseSymbolAddress(fields[0], base)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", line, err)
+		}
+		symbols = append(symbols, Symbol{address, fields[1]})
+	}
+	return symbols, scanner.Err()
+}
+
+// LoadSymbols adds the symbols in a file ParseSymbols understands to Symbols
+func LoadSymbols(fileName string, base uint32) error {
+	file, err := os.Open(fileName)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	symbols, err := ParseSymbols(file, base)
+	if err != nil {
+		return fmt.Errorf("%s %v", fileName, err)
+	}
+	for _, symbol := range symbols {
+		Symbols.Add(symbol.Address, symbol.Name)
+	}
+	return nil
+}
+
+func parseSymbolAddress(s string, base uint32) (uint32, error) {
+	parseHex := func(s string) (uint32, error) {
+		value, err := strconv.ParseUint(strings.TrimPrefix(strings.ToLower(s), "0x"), 16, 32)
+		return uint32(value), err
+	}
+	if segment, offset, found := strings.Cut(s, ":"); found {
+		segmentValue, err := parseHex(segment)
+		if err != nil {
+			return 0, err
+		}
+		offsetValue, err := parseHex(offset)
+		return (segmentValue<<4 + offsetValue) & 0xFFFFF, err
+	}
+	offset, err := parseHex(s)
+	return base + offset, err
+}
+
+// parseFileSegment splits a file[@segment] flag value, the segment defaults to cs after loading the program
+func parseFileSegment(spec string) (string, uint32, error) {
+	fileName, segment, found := strings.Cut(spec, "@")
+	if !found {
+		return fileName, SegmentBase(Register_cs), nil
+	}
+	base, err := segmentBase(segment)
+	return fileName, base, err
+}
+
+// LoadSymbolsFlag handles a -symbols value
+func LoadSymbolsFlag(spec string) error {
+	fileName, base, err := parseFileSegment(spec)
+	if err != nil {
+		return err
+	}
+	return LoadSymbols(fileName, base)
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestParseSymbols(t *testing.T) {
+	nasmMap := `- NASM Map file ---------------------------------------------------------------
+
+Source file:  fib.asm
+Output file:  fib
+
+-- Symbols --------------------------------------------------------------------
+
+---- Section .text ------------------------------------------------------------
+
+Real              Virtual           Name
+               0                 0  start
+               C                 C  loop_start
+              1B                1B  done
+
+-- Section .data --
+               0                 0  not_a_symbol
+`
+	tests := []struct {
+		name    string
+		file    string
+		base    uint32
+		symbols []Symbol
+	}{
+		{"nasm map", nasmMap, 0, []Symbol{{0, "start"}, {0xc, "loop_start"}, {0x1b, "done"}}},
+		{"nasm map in a segment", nasmMap, 0x10000, []Symbol{{0x10000, "start"}, {0x1000c, "loop_start"}, {0x1001b, "done"}}},
+		{
+			"address lines",
+			"; comment\n# comment\n\n0x10 main\n1b done\nf000:fff0 reset\n",
+			0x100,
+			[]Symbol{{0x110, "main"}, {0x11b, "done"}, {0xffff0, "reset"}},
+		},
+	}
+	for _, test := range tests {
+		symbols, err := ParseSymbols(strings.NewReader(test.file), test.base)
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if !slices.Equal(symbols, test.symbols) {
+			t.Errorf("%s: got %v, want %v", test.name, symbols, test.symbols)
+		}
+	}
+
+	for _, file := range []string{"10\n", "10 a b\n", "zz name\n", "f000:zz name\n"} {
+		if _, err := ParseSymbols(strings.NewReader(file), 0); err == nil {
+			t.Errorf("%q should have failed", file)
+		}
+	}
+}
+
+func TestParseAddress(t *testing.T) {
+	ResetMachine()
+	defer func() { Symbols = &SymbolTable{} }()
+	Symbols = &SymbolTable{}
+	Symbols.Add(0x1000c, "loop_start")
+	WriteU16(RegisterValues[Register_b], 0, 4)
+	WriteU16(RegisterValues[Register_cs], 0, 0x1000)
+
+	tests := []struct {
+		address string
+		want    uint32
+	}{
+		{"0x1b", 0x1b},
+		{"0x100:0x10", 0x1010},
+		{"cs:bx+2", 0x10006},
+		{"loop_start", 0x1000c},
+		{"loop_start+3", 0x1000f},
+		// after a segment the symbol is its offset in that segment, not added to it again
+		{"cs:loop_start", 0x1000c},
+		{"0x1000:loop_start+bx", 0x10010},
+		{"0x0fff:loop_start", 0x1000c},
+		// numbers after a segment are hex like debug.com writes them
+		{"f000:fff0", 0xffff0},
+		{"1000:10+bx", 0x10014},
+		{"0x100:10", 0x1010},
+		{"cs:10a", 0x1010a},
+		// without a segment they're still decimal
+		{"16", 0x10},
+	}
+	for _, test := range tests {
+		address, err := ParseAddress(test.address)
+		if err != nil {
+			t.Errorf("ParseAddress(%q) failed: %v", test.address, err)
+			continue
+		}
+		if address != test.want {
+			t.Errorf("ParseAddress(%q) = %05x, want %05x", test.address, address, test.want)
+		}
+	}
+
+	for _, address := range []string{"", "nosuch", "zz:0", "0x2000:loop_start", "0:loop_start", "f000:zz", "10000:0", "0:-1"} {
+		if _, err := ParseAddress(address); err == nil {
+			t.Errorf("ParseAddress(%q) should have failed", address)
+		}
+	}
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"bufio"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+)
+
+// TraceWrite is a memory write made by a traced instruction
+type TraceWrite struct {
+	Address uint32 `json:"address"`
+	Size    int    `json:"size"`
+	Old     uint16 `json:"old"`
+	New     uint16 `json:"new"`
+}
+
+// TraceRecord is one line of a -trace file, it describes a single executed instruction
+type TraceRecord struct {
+	Step        int               `json:"step"`
+	Address     uint32            `json:"address"`
+	Symbol      string            `json:"symbol,omitempty"` // symbol+offset of the address when symbols are loaded
+	Source      *SourceLine       `json:"source,omitempty"` // the line it was assembled from when a listing is loaded
+	Bytes       string            `json:"bytes"`            // hex
+	Mnemonic    string            `json:"mnemonic"`
+	Operands    []string          `json:"operands"`
+	Text        string            `json:"text"`
+	RegsBefore  map[string]uint16 `json:"regs_before"`
+	RegsAfter   map[string]uint16 `json:"regs_after"`
+	FlagsBefore map[string]bool   `json:"flags_before"`
+	FlagsAfter  map[string]bool   `json:"flags_after"`
+	Writes      []TraceWrite      `json:"mem_writes"`
+	Cycles      int               `json:"cycles"`
+	TotalCycles int               `json:"total_cycles"`
+}
+
+// RegisterName is the name of the whole 16 bit register e.g. ax for Register_a
+func RegisterName(r Register) string {
+	return RegisterAccess{r, 0, 2}.String()
+}
+
+func sourceLine(address uint32) *SourceLine {
+	if line, ok := Sources.Lookup(address); ok {
+		return &line
+	}
+	return nil
+}
+
+func traceRegisters() map[string]uint16 {
+	registers := map[string]uint16{}
+	for register, value := range RegisterValues {
+		registers[RegisterName(register)] = ReadU16(value, 0)
+	}
+	return registers
+}
+
+func traceFlags() map[string]bool {
+	flags := map[string]bool{}
+	for name, flag := range flagNames {
+		flags[name] = CpuFlagValues[flag]
+	}
+	return flags
+}
+
+// Tracer writes a TraceRecord as a line of json for every instruction simulated
+type Tracer struct {
+	out *bufio.Writer
+	enc *json.Encoder
+
+	record      TraceRecord
+	recording   bool
+	steps       int
+	totalCycles int
+	err         error
+}
+
+// NewTracer starts tracing every instruction simulated from now on to w, call Flush once done
+func NewTracer(w io.Writer, memory *Memory) *Tracer {
+	out := bufio.NewWriter(w)
+	t := &Tracer{out: out, enc: json.NewEncoder(out)}
+	t.enc.SetEscapeHTML(false) // keep <symbol> readable
+	memory.Observe(t.observeMemory)
+	ExecutionObservers = append(ExecutionObservers, t)
+	return t
+}
+
+func (t *Tracer) observeMemory(access MemoryAccess) {
+	if !t.recording || access.Kind != MemoryWrite {
+		return
+	}
+	size := 1
+	if access.Wide {
+		size = 2
+	}
+	t.record.Writes = append(t.record.Writes, TraceWrite{Address: access.Address, Size: size, Old: access.Old, New: access.New})
+}
+
+func (t *Tracer) Before(instruction Instruction) {
+	operands := []string{}
+	for _, operand := range instruction.InstructionOperands {
+		if operand.Type != Operand_None {
+			operands = append(operands, operand.String())
+		}
+	}
+
+	t.record = TraceRecord{
+		Step:        t.steps,
+		Address:     instruction.Address,
+		Symbol:      Symbolize(instruction.Address),
+		Source:      sourceLine(instruction.Address),
+		Bytes:       hex.EncodeToString(instruction.Bytes),
+		Mnemonic:    opTypeToString[instruction.Op],
+		Operands:    operands,
+		Text:        instruction.String(),
+		RegsBefore:  traceRegisters(),
+		FlagsBefore: traceFlags(),
+		Writes:      []TraceWrite{},
+	}
+	t.recording = true
+}
+
+func (t *Tracer) After(instruction Instruction) {
+	t.recording = false
+	t.steps++
+
+	t.record.RegsAfter = traceRegisters()
+	t.record.FlagsAfter = traceFlags()
+	t.record.Cycles = CalculateInstructionCycles(instruction, tookJump)
+	t.totalCycles += t.record.Cycles
+	t.record.TotalCycles = t.totalCycles
+
+	if t.err == nil {
+		t.err = t.enc.Encode(t.record)
+	}
+}
+
+// Flush writes out any buffered records and returns the first error tracing ran into
+func (t *Tracer) Flush() error {
+	if t.err != nil {
+		return t.err
+	}
+	return t.out.Flush()
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"slices"
+	"testing"
+)
+
+func TestTracerRecord(t *testing.T) {
+	ResetMachine()
+	WriteU16(RegisterValues[Register_a], 0, 0x1234)
+	// mov [10h], ax; sub ax, ax
+	program := []byte{0xa3, 0x10, 0x00, 0x29, 0xc0}
+	copy(MemoryValues.Bytes, program)
+	disassembly := DecodeFlow(MemoryValues.Bytes, 0, len(program), 0)
+
+	var out bytes.Buffer
+	tracer := NewTracer(&out, &MemoryValues)
+	for i := 0; i < 2; i++ {
+		Step(disassembly.Instructions, []bool{false, false, false})
+	}
+	if err := tracer.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	var lines [][]byte
+	scanner := bufio.NewScanner(&out)
+	for scanner.Scan() {
+		lines = append(lines, slices.Clone(scanner.Bytes()))
+	}
+	if len(lines) != 2 {
+		t.Fatalf("got %d trace lines, want one per instruction:\n%s", len(lines), out.String())
+	}
+
+	// the field names are what other tools read so check them as they are in the file
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(lines[0], &fields); err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for name := range fields {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	want := []string{"address", "bytes", "cycles", "flags_after", "flags_before", "mem_writes", "mnemonic", "operands",
+		"regs_after", "regs_before", "step", "text", "total_cycles"}
+	if !slices.Equal(names, want) {
+		t.Errorf("the record has fields %q, want %q", names, want)
+	}
+
+	var first, second TraceRecord
+	json.Unmarshal(lines[0], &first)
+	json.Unmarshal(lines[1], &second)
+	if first.Step != 0 || first.Address != 0 || first.Bytes != "a31000" || first.Mnemonic != "mov" || len(first.Operands) != 2 {
+		t.Errorf("the mov was traced as %s", lines[0])
+	}
+	if first.RegsBefore["ip"] != 0 || first.RegsAfter["ip"] != 3 || first.RegsAfter["ax"] != 0x1234 {
+		t.Errorf("the mov's registers went from %v to %v", first.RegsBefore, first.RegsAfter)
+	}
+	if !slices.Equal(first.Writes, []TraceWrite{{Address: 0x10, Size: 2, Old: 0, New: 0x1234}}) {
+		t.Errorf("the mov wrote %+v", first.Writes)
+	}
+	if first.Cycles == 0 || first.TotalCycles != first.Cycles {
+		t.Errorf("the mov took %d cycles with %d in total", first.Cycles, first.TotalCycles)
+	}
+
+	if second.Step != 1 || second.Mnemonic != "sub" || len(second.Writes) != 0 || second.RegsAfter["ax"] != 0 {
+		t.Errorf("the sub was traced as %s", lines[1])
+	}
+	if second.FlagsBefore["zf"] || !second.FlagsAfter["zf"] {
+		t.Errorf("the sub's zf went from %v to %v", second.FlagsBefore["zf"], second.FlagsAfter["zf"])
+	}
+	if second.TotalCycles != first.Cycles+second.Cycles {
+		t.Errorf("the total after the sub is %d, want %d", second.TotalCycles, first.Cycles+second.Cycles)
+	}
+}
@@ -0,0 +1,303 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"strings"
+)
+
+// TraceSource hands out the records of a trace one step at a time
+type TraceSource interface {
+	// Next is the record for the next step, ok is false once the trace has ended
+	Next() (record TraceRecord, ok bool, err error)
+}
+
+// TraceReader reads a json lines trace written by -trace as it's needed
+type TraceReader struct {
+	scanner *bufio.Scanner
+	line    int
+}
+
+// NewTraceReader reads records from r
+func NewTraceReader(r io.Reader) *TraceReader {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, 1024*1024)
+	return &TraceReader{scanner: scanner}
+}
+
+func (t *TraceReader) Next() (TraceRecord, bool, error) {
+	for t.scanner.Scan() {
+		t.line++
+		if len(bytes.TrimSpace(t.scanner.Bytes())) == 0 {
+			continue
+		}
+		var record TraceRecord
+		if err := json.Unmarshal(t.scanner.Bytes(), &record); err != nil {
+			return TraceRecord{}, false, fmt.Errorf("line %d: %v", t.line, err)
+		}
+		return record, true, nil
+	}
+	return TraceRecord{}, false, t.scanner.Err()
+}
+
+// ProgramTrace simulates a program on a machine of its own one instruction per record, so two programs can be
+// stepped in lockstep and stopped as soon as they differ. An instruction that's followed by an irq gives two
+// records, the second waits in pending
+type ProgramTrace struct {
+	machine     *Machine
+	disassembly Disassembly
+	program     Program
+	buffer      bytes.Buffer
+	tracer      *Tracer
+	pending     []TraceRecord
+	steps       int
+	maxSteps    int
+}
+
+// NewProgramTrace sets up a new machine with the program loaded, the machine that was active is left active
+func NewProgramTrace(fileName string, options MachineOptions, maxSteps int) (*ProgramTrace, error) {
+	previous := SaveMachine()
+	defer previous.Activate()
+	NewMachine()
+
+	program, _, err := setupMachine(fileName, options)
+	if err != nil {
+		return nil, err
+	}
+	t := &ProgramTrace{
+		disassembly: DecodeFlow(MemoryValues.Bytes, program.Start, program.End, program.Entries...),
+		program:     program,
+		maxSteps:    maxSteps,
+	}
+	t.tracer = NewTracer(&t.buffer, &MemoryValues)
+	t.machine = SaveMachine()
+	return t, nil
+}
+
+func (t *ProgramTrace) Next() (TraceRecord, bool, error) {
+	if t.steps >= t.maxSteps {
+		return TraceRecord{}, false, nil
+	}
+	if len(t.pending) == 0 {
+		if ok, err := t.step(); !ok || err != nil {
+			return TraceRecord{}, false, err
+		}
+	}
+	record := t.pending[0]
+	t.pending = t.pending[1:]
+	t.steps++
+	return record, true, nil
+}
+
+// step simulates the next instruction and queues the records it traced
+func (t *ProgramTrace) step() (bool, error) {
+	previous := SaveMachine()
+	t.machine.Activate()
+	defer func() {
+		t.machine = SaveMachine()
+		previous.Activate()
+	}()
+
+	if Halted || InstructionAddress() >= uint32(t.program.End) {
+		return false, nil
+	}
+	if _, ok := Step(t.disassembly.Instructions, []bool{false, false, false}); !ok {
+		return false, nil
+	}
+	if err := t.tracer.Flush(); err != nil {
+		return false, err
+	}
+	// going through json means a program compares the same as a trace file of it would
+	decoder := json.NewDecoder(&t.buffer)
+	for decoder.More() {
+		var record TraceRecord
+		if err := decoder.Decode(&record); err != nil {
+			return false, err
+		}
+		t.pending = append(t.pending, record)
+	}
+	t.buffer.Reset()
+	return true, nil
+}
+
+// TraceDifference is the first place two traces disagree
+type TraceDifference struct {
+	Step    int      // step of the difference, or how many steps there were when the traces are identical
+	Reasons []string // what differs, empty when one trace just ends early
+
+	First int // step A[0] and B[0] are, the records before Step are context
+	A, B  []TraceRecord
+}
+
+func diffValues[V comparable](kind string, a, b map[string]V) []string {
+	var reasons []string
+	keys := make([]string, 0, len(a))
+	for key := range a {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+	for _, key := range keys {
+		if a[key] != b[key] {
+			reasons = append(reasons, fmt.Sprintf("%s %s: %v vs %v", kind, key, a[key], b[key]))
+		}
+	}
+	return reasons
+}
+
+// compareRecords lists every way two records of the same step differ
+func compareRecords(a, b TraceRecord) []string {
+	var reasons []string
+	if a.Address != b.Address || a.Bytes != b.Bytes {
+		reasons = append(reasons, fmt.Sprintf("control flow: %04x `%s` vs %04x `%s`", a.Address, a.Text, b.Address, b.Text))
+	}
+	reasons = append(reasons, diffValues("register", a.RegsAfter, b.RegsAfter)...)
+	reasons = append(reasons, diffValues("flag", a.FlagsAfter, b.FlagsAfter)...)
+	if !slices.Equal(a.Writes, b.Writes) {
+		reasons = append(reasons, fmt.Sprintf("memory writes: %v vs %v", a.Writes, b.Writes))
+	}
+	return reasons
+}
+
+// DiffTraces steps both traces together until they differ, keeping context records either side of the difference.
+// ok is false if they're identical
+func DiffTraces(a, b TraceSource, context int) (TraceDifference, bool, error) {
+	var difference TraceDifference
+	for step := 0; ; step++ {
+		recordA, okA, err := a.Next()
+		if err != nil {
+			return TraceDifference{}, false, err
+		}
+		recordB, okB, err := b.Next()
+		if err != nil {
+			return TraceDifference{}, false, err
+		}
+		if !okA && !okB {
+			return TraceDifference{Step: step}, false, nil
+		}
+		if okA {
+			difference.A = append(difference.A, recordA)
+		}
+		if okB {
+			difference.B = append(difference.B, recordB)
+		}
+
+		if okA && okB {
+			difference.Reasons = compareRecords(recordA, recordB)
+		}
+		if okA != okB || len(difference.Reasons) > 0 {
+			difference.Step = step
+			break
+		}
+		// only the last few steps are kept for context
+		if len(difference.A) > context {
+			difference.A = difference.A[1:]
+			difference.B = difference.B[1:]
+			difference.First++
+		}
+	}
+
+	for _, trace := range []struct {
+		source  TraceSource
+		records *[]TraceRecord
+	}{{a, &difference.A}, {b, &difference.B}} {
+		for difference.First+len(*trace.records) <= difference.Step+context {
+			record, ok, err := trace.source.Next()
+			if err != nil {
+				return TraceDifference{}, false, err
+			}
+			if !ok {
+				break
+			}
+			*trace.records = append(*trace.records, record)
+		}
+	}
+	return difference, true, nil
+}
+
+func describeRecord(prefix string, records []TraceRecord, first, i int) string {
+	if i-first >= len(records) {
+		return fmt.Sprintf("%s %6d  (trace ended)", prefix, i)
+	}
+	return fmt.Sprintf("%s %6d  %04x  %s", prefix, i, records[i-first].Address, records[i-first].Text)
+}
+
+// FormatTraceDifference explains a difference with the context records around it
+func FormatTraceDifference(difference TraceDifference) string {
+	var res strings.Builder
+	fmt.Fprintf(&res, "traces diverge at step %d\n", difference.Step)
+	if len(difference.Reasons) == 0 {
+		ended := "a"
+		if difference.First+len(difference.B) == difference.Step {
+			ended = "b"
+		}
+		fmt.Fprintf(&res, "  %s ends early after %d steps\n", ended, difference.Step)
+	}
+	for _, reason := range difference.Reasons {
+		fmt.Fprintf(&res, "  %s\n", reason)
+	}
+
+	res.WriteString("\n")
+	for i := difference.First; i < difference.Step; i++ {
+		res.WriteString(describeRecord("   ", difference.A, difference.First, i) + "\n")
+	}
+	for i := difference.Step; i < difference.First+max(len(difference.A), len(difference.B)); i++ {
+		res.WriteString(describeRecord(" a>", difference.A, difference.First, i) + "\n")
+		res.WriteString(describeRecord(" b>", difference.B, difference.First, i) + "\n")
+	}
+	return res.String()
+}
+
+// openTrace reads a .jsonl trace, anything else is a program to simulate
+func openTrace(fileName string, options MachineOptions, maxSteps int) (TraceSource, error) {
+	if !strings.HasSuffix(fileName, ".jsonl") {
+		return NewProgramTrace(fileName, options, maxSteps)
+	}
+	file, err := os.Open(fileName)
+	if err != nil {
+		return nil, err
+	}
+	// the file is read until the command exits
+	return NewTraceReader(file), nil
+}
+
+// RunTraceDiffCommand handles `sim_8086 tracediff [-context n] [-max n] <a> <b>`
+func RunTraceDiffCommand(args []string) {
+	flags := flag.NewFlagSet("tracediff", flag.ExitOnError)
+	context := flags.Int("context", 3, "steps of context to show around the difference")
+	maxSteps := flags.Int("max", 1_000_000, "most instructions to simulate when comparing programs")
+	var options MachineOptions
+	options.AddFlags(flags)
+	flags.Parse(args)
+
+	if flags.NArg() != 2 {
+		fmt.Println("Error: need two traces (.jsonl) or programs to compare")
+		flags.PrintDefaults()
+		return
+	}
+
+	var traces [2]TraceSource
+	for i, fileName := range flags.Args() {
+		var err error
+		if traces[i], err = openTrace(fileName, options, *maxSteps); err != nil {
+			fmt.Printf("failed to get a trace from %s\n%v\n", fileName, err)
+			return
+		}
+	}
+
+	difference, differs, err := DiffTraces(traces[0], traces[1], *context)
+	if err != nil {
+		fmt.Println("Error: failed to compare traces", err)
+		return
+	}
+	if !differs {
+		fmt.Printf("traces are identical (%d steps)\n", difference.Step)
+		return
+	}
+	fmt.Print(FormatTraceDifference(difference))
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// writeProgram writes code to a flat binary in a temporary directory
+func writeProgram(t *testing.T, name string, code []byte) string {
+	fileName := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(fileName, code, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return fileName
+}
+
+func testOptions() MachineOptions {
+	return MachineOptions{MemorySize: "1m", Unmapped: "zero"}
+}
+
+func TestDiffProgramsInLockstep(t *testing.T) {
+	defer ResetMachine()
+	// mov ax, 1; mov bx, 2; jmp $ against mov ax, 1; mov bx, 3; jmp $, both run forever
+	a := writeProgram(t, "a", []byte{0xb8, 0x01, 0x00, 0xbb, 0x02, 0x00, 0xeb, 0xfe})
+	b := writeProgram(t, "b", []byte{0xb8, 0x01, 0x00, 0xbb, 0x03, 0x00, 0xeb, 0xfe})
+
+	traces := [2]TraceSource{}
+	for i, fileName := range []string{a, b} {
+		var err error
+		if traces[i], err = NewProgramTrace(fileName, testOptions(), 1<<62); err != nil {
+			t.Fatal(err)
+		}
+	}
+	difference, differs, err := DiffTraces(traces[0], traces[1], 1)
+	if err != nil || !differs {
+		t.Fatalf("DiffTraces = %v, %v", differs, err)
+	}
+	if difference.Step != 1 || difference.First != 0 || len(difference.A) != 3 || len(difference.B) != 3 {
+		t.Errorf("difference at step %d from %d with %d and %d records", difference.Step, difference.First, len(difference.A), len(difference.B))
+	}
+	// each machine kept its own registers
+	want := []string{"control flow: 0003 `mov bx, 2` vs 0003 `mov bx, 3`", "register bx: 2 vs 3"}
+	if !slices.Equal(difference.Reasons, want) {
+		t.Errorf("reasons are %q, want %q", difference.Reasons, want)
+	}
+}
+
+func TestDiffTraceEndsEarly(t *testing.T) {
+	defer ResetMachine()
+	// mov ax, 1; hlt against the same trace read from a file with a step missing
+	program := writeProgram(t, "a", []byte{0xb8, 0x01, 0x00, 0xf4})
+	trace, err := NewProgramTrace(program, testOptions(), 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var lines strings.Builder
+	record, _, _ := trace.Next()
+	lines.WriteString(`{"step":0,"address":0,"bytes":"` + record.Bytes + `","text":"` + record.Text + `","regs_after":{"ax":1}}` + "\n")
+
+	trace, _ = NewProgramTrace(program, testOptions(), 100)
+	difference, differs, err := DiffTraces(NewTraceReader(strings.NewReader(lines.String())), trace, 3)
+	if err != nil || !differs {
+		t.Fatalf("DiffTraces = %v, %v", differs, err)
+	}
+	if difference.Step != 1 || len(difference.Reasons) != 0 || len(difference.A) != 1 || len(difference.B) != 2 {
+		t.Errorf("difference at step %d, %q, with %d and %d records", difference.Step, difference.Reasons, len(difference.A), len(difference.B))
+	}
+	if text := FormatTraceDifference(difference); !strings.Contains(text, "a ends early after 1 steps") {
+		t.Errorf("formatted as\n%s", text)
+	}
+}
+
+func TestProgramTraceKeepsIrqRecords(t *testing.T) {
+	defer ResetMachine()
+	// sti; mov ax, 1; hlt; iret with irq0 waiting and its vector pointing at the iret
+	fileName := writeProgram(t, "irq.bin", []byte{0xfb, 0xb8, 0x01, 0x00, 0xf4, 0xcf})
+	trace, err := NewProgramTrace(fileName, testOptions(), 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	previous := SaveMachine()
+	trace.machine.Activate()
+	MemoryValues.Poke(0x08*4, 0x0005, true)
+	InterruptController.Raise(0)
+	trace.machine = SaveMachine()
+	previous.Activate()
+
+	var mnemonics []string
+	for {
+		record, ok, err := trace.Next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !ok {
+			break
+		}
+		mnemonics = append(mnemonics, record.Mnemonic)
+	}
+	// sti holds the irq off for one instruction, then it's taken after the mov
+	if want := []string{"sti", "mov", "irq", "iret", "hlt"}; !slices.Equal(mnemonics, want) {
+		t.Errorf("traced %q, want %q", mnemonics, want)
+	}
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+type WatchKind int
+
+const (
+	WatchRead WatchKind = 1 << iota
+	WatchWrite
+	WatchChange // writes that actually change the stored value
+)
+
+var watchKindNames = map[string]WatchKind{
+	"r":      WatchRead,
+	"w":      WatchWrite,
+	"rw":     WatchRead | WatchWrite,
+	"change": WatchChange,
+}
+
+func (k WatchKind) String() string {
+	for name, kind := range watchKindNames {
+		if kind == k {
+			return name
+		}
+	}
+	return "?"
+}
+
+// Watchpoint triggers on accesses that touch any byte in [Start, End)
+type Watchpoint struct {
+	ID         int
+	Kind       WatchKind
+	Start, End uint32
+	Hits       int
+}
+
+func (w *Watchpoint) String() string {
+	return fmt.Sprintf("%d: %s %05x,%d (hit %d times)", w.ID, w.Kind, w.Start, w.End-w.Start, w.Hits)
+}
+
+func (w *Watchpoint) matches(access MemoryAccess) bool {
+	end := access.Address + 1
+	if access.Wide {
+		end++
+	}
+	if access.Address >= w.End || end <= w.Start {
+		return false
+	}
+
+	switch access.Kind {
+	case MemoryRead:
+		return w.Kind&WatchRead != 0
+	default:
+		return w.Kind&WatchWrite != 0 || (w.Kind&WatchChange != 0 && access.Old != access.New)
+	}
+}
+
+// WatchHit is a memory access that triggered a watchpoint and the instruction that made it
+type WatchHit struct {
+	Watchpoint  *Watchpoint
+	Access      MemoryAccess
+	Instruction Instruction
+	IP          uint16 // ip of the instruction making the access
+}
+
+func (h WatchHit) String() string {
+	size := "byte"
+	if h.Access.Wide {
+		size = "word"
+	}
+	return fmt.Sprintf("watchpoint %d: %s %s [%05x] %x -> %x by `%s` at ip %x",
+		h.Watchpoint.ID, h.Access.Kind, size, h.Access.Address, h.Access.Old, h.Access.New, h.Instruction, h.IP)
+}
+
+// Watchpoints observes a Memory and collects the accesses that hit any of its watchpoints
+type Watchpoints struct {
+	List   []*Watchpoint
+	nextID int
+
+	hits []WatchHit
+}
+
+// NewWatchpoints creates an empty set of watchpoints that watches memory
+func NewWatchpoints(memory *Memory) *Watchpoints {
+	ws := &Watchpoints{}
+	memory.Observe(ws.observe)
+	return ws
+}
+
+func (ws *Watchpoints) observe(access MemoryAccess) {
+	for _, w := range ws.List {
+		if w.matches(access) {
+			w.Hits++
+			ws.hits = append(ws.hits, WatchHit{
+				Watchpoint:  w,
+				Access:      access,
+				Instruction: CurrentInstruction,
+				IP:          CurrentIP,
+			})
+		}
+	}
+}
+
+// AddRange watches length bytes starting at address
+func (ws *Watchpoints) AddRange(kind WatchKind, address, length uint32) *Watchpoint {
+	ws.nextID++
+	w := &Watchpoint{ID: ws.nextID, Kind: kind, Start: address, End: address + length}
+	ws.List = append(ws.List, w)
+	return w
+}
+
+// Add parses `<r|w|rw|change> <address>[,<length>]` e.g. `w ss:sp,2` or `change 17000,24`
+func (ws *Watchpoints) Add(spec string) (*Watchpoint, error) {
+	kindName, location, found := strings.Cut(strings.TrimSpace(spec), " ")
+	kind, ok := watchKindNames[kindName]
+	if !found || !ok {
+		return nil, fmt.Errorf("watchpoint should look like <r|w|rw|change> <address>[,<length>]")
+	}
+
+	location, lengthText, hasLength := strings.Cut(location, ",")
+	address, err := ParseAddress(strings.ReplaceAll(location, " ", ""))
+	if err != nil {
+		return nil, err
+	}
+	length := uint64(1)
+	if hasLength {
+		if length, err = strconv.ParseUint(strings.TrimSpace(lengthText), 0, 32); err != nil || length == 0 {
+			return nil, fmt.Errorf("invalid watchpoint length %q", lengthText)
+		}
+	}
+	return ws.AddRange(kind, address, uint32(length)), nil
+}
+
+// Delete removes the watchpoint with the given id
+func (ws *Watchpoints) Delete(id int) error {
+	for i, w := range ws.List {
+		if w.ID == id {
+			ws.List = append(ws.List[:i], ws.List[i+1:]...)
+			return nil
+		}
+	}
+	return fmt.Errorf("no watchpoint %d", id)
+}
+
+// TakeHits returns the hits collected since the last call
+func (ws *Watchpoints) TakeHits() []WatchHit {
+	if ws == nil {
+		return nil
+	}
+	hits := ws.hits
+	ws.hits = nil
+	return hits
+}
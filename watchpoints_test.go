@@ -0,0 +1,38 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestWatchHitIP(t *testing.T) {
+	ResetMachine()
+	// a cs that isn't 64k aligned so the low bits of the physical address aren't the ip
+	for _, register := range []Register{Register_cs, Register_ds, Register_ss} {
+		WriteU16(RegisterValues[register], 0, 0x1010)
+	}
+	WriteU16(RegisterValues[Register_ip], 0, 0)
+	WriteU16(RegisterValues[Register_sp], 0, 0x1000)
+	// mov [200h], ax; int 21h which pushes flags and cs:ip on the way to a handler in another segment
+	program := []byte{0xa3, 0x00, 0x02, 0xcd, 0x21}
+	MemoryValues.Poke(0x21*4+2, 0x2000, true)
+	copy(MemoryValues.Bytes[0x10100:], program)
+	instructions := DecodeFlow(MemoryValues.Bytes, 0x10100, 0x10100+len(program), 0x10100).Instructions
+
+	watchpoints := NewWatchpoints(&MemoryValues)
+	watchpoints.AddRange(WatchWrite, 0x10300, 2)
+	watchpoints.AddRange(WatchWrite, 0x110fa, 6)
+	for _, want := range []uint16{0, 3} {
+		if _, ok := Step(instructions, []bool{false, false, false}); !ok {
+			t.Fatalf("nothing decoded at %05x", InstructionAddress())
+		}
+		hits := watchpoints.TakeHits()
+		if len(hits) == 0 {
+			t.Errorf("the instruction at ip %x hit no watchpoints", want)
+		}
+		for _, hit := range hits {
+			if hit.IP != want {
+				t.Errorf("%s, want ip %x", hit, want)
+			}
+		}
+	}
+}